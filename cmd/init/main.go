@@ -1,10 +1,17 @@
 package main
 
 import (
+	"crypto/x509"
+	"fmt"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"io/ioutil"
+	"k8s-pod-mutator-webhook/internal/k8s_client"
 	"k8s-pod-mutator-webhook/internal/logger"
 	cert_generator "k8s-pod-mutator-webhook/pkg/cert-generator"
 	"k8s-pod-mutator-webhook/pkg/webhook"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"time"
 )
 
 var rootCmd = &cobra.Command{
@@ -16,43 +23,388 @@ var rootCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		logger.SetLogLevel(cmd.Flag("log-level").Value.String())
 
-		initWebhook()
+		initWebhook(k8s_client.NewFactory(parameters.k8sClientSettings))
 	},
 }
 
+var cleanupCmd = &cobra.Command{
+	Use:   "cleanup",
+	Short: "Deletes the webhook configurations and cert Secrets owned by '--owner', e.g. as helm pre-delete hook",
+	Run: func(cmd *cobra.Command, args []string) {
+		logger.SetLogLevel(cmd.Flag("log-level").Value.String())
+
+		cleanup(k8s_client.NewFactory(parameters.k8sClientSettings))
+	},
+}
+
+const (
+	generateCertsMode = "generate"
+	externalCertsMode = "external"
+)
+
+const (
+	disabledVerification = "disabled"
+	reportVerification   = "report"
+	requiredVerification = "required"
+)
+
+const (
+	verificationAttemptTimeout = 10 * time.Second
+	verificationRetryInterval  = 2 * time.Second
+)
+
+const (
+	fullApplyMode     = "full"
+	caBundleApplyMode = "ca-bundle"
+)
+
 var parameters = &struct {
-	certOutputFiles       cert_generator.CertOutputFiles
-	webhookConfigTemplate string
+	certsMode          string
+	applyMode          string
+	owner              string
+	k8sClientSettings  k8s_client.Settings
+	externalCerts      externalCertsParameters
+	certOutputFiles    cert_generator.CertOutputFiles
+	certSettings       cert_generator.CertSettings
+	certSecretSettings cert_generator.SecretSettings
+	externalCa         externalCaParameters
+	webhookConfig      webhook.ConfigurationSourceSettings
+	verification       verificationParameters
 }{
-	certOutputFiles:       cert_generator.CertOutputFiles{},
-	webhookConfigTemplate: "",
+	certsMode:          generateCertsMode,
+	applyMode:          fullApplyMode,
+	owner:              webhook.DefaultOwner,
+	k8sClientSettings:  k8s_client.Settings{},
+	externalCerts:      externalCertsParameters{},
+	certOutputFiles:    cert_generator.CertOutputFiles{},
+	certSettings:       cert_generator.CertSettings{},
+	certSecretSettings: cert_generator.SecretSettings{},
+	externalCa:         externalCaParameters{},
+	webhookConfig:      webhook.ConfigurationSourceSettings{},
+	verification:       verificationParameters{},
 }
 
-func initWebhook() {
-	webhookConfiguration, err := webhook.ConfigurationFromTemplate(parameters.webhookConfigTemplate)
+func initWebhook(clientFactory k8s_client.Factory) {
+	// otherwise the certs in the Secret would be due for renewal on every run
+	if parameters.certSecretSettings.Name != "" && parameters.certSettings.TlsValidity <= parameters.certSecretSettings.RenewBefore {
+		logger.Logger.Fatal("'--tls-validity' must exceed '--cert-renew-before'")
+	}
+	if err := webhook.ValidateOwner(parameters.owner); err != nil {
+		logger.Logger.Fatal(err.Error())
+	}
+
+	webhookConfiguration, err := webhook.LoadConfiguration(parameters.webhookConfig)
 	if err != nil {
 		logger.Logger.Fatal(err.Error())
 	}
+	webhookConfiguration.SetOwner(parameters.owner)
+
+	var caBundle []byte
+	switch parameters.certsMode {
+	case generateCertsMode:
+		serviceMetadata, err := webhookConfiguration.GetServiceMetadata()
+		if err != nil {
+			logger.Logger.Fatal(err.Error())
+		}
+		certs, err := provideCerts(serviceMetadata, clientFactory)
+		if err != nil {
+			logger.Logger.Fatal(err.Error())
+		}
+		caBundle = certs.CaCert
+	case externalCertsMode:
+		caBundle, err = externalCaBundle(webhookConfiguration)
+		if err != nil {
+			logger.Logger.Fatal(err.Error())
+		}
+	default:
+		logger.Logger.Fatalf("unknown certs mode %q, expected %q or %q", parameters.certsMode, generateCertsMode, externalCertsMode)
+	}
 
-	certs, err := cert_generator.Generate(webhookConfiguration.GetServiceMetadata(), parameters.certOutputFiles)
+	if err = applyWebhookConfiguration(webhookConfiguration, caBundle, clientFactory); err != nil {
+		logger.Logger.Fatal(err.Error())
+	}
+
+	if err = verifyWebhook(webhookConfiguration, caBundle, clientFactory); err != nil {
+		logger.Logger.Fatal(err.Error())
+	}
+}
+
+type verificationParameters struct {
+	mode           string
+	timeout        time.Duration
+	address        string
+	clientCertFile string
+	clientKeyFile  string
+}
+
+// verifyWebhook checks that the webhook is reachable with the caBundle and records the result on the webhook configurations.
+// It only fails if the verification is required.
+func verifyWebhook(webhookConfiguration *webhook.Configuration, caBundle []byte, clientFactory k8s_client.Factory) error {
+	switch parameters.verification.mode {
+	case disabledVerification:
+		return nil
+	case reportVerification, requiredVerification:
+	default:
+		return fmt.Errorf("unknown verification mode %q, expected %q, %q or %q", parameters.verification.mode, disabledVerification, reportVerification, requiredVerification)
+	}
+
+	if caBundle == nil {
+		logger.Logger.Warnln("caBundle is managed externally, not verifying the webhook")
+		return nil
+	}
+
+	settings := webhook.VerificationSettings{
+		Timeout:        verificationAttemptTimeout,
+		Address:        parameters.verification.address,
+		ClientCertFile: parameters.verification.clientCertFile,
+		ClientKeyFile:  parameters.verification.clientKeyFile,
+	}
+	var verificationErr error
+	// the webhook may still be starting, e.g. after an upgrade
+	_ = wait.PollImmediate(verificationRetryInterval, parameters.verification.timeout, func() (bool, error) {
+		if verificationErr = webhookConfiguration.Verify(caBundle, settings); verificationErr != nil {
+			logger.Logger.WithFields(logrus.Fields{
+				"error": verificationErr,
+			}).Warnln("could not verify webhook, retrying")
+			return false, nil
+		}
+		return true, nil
+	})
+
+	client, err := clientFactory()
 	if err != nil {
+		return err
+	}
+	if err := webhookConfiguration.RecordVerification(client, verificationErr); err != nil {
+		logger.Logger.WithFields(logrus.Fields{
+			"error": err,
+		}).Warnln("could not record verification")
+	}
+
+	if verificationErr == nil {
+		return nil
+	}
+	if parameters.verification.mode == requiredVerification {
+		return fmt.Errorf("could not verify webhook: %v", verificationErr)
+	}
+	logger.Logger.WithFields(logrus.Fields{
+		"error": verificationErr,
+	}).Errorln("could not verify webhook")
+	return nil
+}
+
+func applyWebhookConfiguration(webhookConfiguration *webhook.Configuration, caBundle []byte, clientFactory k8s_client.Factory) error {
+	client, err := clientFactory()
+	if err != nil {
+		return err
+	}
+
+	switch parameters.applyMode {
+	case fullApplyMode:
+		return webhookConfiguration.ApplyInCluster(client, caBundle)
+	case caBundleApplyMode:
+		return webhookConfiguration.PatchCaBundle(client, caBundle)
+	default:
+		return fmt.Errorf("unknown apply mode %q, expected %q or %q", parameters.applyMode, fullApplyMode, caBundleApplyMode)
+	}
+}
+
+func cleanup(clientFactory k8s_client.Factory) {
+	if err := webhook.ValidateOwner(parameters.owner); err != nil {
 		logger.Logger.Fatal(err.Error())
 	}
 
-	if err = webhookConfiguration.ApplyInCluster(certs.CaCert); err != nil {
+	client, err := clientFactory()
+	if err != nil {
 		logger.Logger.Fatal(err.Error())
 	}
+
+	if err := webhook.DeleteOwnedConfigurations(client, parameters.owner); err != nil {
+		logger.Logger.Fatal(err.Error())
+	}
+
+	if parameters.certSecretSettings.Name == "" {
+		logger.Logger.Infoln("not deleting owned secrets, '--cert-secret' is not set")
+		return
+	}
+	namespace, err := certSecretNamespace()
+	if err != nil {
+		logger.Logger.WithFields(logrus.Fields{
+			"error": err,
+		}).Warnln("not deleting owned secrets, set '--cert-secret-namespace'")
+		return
+	}
+	if err := cert_generator.DeleteOwnedSecrets(client, namespace, []string{parameters.certSecretSettings.Name}, parameters.owner); err != nil {
+		logger.Logger.Fatal(err.Error())
+	}
+}
+
+// certSecretNamespace returns '--cert-secret-namespace', which defaults to the namespace of the webhook service
+func certSecretNamespace() (string, error) {
+	if parameters.certSecretSettings.Namespace != "" {
+		return parameters.certSecretSettings.Namespace, nil
+	}
+
+	webhookConfiguration, err := webhook.LoadConfiguration(parameters.webhookConfig)
+	if err != nil {
+		return "", err
+	}
+	serviceMetadata, err := webhookConfiguration.GetServiceMetadata()
+	if err != nil {
+		return "", err
+	}
+	if serviceMetadata.Namespace == "" {
+		return "", fmt.Errorf("'--cert-secret-namespace' is required if the webhook is reached by url")
+	}
+	return serviceMetadata.Namespace, nil
+}
+
+type externalCertsParameters struct {
+	caBundleFile           string
+	certManagerCertificate string
+}
+
+// externalCaBundle returns the caBundle for certs that are managed externally, or nil if the caBundle is managed externally as well
+func externalCaBundle(webhookConfiguration *webhook.Configuration) ([]byte, error) {
+	if parameters.externalCerts.caBundleFile != "" && parameters.externalCerts.certManagerCertificate != "" {
+		return nil, fmt.Errorf("'--ca-bundle' and '--cert-manager-certificate' are mutually exclusive")
+	}
+
+	if parameters.externalCerts.certManagerCertificate != "" {
+		webhookConfiguration.InjectCaFromCertManager(parameters.externalCerts.certManagerCertificate)
+		return nil, nil
+	}
+
+	if parameters.externalCerts.caBundleFile != "" {
+		logger.Logger.WithFields(logrus.Fields{
+			"caBundleFile": parameters.externalCerts.caBundleFile,
+		}).Infoln("reading external caBundle")
+		caBundle, err := ioutil.ReadFile(parameters.externalCerts.caBundleFile)
+		if err != nil {
+			return nil, err
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("'--ca-bundle' does not contain any PEM encoded certs")
+		}
+		return caBundle, nil
+	}
+
+	logger.Logger.Infoln("no external caBundle given, keeping the caBundle present in the cluster")
+	return nil, nil
+}
+
+type externalCaParameters struct {
+	certFile        string
+	keyFile         string
+	secretName      string
+	secretNamespace string
+}
+
+func provideCerts(serviceMetadata webhook.ServiceMetadata, clientFactory k8s_client.Factory) (*cert_generator.Certs, error) {
+	ca, err := loadExternalCa(serviceMetadata, clientFactory)
+	if err != nil {
+		return nil, err
+	}
+	parameters.certSettings.Ca = ca
+
+	if parameters.certSecretSettings.Name == "" {
+		return cert_generator.Generate(serviceMetadata, parameters.certSettings, parameters.certOutputFiles)
+	}
+
+	client, err := clientFactory()
+	if err != nil {
+		return nil, err
+	}
+
+	secretSettings := parameters.certSecretSettings
+	secretSettings.Owner = parameters.owner
+	if secretSettings.Namespace == "" {
+		secretSettings.Namespace = serviceMetadata.Namespace
+	}
+	if secretSettings.Namespace == "" {
+		return nil, fmt.Errorf("'--cert-secret-namespace' is required if the webhook is reached by url")
+	}
+	return cert_generator.GenerateOrReuse(client, serviceMetadata, parameters.certSettings, secretSettings, parameters.certOutputFiles)
+}
+
+func loadExternalCa(serviceMetadata webhook.ServiceMetadata, clientFactory k8s_client.Factory) (*cert_generator.CertificateAuthority, error) {
+	if parameters.externalCa.secretName != "" {
+		client, err := clientFactory()
+		if err != nil {
+			return nil, err
+		}
+		namespace := parameters.externalCa.secretNamespace
+		if namespace == "" {
+			namespace = serviceMetadata.Namespace
+		}
+		if namespace == "" {
+			return nil, fmt.Errorf("'--external-ca-secret-namespace' is required if the webhook is reached by url")
+		}
+		return cert_generator.LoadCaFromSecret(client, parameters.externalCa.secretName, namespace)
+	}
+	if parameters.externalCa.certFile != "" || parameters.externalCa.keyFile != "" {
+		return cert_generator.LoadCaFromFiles(parameters.externalCa.certFile, parameters.externalCa.keyFile)
+	}
+	return nil, nil
 }
 
 func init() {
+	rootCmd.AddCommand(cleanupCmd)
+
 	rootCmd.PersistentFlags().String("log-level", "info", "panic | fatal | error | warn | info | debug | trace")
 
+	rootCmd.PersistentFlags().StringVar(&parameters.certsMode, "certs", generateCertsMode, fmt.Sprintf("%q: generate certs (or issue them with '--external-ca-*') | %q: certs are managed externally (e.g. by cert-manager) and mounted into the webhook, no certs are generated", generateCertsMode, externalCertsMode))
+	rootCmd.PersistentFlags().StringVar(&parameters.externalCerts.caBundleFile, "ca-bundle", "", "Path to the caBundle for externally managed certs, e.g. 'ca.crt' of a mounted cert-manager Secret. Has no effect unless '--certs=external'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.externalCerts.certManagerCertificate, "cert-manager-certificate", "", "cert-manager Certificate ('<namespace>/<name>') whose CA is injected as caBundle by cert-manager's cainjector. Has no effect unless '--certs=external'.")
+
 	rootCmd.PersistentFlags().StringVar(&parameters.certOutputFiles.CaCertOutputFile, "ca-cert-output", "/etc/k8s-pod-mutator/certs/ca.crt", "Output file path for the CA cert.")
 	rootCmd.PersistentFlags().StringVar(&parameters.certOutputFiles.CaKeyOutputFile, "ca-key-output", "/etc/k8s-pod-mutator/certs/ca.key", "Output file path for the CA key.")
 	rootCmd.PersistentFlags().StringVar(&parameters.certOutputFiles.TlsCertOutputFile, "tls-cert-output", "/etc/k8s-pod-mutator/certs/tls.crt", "Output file path for the TLS cert.")
 	rootCmd.PersistentFlags().StringVar(&parameters.certOutputFiles.TlsKeyOutputFile, "tls-key-output", "/etc/k8s-pod-mutator/certs/tls.key", "Output file path for the TLS key.")
 
-	rootCmd.PersistentFlags().StringVar(&parameters.webhookConfigTemplate, "webhook-config-template", "/etc/k8s-pod-mutator/config/webhook_config_template.yaml", "Path to the manifest template file for the MutatingWebhookConfiguration")
+	rootCmd.PersistentFlags().StringVar((*string)(&parameters.certSettings.KeyAlgorithm), "key-algorithm", string(cert_generator.DefaultCertSettings.KeyAlgorithm), fmt.Sprintf("Algorithm of the generated CA and TLS keys: %v. Keys are written in PKCS#8 format.", cert_generator.KeyAlgorithms))
+	rootCmd.PersistentFlags().DurationVar(&parameters.certSettings.CaValidity, "ca-validity", cert_generator.DefaultCertSettings.CaValidity, "Validity of the generated CA cert.")
+	rootCmd.PersistentFlags().DurationVar(&parameters.certSettings.TlsValidity, "tls-validity", cert_generator.DefaultCertSettings.TlsValidity, "Validity of the generated TLS cert. Must not exceed '--ca-validity' and must exceed '--cert-renew-before'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certSettings.Organization, "cert-organization", cert_generator.DefaultCertSettings.Organization, "Organization in the subject of the generated CA and TLS certs.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certSettings.CaCommonName, "ca-common-name", cert_generator.DefaultCertSettings.CaCommonName, "Common name in the subject of the generated CA cert.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certSettings.ClusterDomain, "cluster-domain", cert_generator.DefaultCertSettings.ClusterDomain, "Cluster domain, adds '<service>.<namespace>.svc.<cluster-domain>' to the TLS cert. Empty to omit.")
+	rootCmd.PersistentFlags().StringSliceVar(&parameters.certSettings.DnsNames, "extra-dns-names", nil, "Additional DNS names of the TLS cert, e.g. to reach the webhook from outside the cluster.")
+	rootCmd.PersistentFlags().IPSliceVar(&parameters.certSettings.IpAddresses, "extra-ip-addresses", nil, "Additional IP addresses of the TLS cert.")
+
+	rootCmd.PersistentFlags().StringVar(&parameters.externalCa.certFile, "external-ca-cert", "", "Path to the cert (chain) of an existing CA that issues the TLS cert instead of a generated CA. The whole chain is published as caBundle.")
+	rootCmd.PersistentFlags().StringVar(&parameters.externalCa.keyFile, "external-ca-key", "", "Path to the key of the CA from '--external-ca-cert'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.externalCa.secretName, "external-ca-secret", "", "Name of a Secret of type 'kubernetes.io/tls' containing an existing CA, alternatively to '--external-ca-cert' and '--external-ca-key'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.externalCa.secretNamespace, "external-ca-secret-namespace", "", "Namespace of the Secret from '--external-ca-secret'. Defaults to the namespace of the webhook service.")
+
+	rootCmd.PersistentFlags().StringVar(&parameters.certSecretSettings.Name, "cert-secret", "", "Name of a Secret to persist the generated certs in, so that all replicas share the same certs. Certs are only regenerated if the Secret is missing, invalid or about to expire. If empty, new certs are generated on every run.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certSecretSettings.Namespace, "cert-secret-namespace", "", "Namespace of the Secret from '--cert-secret'. Defaults to the namespace of the webhook service.")
+	rootCmd.PersistentFlags().DurationVar(&parameters.certSecretSettings.RenewBefore, "cert-renew-before", 30*24*time.Hour, "Regenerate the certs from '--cert-secret' if they expire within this duration.")
+
+	rootCmd.PersistentFlags().StringVar(&parameters.applyMode, "apply-mode", fullApplyMode, fmt.Sprintf("%q: create or update the webhook configurations by server-side apply (field manager %q) | %q: only patch the caBundle of existing webhook configurations, e.g. if they are managed by helm", fullApplyMode, webhook.FieldManager, caBundleApplyMode))
+	rootCmd.PersistentFlags().StringVar(&parameters.k8sClientSettings.Kubeconfig, "kubeconfig", "", "Path to a kubeconfig file, e.g. to run outside of a cluster. Defaults to the in-cluster config, or $KUBECONFIG / ~/.kube/config outside of a cluster.")
+	rootCmd.PersistentFlags().StringVar(&parameters.k8sClientSettings.Context, "context", "", "Context of the kubeconfig to use. Defaults to its current context.")
+
+	rootCmd.PersistentFlags().StringVar(&parameters.verification.mode, "verification", disabledVerification, fmt.Sprintf("%q | %q: after applying, verify that the webhook is reachable with the caBundle by a TLS handshake and a synthetic AdmissionReview, log the result and record it in the annotation %q | %q: additionally fail if the verification fails. The webhook must be running already, i.e. the init must not run as init-container of the webhook itself.", disabledVerification, reportVerification, webhook.VerificationAnnotation, requiredVerification))
+	rootCmd.PersistentFlags().DurationVar(&parameters.verification.timeout, "verification-timeout", time.Minute, "Duration for which the verification is retried, e.g. while the webhook is starting.")
+	rootCmd.PersistentFlags().StringVar(&parameters.verification.address, "verification-address", "", "Address ('<host>:<port>') to reach the webhook at during the verification instead of its service, e.g. a port-forward when running outside of the cluster.")
+	rootCmd.PersistentFlags().StringVar(&parameters.verification.clientCertFile, "verification-client-cert", "", "Path to a client cert presented during the verification, e.g. the one the API server presents to the webhook. Required if the webhook runs with '--client-ca'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.verification.clientKeyFile, "verification-client-key", "", "Path to the key of '--verification-client-cert'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.owner, "owner", webhook.DefaultOwner, fmt.Sprintf("Identifies the installation. The webhook configurations and cert Secrets created at runtime are labeled with %q, so that 'cleanup' can delete them. Must be a valid label value.", webhook.OwnerLabel))
+	rootCmd.PersistentFlags().StringVar(&parameters.webhookConfig.Source, "webhook-config-source", webhook.TemplateConfigurationSource, fmt.Sprintf("%q: read the webhook configurations from '--webhook-config-template' | %q: build a MutatingWebhookConfiguration for Pods from the '--webhook-*' and '--service-*' flags", webhook.TemplateConfigurationSource, webhook.FlagsConfigurationSource))
+	rootCmd.PersistentFlags().StringVar(&parameters.webhookConfig.Template, "webhook-config-template", "/etc/k8s-pod-mutator/config/webhook_config_template.yaml", "Path to the manifest template file for the webhook configurations. May contain several Mutating- and ValidatingWebhookConfigurations, separated by '---'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.webhookConfig.Generated.Name, "webhook-config-name", webhook.DefaultGeneratedConfigurationSettings.Name, "Name of the MutatingWebhookConfiguration. Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.webhookConfig.Generated.WebhookName, "webhook-name", webhook.DefaultGeneratedConfigurationSettings.WebhookName, "Fully qualified name of the webhook. Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.webhookConfig.Generated.ServiceName, "service-name", "", "Name of the webhook service. Required if '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.webhookConfig.Generated.ServiceNamespace, "service-namespace", "", "Namespace of the webhook service. Required if '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.webhookConfig.Generated.ServicePath, "service-path", webhook.DefaultGeneratedConfigurationSettings.ServicePath, "Path of the webhook. Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().Int32Var(&parameters.webhookConfig.Generated.ServicePort, "service-port", webhook.DefaultGeneratedConfigurationSettings.ServicePort, "Port of the webhook service. Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringSliceVar(&parameters.webhookConfig.Generated.Operations, "webhook-operations", webhook.DefaultGeneratedConfigurationSettings.Operations, "Operations on Pods that are sent to the webhook: CREATE, UPDATE, DELETE, CONNECT or *. Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.webhookConfig.Generated.FailurePolicy, "webhook-failure-policy", webhook.DefaultGeneratedConfigurationSettings.FailurePolicy, "Ignore | Fail. Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().Int32Var(&parameters.webhookConfig.Generated.TimeoutSeconds, "webhook-timeout-seconds", webhook.DefaultGeneratedConfigurationSettings.TimeoutSeconds, "Timeout of the webhook (1-30). Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.webhookConfig.Generated.ReinvocationPolicy, "webhook-reinvocation-policy", webhook.DefaultGeneratedConfigurationSettings.ReinvocationPolicy, "Never | IfNeeded. Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringSliceVar(&parameters.webhookConfig.Generated.AdmissionReviewVersions, "webhook-admission-review-versions", webhook.DefaultGeneratedConfigurationSettings.AdmissionReviewVersions, "AdmissionReview versions accepted by the webhook, in order of preference: v1, v1beta1. Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.webhookConfig.Generated.NamespaceSelector, "webhook-namespace-selector", webhook.DefaultGeneratedConfigurationSettings.NamespaceSelector, "Label selector of the namespaces whose Pods are sent to the webhook, e.g. '!control-plane,environment in (dev,test)'. Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.webhookConfig.Generated.ObjectSelector, "webhook-object-selector", webhook.DefaultGeneratedConfigurationSettings.ObjectSelector, "Label selector of the Pods that are sent to the webhook, e.g. 'aadpodidbinding'. Has no effect unless '--webhook-config-source=flags'.")
 }
 
 func main() {
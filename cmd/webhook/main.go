@@ -1,13 +1,22 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"k8s-pod-mutator-webhook/internal/k8s_client"
 	"k8s-pod-mutator-webhook/internal/logger"
+	cert_generator "k8s-pod-mutator-webhook/pkg/cert-generator"
 	"k8s-pod-mutator-webhook/pkg/mutator"
 	"k8s-pod-mutator-webhook/pkg/webhook"
+	"k8s.io/client-go/kubernetes"
+	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"syscall"
+	"time"
 )
 
 var rootCmd = &cobra.Command{
@@ -16,7 +25,7 @@ var rootCmd = &cobra.Command{
 	Long: `
 This webhook mutates a Pod's manifest by applying changes from a YAML file (a "patch"), which can contain virtually arbitrary changes 
 - e.g. adding containers/init-containers or volumes, changing metadata etc.
-After successful mutation the Pod is marked with an annotation ("k8s-pod-mutator.io/mutated=true") to prevent repeated mutation.
+After successful mutation the Pod is marked with an annotation ("k8s-pod-mutator.io/mutated=true", or "k8s-pod-mutator.io/mutated-<profile>=true" for profiles) to prevent repeated mutation.
 
 By default, the webhook is reachable under "https://<service_name>:8443/mutate"
 
@@ -25,51 +34,363 @@ For more information regarding Admission Controllers, see https://kubernetes.io/
 	Run: func(cmd *cobra.Command, args []string) {
 		logger.SetLogLevel(cmd.Flag("log-level").Value.String())
 
-		serveWebhook()
+		serveWebhook(k8s_client.NewFactory(parameters.k8sClientSettings))
 	},
 }
 
+const (
+	minRegistrationRetryDelay = time.Second
+	maxRegistrationRetryDelay = time.Minute
+)
+
 var parameters = &struct {
-	serverSettings   webhook.ServerSettings
-	mutationSettings mutator.MutationSettings
+	serverSettings            webhook.ServerSettings
+	mutationSettings          mutator.MutationSettings
+	profiles                  map[string]string
+	profileRolloutPercentages map[string]int
+	profileRolloutSeeds       map[string]string
+	certRotation              certRotationParameters
+	selfRegistration          bool
+	k8sClientSettings         k8s_client.Settings
 }{
-	serverSettings:   webhook.ServerSettings{},
-	mutationSettings: mutator.MutationSettings{},
+	serverSettings:    webhook.ServerSettings{},
+	mutationSettings:  mutator.MutationSettings{},
+	certRotation:      certRotationParameters{},
+	selfRegistration:  false,
+	k8sClientSettings: k8s_client.Settings{},
+}
+
+type certRotationParameters struct {
+	enabled            bool
+	settings           cert_generator.RotationSettings
+	certSettings       cert_generator.CertSettings
+	secretSettings     cert_generator.SecretSettings
+	caCertFile         string
+	caKeyFile          string
+	externalCaCertFile string
+	externalCaKeyFile  string
+	externalCaSecret   string
+	owner              string
+	webhookConfig      webhook.ConfigurationSourceSettings
 }
 
-func serveWebhook() {
-	mutator, err := mutator.CreateMutator(parameters.mutationSettings)
+func serveWebhook(clientFactory k8s_client.Factory) {
+	mutators, err := createMutators()
 	if err != nil {
 		logger.Logger.Fatal(err.Error())
 	}
 
-	server, err := webhook.CreateServer(parameters.serverSettings, *mutator)
+	server, err := webhook.CreateServer(parameters.serverSettings, mutators)
 	if err != nil {
 		logger.Logger.Fatal(err.Error())
 	}
 
-	go func() {
-		if err := server.Start(); err != nil {
+	var provisioning *certProvisioning
+	if parameters.certRotation.enabled || parameters.selfRegistration {
+		if provisioning, err = createCertProvisioning(clientFactory); err != nil {
 			logger.Logger.Fatal(err.Error())
 		}
+	}
+
+	var caBundle []byte
+	if parameters.selfRegistration {
+		// the certs must exist before the server starts, the webhook must not receive requests before it is registered
+		certs, err := provisioning.provideCerts()
+		if err != nil {
+			logger.Logger.Fatal(err.Error())
+		}
+		caBundle = certs.CaCert
+		server.SetReady(false)
+	}
+
+	serverErrChan := make(chan error, 1)
+	go func() {
+		serverErrChan <- server.Start()
 	}()
 
+	stopChan := make(chan struct{})
+	if provisioning != nil {
+		rotator, err := provisioning.createCertRotator(server)
+		if err != nil {
+			logger.Logger.Fatal(err.Error())
+		}
+
+		go func() {
+			if parameters.selfRegistration {
+				if err := provisioning.register(caBundle, stopChan); err != nil {
+					return
+				}
+				server.SetReady(true)
+			}
+			rotator.Run(stopChan)
+		}()
+	}
+
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
-	<-signalChan
+	select {
+	case receivedSignal := <-signalChan:
+		logger.Logger.WithFields(logrus.Fields{
+			"signal": receivedSignal,
+		}).Infoln("received signal, shutting down")
+	case err := <-serverErrChan:
+		// the server only stops on its own if it fails, e.g. because the port is in use
+		if err == nil || errors.Is(err, http.ErrServerClosed) {
+			err = fmt.Errorf("server stopped unexpectedly")
+		}
+		logger.Logger.Fatal(err.Error())
+	}
+
+	close(stopChan)
+	if err := server.Stop(); err != nil {
+		logger.Logger.Fatal(err.Error())
+	}
+	if err := <-serverErrChan; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Logger.Fatal(err.Error())
+	}
+}
+
+// createMutators creates the default mutator from '--patch' and one for each of '--profiles', with the rollout of the
+// profile or else the default rollout
+func createMutators() (*mutator.Registry, error) {
+	for profile := range parameters.profileRolloutPercentages {
+		if _, ok := parameters.profiles[profile]; !ok {
+			return nil, fmt.Errorf("'--profile-rollout-percentages': unknown profile %q", profile)
+		}
+	}
+	for profile := range parameters.profileRolloutSeeds {
+		if _, ok := parameters.profiles[profile]; !ok {
+			return nil, fmt.Errorf("'--profile-rollout-seeds': unknown profile %q", profile)
+		}
+	}
+
+	defaultMutator, err := mutator.CreateMutator(parameters.mutationSettings)
+	if err != nil {
+		return nil, err
+	}
+	mutators := mutator.NewRegistry(*defaultMutator)
+
+	var profiles []string
+	for profile := range parameters.profiles {
+		profiles = append(profiles, profile)
+	}
+	sort.Strings(profiles)
+	for _, profile := range profiles {
+		settings := parameters.mutationSettings
+		settings.Profile = profile
+		settings.PatchFile = parameters.profiles[profile]
+		if percentage, ok := parameters.profileRolloutPercentages[profile]; ok {
+			settings.RolloutPercentage = percentage
+		}
+		if seed, ok := parameters.profileRolloutSeeds[profile]; ok {
+			settings.RolloutSeed = seed
+		}
+		profileMutator, err := mutator.CreateMutator(settings)
+		if err != nil {
+			return nil, fmt.Errorf("could not create mutator of profile %q: %v", profile, err)
+		}
+		if err := mutators.Add(*profileMutator); err != nil {
+			return nil, err
+		}
+	}
+	return mutators, nil
+}
 
-	_ = server.Stop()
+// certProvisioning provides, renews and registers the certs of the webhook
+type certProvisioning struct {
+	client          kubernetes.Interface
+	configuration   *webhook.Configuration
+	serviceMetadata webhook.ServiceMetadata
+	certSettings    cert_generator.CertSettings
+	// secretSettings.Name is empty if the certs are not persisted in a Secret
+	secretSettings cert_generator.SecretSettings
+	outputFiles    cert_generator.CertOutputFiles
+}
+
+func createCertProvisioning(clientFactory k8s_client.Factory) (*certProvisioning, error) {
+	if !parameters.serverSettings.Tls {
+		return nil, fmt.Errorf("cert rotation and self-registration require '--tls=true'")
+	}
+	if err := cert_generator.ValidateRotationSettings(parameters.certRotation.settings, parameters.certRotation.certSettings); err != nil {
+		return nil, fmt.Errorf("invalid cert rotation settings: %v", err)
+	}
+	if err := webhook.ValidateOwner(parameters.certRotation.owner); err != nil {
+		return nil, err
+	}
+
+	webhookConfiguration, err := webhook.LoadConfiguration(parameters.certRotation.webhookConfig)
+	if err != nil {
+		return nil, err
+	}
+	webhookConfiguration.SetOwner(parameters.certRotation.owner)
+	serviceMetadata, err := webhookConfiguration.GetServiceMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := clientFactory()
+	if err != nil {
+		return nil, err
+	}
+
+	certSettings := parameters.certRotation.certSettings
+	if parameters.certRotation.externalCaSecret != "" {
+		if serviceMetadata.Namespace == "" {
+			return nil, fmt.Errorf("'--external-ca-secret' requires a webhook service, the webhook is reached by url")
+		}
+		if certSettings.Ca, err = cert_generator.LoadCaFromSecret(client, parameters.certRotation.externalCaSecret, serviceMetadata.Namespace); err != nil {
+			return nil, err
+		}
+	} else if parameters.certRotation.externalCaCertFile != "" || parameters.certRotation.externalCaKeyFile != "" {
+		if certSettings.Ca, err = cert_generator.LoadCaFromFiles(parameters.certRotation.externalCaCertFile, parameters.certRotation.externalCaKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	secretSettings := parameters.certRotation.secretSettings
+	if secretSettings.Name != "" {
+		secretSettings.Owner = parameters.certRotation.owner
+		if secretSettings.Namespace == "" {
+			secretSettings.Namespace = serviceMetadata.Namespace
+		}
+		if secretSettings.Namespace == "" {
+			return nil, fmt.Errorf("'--cert-secret-namespace' is required if the webhook is reached by url")
+		}
+	}
+
+	return &certProvisioning{
+		client:          client,
+		configuration:   webhookConfiguration,
+		serviceMetadata: serviceMetadata,
+		certSettings:    certSettings,
+		secretSettings:  secretSettings,
+		outputFiles: cert_generator.CertOutputFiles{
+			CaCertOutputFile:  parameters.certRotation.caCertFile,
+			CaKeyOutputFile:   parameters.certRotation.caKeyFile,
+			TlsCertOutputFile: parameters.serverSettings.TlsCertFile,
+			TlsKeyOutputFile:  parameters.serverSettings.TlsKeyFile,
+		},
+	}, nil
+}
+
+func (p *certProvisioning) provideCerts() (*cert_generator.Certs, error) {
+	if p.secretSettings.Name == "" {
+		return cert_generator.Generate(p.serviceMetadata, p.certSettings, p.outputFiles)
+	}
+	return cert_generator.GenerateOrReuse(p.client, p.serviceMetadata, p.certSettings, p.secretSettings, p.outputFiles)
+}
+
+func (p *certProvisioning) createCertRotator(server *webhook.Server) (*cert_generator.Rotator, error) {
+	settings := parameters.certRotation.settings
+	// a self-registered webhook keeps its caBundle reconciled - without '--cert-rotation', its certs are only renewed once expired
+	settings.ReconcileCaBundle = parameters.selfRegistration
+	if !parameters.certRotation.enabled {
+		settings.RenewBefore = 0
+	}
+
+	if p.secretSettings.Name == "" {
+		return cert_generator.NewRotator(settings, p.client, p.serviceMetadata, p.certSettings, p.configuration, p.outputFiles, server.ReloadCertificate), nil
+	}
+	return cert_generator.NewSecretRotator(settings, p.client, p.serviceMetadata, p.certSettings, p.secretSettings, p.configuration, p.outputFiles, server.ReloadCertificate), nil
+}
+
+// register applies the webhook configurations, retrying with backoff until it succeeds or stop is closed
+func (p *certProvisioning) register(caBundle []byte, stop <-chan struct{}) error {
+	delay := minRegistrationRetryDelay
+	for {
+		err := p.configuration.ApplyInCluster(p.client, caBundle)
+		if err == nil {
+			logger.Logger.Infoln("webhook registered")
+			return nil
+		}
+
+		logger.Logger.WithFields(logrus.Fields{
+			"error": err,
+			"retry": delay,
+		}).Errorln("could not register webhook")
+
+		select {
+		case <-stop:
+			return err
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRegistrationRetryDelay {
+			delay = maxRegistrationRetryDelay
+		}
+	}
 }
 
 func init() {
 	rootCmd.PersistentFlags().String("log-level", "info", "panic | fatal | error | warn | info | debug | trace")
 
+	rootCmd.PersistentFlags().StringVar(&parameters.k8sClientSettings.Kubeconfig, "kubeconfig", "", "Path to a kubeconfig file, e.g. to run outside of a cluster. Defaults to the in-cluster config, or $KUBECONFIG / ~/.kube/config outside of a cluster.")
+	rootCmd.PersistentFlags().StringVar(&parameters.k8sClientSettings.Context, "context", "", "Context of the kubeconfig to use. Defaults to its current context.")
+
 	rootCmd.PersistentFlags().IntVar(&parameters.serverSettings.Port, "port", 8443, "Port to listen on for HTTP requests.")
 	rootCmd.PersistentFlags().BoolVar(&parameters.serverSettings.Tls, "tls", true, "Enables/Disables TLS.")
 	rootCmd.PersistentFlags().StringVar(&parameters.serverSettings.TlsCertFile, "tls-cert", "/etc/k8s-pod-mutator/certs/tls.crt", "Path to TLS cert. Has no effect when '--tls=false'.")
 	rootCmd.PersistentFlags().StringVar(&parameters.serverSettings.TlsKeyFile, "tls-key", "/etc/k8s-pod-mutator/certs/tls.key", "Path to TLS key. Has no effect when '--tls=false.'")
+	rootCmd.PersistentFlags().DurationVar(&parameters.serverSettings.TlsReloadInterval, "tls-reload-interval", 10*time.Second, "Interval in which the TLS cert and key are checked for changes and reloaded. '0' disables reloading. Has no effect when '--tls=false'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.serverSettings.TlsMinVersion, "tls-min-version", "1.2", fmt.Sprintf("Minimum TLS version: %v. Has no effect when '--tls=false'.", webhook.TlsVersions()))
+	rootCmd.PersistentFlags().StringSliceVar(&parameters.serverSettings.TlsCipherSuites, "tls-cipher-suites", nil, "Comma-separated TLS cipher suites for TLS 1.2 and lower, e.g. 'TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256'. Only secure cipher suites are accepted. Defaults to Go's defaults. Has no effect when '--tls=false'.")
+	rootCmd.PersistentFlags().StringSliceVar(&parameters.serverSettings.TlsCurves, "tls-curves", nil, fmt.Sprintf("Comma-separated curves for the key exchange in order of preference: %v. Defaults to Go's defaults. Has no effect when '--tls=false'.", webhook.TlsCurves()))
+	rootCmd.PersistentFlags().StringVar(&parameters.serverSettings.ClientCaFile, "client-ca", "", "Path to a CA bundle to verify client certs against. If set, mutation requests without a valid client cert (e.g. of the API server) are rejected with 401. Probes and metrics do not require a client cert. Requires '--tls=true'.")
+	rootCmd.PersistentFlags().StringSliceVar(&parameters.serverSettings.AllowedClientNames, "allowed-client-names", nil, "Comma-separated common names or DNS/URI SANs of the client certs that may send mutation requests, others are rejected with 403. Defaults to all client certs issued by '--client-ca'.")
+	rootCmd.PersistentFlags().BoolVar(&parameters.serverSettings.Http2, "http2", true, "Enables/Disables HTTP/2. Has no effect when '--tls=false'.")
+	rootCmd.PersistentFlags().DurationVar(&parameters.serverSettings.ReadHeaderTimeout, "read-header-timeout", 5*time.Second, "Maximum duration to read the headers of a request. '0' disables the timeout.")
+	rootCmd.PersistentFlags().DurationVar(&parameters.serverSettings.ReadTimeout, "read-timeout", 10*time.Second, "Maximum duration to read a whole request. '0' disables the timeout.")
+	rootCmd.PersistentFlags().DurationVar(&parameters.serverSettings.WriteTimeout, "write-timeout", 15*time.Second, "Maximum duration from the end of the request headers to the end of the response. '0' disables the timeout.")
+	rootCmd.PersistentFlags().DurationVar(&parameters.serverSettings.IdleTimeout, "idle-timeout", time.Minute, "Maximum duration to keep idle connections open. '0' disables the timeout.")
+	rootCmd.PersistentFlags().Int64Var(&parameters.serverSettings.MaxRequestBodyBytes, "max-request-body-bytes", 8*1024*1024, "Requests with larger bodies are rejected with 413. '0' does not limit the body size.")
+	rootCmd.PersistentFlags().IntVar(&parameters.serverSettings.AdminPort, "admin-port", 0, "Port to serve the debug endpoints (e.g. '/debug/preview') on, by TLS unless '--tls=false'. Requires '--admin-token-file'. '0' disables them.")
+	rootCmd.PersistentFlags().StringVar(&parameters.serverSettings.AdminTokenFile, "admin-token-file", "", "Path to a file containing the bearer token required by the debug endpoints. The file is read for every request, so the token can be rotated.")
+	rootCmd.PersistentFlags().IntVar(&parameters.serverSettings.MetricsPort, "metrics-port", 0, "Port to serve the Prometheus metrics ('/metrics') on by plain HTTP. '0' serves them on '--port'.")
+	rootCmd.PersistentFlags().DurationVar(&parameters.serverSettings.ShutdownGracePeriod, "shutdown-grace-period", 5*time.Second, "On shutdown, duration for which the webhook keeps serving while it is not ready anymore, so that it is removed from the service endpoints before requests are drained.")
+	rootCmd.PersistentFlags().DurationVar(&parameters.serverSettings.DrainTimeout, "drain-timeout", 20*time.Second, "On shutdown, maximum duration to wait for in-flight requests after the grace period. '0' waits indefinitely.")
+
+	rootCmd.PersistentFlags().BoolVar(&parameters.selfRegistration, "self-registration", false, "Provide the certs and register the webhook configurations from '--webhook-config-source' at startup, instead of relying on 'k8s-pod-mutator-init'. The webhook only becomes ready once it is registered and keeps its caBundle reconciled. Uses the same cert options as '--cert-rotation'. Requires '--tls=true'.")
+	rootCmd.PersistentFlags().BoolVar(&parameters.certRotation.enabled, "cert-rotation", false, "Enables/Disables renewal of the certs before they expire. Requires '--tls=true'.")
+	rootCmd.PersistentFlags().DurationVar(&parameters.certRotation.settings.RenewBefore, "cert-renew-before", 30*24*time.Hour, "Renew the certs if they expire within this duration. Has no effect when '--cert-rotation=false', in which case certs provided by '--self-registration' are only renewed once expired.")
+	rootCmd.PersistentFlags().DurationVar(&parameters.certRotation.settings.Overlap, "cert-rotation-overlap", 24*time.Hour, "Duration for which the previous CA is kept in the caBundle after a renewal. Must exceed '--cert-rotation-check-interval'. Has no effect unless '--cert-rotation' or '--self-registration' is set.")
+	rootCmd.PersistentFlags().DurationVar(&parameters.certRotation.settings.CheckInterval, "cert-rotation-check-interval", time.Hour, "Interval in which the certs are checked for renewal. Has no effect unless '--cert-rotation' or '--self-registration' is set.")
+	rootCmd.PersistentFlags().StringVar((*string)(&parameters.certRotation.certSettings.KeyAlgorithm), "key-algorithm", string(cert_generator.DefaultCertSettings.KeyAlgorithm), fmt.Sprintf("Algorithm of the generated CA and TLS keys: %v. Has no effect unless '--cert-rotation' or '--self-registration' is set.", cert_generator.KeyAlgorithms))
+	rootCmd.PersistentFlags().DurationVar(&parameters.certRotation.certSettings.CaValidity, "ca-validity", cert_generator.DefaultCertSettings.CaValidity, "Validity of the generated CA cert. Has no effect unless '--cert-rotation' or '--self-registration' is set.")
+	rootCmd.PersistentFlags().DurationVar(&parameters.certRotation.certSettings.TlsValidity, "tls-validity", cert_generator.DefaultCertSettings.TlsValidity, "Validity of the generated TLS cert. Must exceed '--cert-renew-before'. Has no effect unless '--cert-rotation' or '--self-registration' is set.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.certSettings.Organization, "cert-organization", cert_generator.DefaultCertSettings.Organization, "Organization in the subject of the generated CA and TLS certs. Has no effect unless '--cert-rotation' or '--self-registration' is set.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.certSettings.CaCommonName, "ca-common-name", cert_generator.DefaultCertSettings.CaCommonName, "Common name in the subject of the generated CA cert. Has no effect unless '--cert-rotation' or '--self-registration' is set.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.certSettings.ClusterDomain, "cluster-domain", cert_generator.DefaultCertSettings.ClusterDomain, "Cluster domain, adds '<service>.<namespace>.svc.<cluster-domain>' to the generated TLS cert. Empty to omit. Has no effect unless '--cert-rotation' or '--self-registration' is set.")
+	rootCmd.PersistentFlags().StringSliceVar(&parameters.certRotation.certSettings.DnsNames, "extra-dns-names", nil, "Additional DNS names of the generated TLS cert. Has no effect unless '--cert-rotation' or '--self-registration' is set.")
+	rootCmd.PersistentFlags().IPSliceVar(&parameters.certRotation.certSettings.IpAddresses, "extra-ip-addresses", nil, "Additional IP addresses of the generated TLS cert. Has no effect unless '--cert-rotation' or '--self-registration' is set.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.externalCaCertFile, "external-ca-cert", "", "Path to the cert (chain) of an existing CA that issues the generated TLS certs (see 'k8s-pod-mutator-init --external-ca-cert'). Has no effect unless '--cert-rotation' or '--self-registration' is set.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.externalCaKeyFile, "external-ca-key", "", "Path to the key of the CA from '--external-ca-cert'. Has no effect unless '--cert-rotation' or '--self-registration' is set.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.externalCaSecret, "external-ca-secret", "", "Name of a Secret of type 'kubernetes.io/tls' in the namespace of the webhook service containing an existing CA, alternatively to '--external-ca-cert' and '--external-ca-key'. Has no effect unless '--cert-rotation' or '--self-registration' is set.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.secretSettings.Name, "cert-secret", "", "Name of the Secret the certs are persisted in (see 'k8s-pod-mutator-init --cert-secret'). Should be set when running more than one replica. Has no effect unless '--cert-rotation' or '--self-registration' is set.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.secretSettings.Namespace, "cert-secret-namespace", "", "Namespace of the Secret from '--cert-secret'. Defaults to the namespace of the webhook service.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.caCertFile, "ca-cert", "/etc/k8s-pod-mutator/certs/ca.crt", "Path to CA cert. Has no effect unless '--cert-rotation' or '--self-registration' is set.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.caKeyFile, "ca-key", "/etc/k8s-pod-mutator/certs/ca.key", "Path to CA key. Has no effect unless '--cert-rotation' or '--self-registration' is set.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.owner, "owner", webhook.DefaultOwner, fmt.Sprintf("Identifies the installation. The cert Secret is labeled with %q when it is created. Must match '--owner' of the init-container. Has no effect unless '--cert-rotation' or '--self-registration' is set.", webhook.OwnerLabel))
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.webhookConfig.Source, "webhook-config-source", webhook.TemplateConfigurationSource, fmt.Sprintf("%q: read the webhook configurations from '--webhook-config-template' | %q: build a MutatingWebhookConfiguration for Pods from the '--webhook-*' and '--service-*' flags. Has no effect unless '--cert-rotation' or '--self-registration' is set.", webhook.TemplateConfigurationSource, webhook.FlagsConfigurationSource))
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.webhookConfig.Template, "webhook-config-template", "/etc/k8s-pod-mutator/config/webhook_config_template.yaml", "Path to the manifest template file for the webhook configurations. May contain several Mutating- and ValidatingWebhookConfigurations, separated by '---'. Has no effect unless '--cert-rotation' or '--self-registration' is set.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.webhookConfig.Generated.Name, "webhook-config-name", webhook.DefaultGeneratedConfigurationSettings.Name, "Name of the MutatingWebhookConfiguration. Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.webhookConfig.Generated.WebhookName, "webhook-name", webhook.DefaultGeneratedConfigurationSettings.WebhookName, "Fully qualified name of the webhook. Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.webhookConfig.Generated.ServiceName, "service-name", "", "Name of the webhook service. Required if '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.webhookConfig.Generated.ServiceNamespace, "service-namespace", "", "Namespace of the webhook service. Required if '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.webhookConfig.Generated.ServicePath, "service-path", webhook.DefaultGeneratedConfigurationSettings.ServicePath, "Path of the webhook. Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().Int32Var(&parameters.certRotation.webhookConfig.Generated.ServicePort, "service-port", webhook.DefaultGeneratedConfigurationSettings.ServicePort, "Port of the webhook service. Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringSliceVar(&parameters.certRotation.webhookConfig.Generated.Operations, "webhook-operations", webhook.DefaultGeneratedConfigurationSettings.Operations, "Operations on Pods that are sent to the webhook: CREATE, UPDATE, DELETE, CONNECT or *. Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.webhookConfig.Generated.FailurePolicy, "webhook-failure-policy", webhook.DefaultGeneratedConfigurationSettings.FailurePolicy, "Ignore | Fail. Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().Int32Var(&parameters.certRotation.webhookConfig.Generated.TimeoutSeconds, "webhook-timeout-seconds", webhook.DefaultGeneratedConfigurationSettings.TimeoutSeconds, "Timeout of the webhook (1-30). Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.webhookConfig.Generated.ReinvocationPolicy, "webhook-reinvocation-policy", webhook.DefaultGeneratedConfigurationSettings.ReinvocationPolicy, "Never | IfNeeded. Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringSliceVar(&parameters.certRotation.webhookConfig.Generated.AdmissionReviewVersions, "webhook-admission-review-versions", webhook.DefaultGeneratedConfigurationSettings.AdmissionReviewVersions, "AdmissionReview versions accepted by the webhook, in order of preference: v1, v1beta1. Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.webhookConfig.Generated.NamespaceSelector, "webhook-namespace-selector", webhook.DefaultGeneratedConfigurationSettings.NamespaceSelector, "Label selector of the namespaces whose Pods are sent to the webhook, e.g. '!control-plane,environment in (dev,test)'. Has no effect unless '--webhook-config-source=flags'.")
+	rootCmd.PersistentFlags().StringVar(&parameters.certRotation.webhookConfig.Generated.ObjectSelector, "webhook-object-selector", webhook.DefaultGeneratedConfigurationSettings.ObjectSelector, "Label selector of the Pods that are sent to the webhook, e.g. 'aadpodidbinding'. Has no effect unless '--webhook-config-source=flags'.")
 
 	rootCmd.PersistentFlags().StringVar(&parameters.mutationSettings.PatchFile, "patch", "/etc/k8s-pod-mutator/config/patch.yaml", "Path to the YAML file containing the patch to be applied to eligible Pods (see https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.20/#pod-v1-core for help).")
+	rootCmd.PersistentFlags().StringToStringVar(&parameters.profiles, "profiles", nil, "Comma-separated additional profiles as '<profile>=<path to patch file>', each served on '/mutate/<profile>', e.g. 'sidecar=/etc/k8s-pod-mutator/config/sidecar.yaml'. '--patch' is served on '/mutate'.")
+	rootCmd.PersistentFlags().IntVar(&parameters.mutationSettings.RolloutPercentage, "rollout-percentage", 100, "Percentage (0-100) of workloads whose Pods receive the patch. All replicas of a workload share the same decision.")
+	rootCmd.PersistentFlags().StringVar(&parameters.mutationSettings.RolloutSeed, "rollout-seed", "", "Seed for the rollout decision. Changing the seed reshuffles which workloads are selected.")
+	rootCmd.PersistentFlags().StringToIntVar(&parameters.profileRolloutPercentages, "profile-rollout-percentages", nil, "Comma-separated rollout percentages of profiles as '<profile>=<percentage>', e.g. 'sidecar=10'. Profiles without one use '--rollout-percentage'.")
+	rootCmd.PersistentFlags().StringToStringVar(&parameters.profileRolloutSeeds, "profile-rollout-seeds", nil, "Comma-separated rollout seeds of profiles as '<profile>=<seed>'. Profiles without one use '--rollout-seed'.")
 }
 
 func main() {
@@ -50,3 +50,10 @@ Selector labels
 app.kubernetes.io/name: {{ include "k8s-pod-mutator-webhook.name" . }}
 app.kubernetes.io/instance: {{ .Release.Name }}
 {{- end }}
+
+{{/*
+Owner of the cluster resources created at runtime (must be a valid label value)
+*/}}
+{{- define "k8s-pod-mutator-webhook.owner" -}}
+{{- printf "%s.%s" .Release.Namespace (include "k8s-pod-mutator-webhook.fullname" .) | trunc 63 | trimSuffix "-" | trimSuffix "." }}
+{{- end }}
@@ -2,6 +2,7 @@ module k8s-pod-mutator-webhook
 
 require (
 	github.com/evanphx/json-patch v4.9.0+incompatible
+	github.com/prometheus/client_golang v1.7.1
 	github.com/sirupsen/logrus v1.7.0
 	github.com/spf13/cobra v1.1.3
 	github.com/stretchr/testify v1.7.0
@@ -1,16 +1,50 @@
 package admission_review
 
 import (
+	"errors"
 	v1 "k8s.io/api/admission/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
 )
 
+// badRequestError marks errors that are caused by the request rather than by the webhook
+type badRequestError struct {
+	err error
+}
+
+func (e *badRequestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *badRequestError) Unwrap() error {
+	return e.err
+}
+
+// BadRequest marks err as caused by the request, e.g. an object that cannot be decoded
+func BadRequest(err error) error {
+	return &badRequestError{err}
+}
+
+// IsBadRequest reports whether err, or any error it wraps, was marked by BadRequest
+func IsBadRequest(err error) bool {
+	var badRequest *badRequestError
+	return errors.As(err, &badRequest)
+}
+
+// ErrorResponse rejects the request with a failure status. Errors marked by BadRequest result in code 400 and reason
+// BadRequest, all others in code 500 and reason InternalError.
 func ErrorResponse(err error) *v1.AdmissionResponse {
+	status := &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusInternalServerError,
+		Reason:  metav1.StatusReasonInternalError,
+		Message: err.Error(),
+	}
+	if IsBadRequest(err) {
+		status.Code = http.StatusBadRequest
+		status.Reason = metav1.StatusReasonBadRequest
+	}
 	return &v1.AdmissionResponse{
-		Result: &metav1.Status{
-			Status:  "Failure",
-			Code:    500,
-			Message: err.Error(),
-		},
+		Result: status,
 	}
 }
@@ -0,0 +1,45 @@
+package admission_review
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func TestErrorResponse(t *testing.T) {
+	testCases := []struct {
+		description    string
+		err            error
+		expectedCode   int32
+		expectedReason metav1.StatusReason
+	}{
+		{
+			description:    "internal error",
+			err:            fmt.Errorf("some error"),
+			expectedCode:   500,
+			expectedReason: metav1.StatusReasonInternalError,
+		},
+		{
+			description:    "bad request",
+			err:            BadRequest(fmt.Errorf("some error")),
+			expectedCode:   400,
+			expectedReason: metav1.StatusReasonBadRequest,
+		},
+		{
+			description:    "wrapped bad request",
+			err:            fmt.Errorf("could not mutate: %w", BadRequest(fmt.Errorf("some error"))),
+			expectedCode:   400,
+			expectedReason: metav1.StatusReasonBadRequest,
+		},
+	}
+
+	for _, testCase := range testCases {
+		response := ErrorResponse(testCase.err)
+		assert.False(t, response.Allowed, testCase.description)
+		assert.Equal(t, metav1.StatusFailure, response.Result.Status, testCase.description)
+		assert.Equal(t, testCase.expectedCode, response.Result.Code, testCase.description)
+		assert.Equal(t, testCase.expectedReason, response.Result.Reason, testCase.description)
+		assert.Equal(t, testCase.err.Error(), response.Result.Message, testCase.description)
+	}
+}
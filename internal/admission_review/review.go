@@ -0,0 +1,123 @@
+package admission_review
+
+import (
+	"encoding/json"
+	"fmt"
+	v1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const kind = "AdmissionReview"
+
+// SupportedVersions are the versions of AdmissionReview that can be decoded, in order of preference
+var SupportedVersions = []string{v1.SchemeGroupVersion.Version, v1beta1.SchemeGroupVersion.Version}
+
+// Review is the version independent representation of an AdmissionReview. Requests of all supported versions are
+// converted to admission.k8s.io/v1, responses are converted back to the version of the request.
+type Review struct {
+	// APIVersion of the AdmissionReview that was received
+	APIVersion string
+	Request    *v1.AdmissionRequest
+}
+
+// Decode decodes an AdmissionReview of any supported version and ensures that it can be answered
+func Decode(body []byte) (*Review, error) {
+	typeMeta := metav1.TypeMeta{}
+	if err := json.Unmarshal(body, &typeMeta); err != nil {
+		return nil, fmt.Errorf("could not decode admission review: %v", err)
+	}
+	if typeMeta.Kind != kind {
+		return nil, fmt.Errorf("expected kind %v, got %q", kind, typeMeta.Kind)
+	}
+
+	review := &Review{APIVersion: typeMeta.APIVersion}
+	switch typeMeta.APIVersion {
+	case v1.SchemeGroupVersion.String():
+		v1Review := v1.AdmissionReview{}
+		if err := json.Unmarshal(body, &v1Review); err != nil {
+			return nil, fmt.Errorf("could not decode admission review: %v", err)
+		}
+		review.Request = v1Review.Request
+	case v1beta1.SchemeGroupVersion.String():
+		v1beta1Review := v1beta1.AdmissionReview{}
+		if err := json.Unmarshal(body, &v1beta1Review); err != nil {
+			return nil, fmt.Errorf("could not decode admission review: %v", err)
+		}
+		review.Request = requestFromV1beta1(v1beta1Review.Request)
+	default:
+		return nil, fmt.Errorf("unsupported apiVersion %q, expected one of %v", typeMeta.APIVersion, supportedApiVersions())
+	}
+
+	if review.Request == nil {
+		return nil, fmt.Errorf("admission review has no request")
+	}
+	if review.Request.UID == "" {
+		return nil, fmt.Errorf("admission review request has no uid")
+	}
+	return review, nil
+}
+
+// EncodeResponse encodes an AdmissionReview with the response in the version of the request
+func (r *Review) EncodeResponse(response *v1.AdmissionResponse) ([]byte, error) {
+	typeMeta := metav1.TypeMeta{APIVersion: r.APIVersion, Kind: kind}
+	switch r.APIVersion {
+	case v1.SchemeGroupVersion.String():
+		return json.Marshal(v1.AdmissionReview{TypeMeta: typeMeta, Response: response})
+	case v1beta1.SchemeGroupVersion.String():
+		return json.Marshal(v1beta1.AdmissionReview{TypeMeta: typeMeta, Response: responseToV1beta1(response)})
+	default:
+		return nil, fmt.Errorf("unsupported apiVersion %q", r.APIVersion)
+	}
+}
+
+func supportedApiVersions() []string {
+	var apiVersions []string
+	for _, version := range SupportedVersions {
+		apiVersions = append(apiVersions, v1.GroupName+"/"+version)
+	}
+	return apiVersions
+}
+
+func requestFromV1beta1(request *v1beta1.AdmissionRequest) *v1.AdmissionRequest {
+	if request == nil {
+		return nil
+	}
+	return &v1.AdmissionRequest{
+		UID:                request.UID,
+		Kind:               request.Kind,
+		Resource:           request.Resource,
+		SubResource:        request.SubResource,
+		RequestKind:        request.RequestKind,
+		RequestResource:    request.RequestResource,
+		RequestSubResource: request.RequestSubResource,
+		Name:               request.Name,
+		Namespace:          request.Namespace,
+		Operation:          v1.Operation(request.Operation),
+		UserInfo:           request.UserInfo,
+		Object:             request.Object,
+		OldObject:          request.OldObject,
+		DryRun:             request.DryRun,
+		Options:            request.Options,
+	}
+}
+
+func responseToV1beta1(response *v1.AdmissionResponse) *v1beta1.AdmissionResponse {
+	if response == nil {
+		return nil
+	}
+	var patchType *v1beta1.PatchType
+	if response.PatchType != nil {
+		pt := v1beta1.PatchType(*response.PatchType)
+		patchType = &pt
+	}
+	return &v1beta1.AdmissionResponse{
+		UID:              response.UID,
+		Allowed:          response.Allowed,
+		Result:           response.Result,
+		Patch:            response.Patch,
+		PatchType:        patchType,
+		AuditAnnotations: response.AuditAnnotations,
+		Warnings:         response.Warnings,
+	}
+}
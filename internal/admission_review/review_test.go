@@ -0,0 +1,87 @@
+package admission_review
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	for _, apiVersion := range []string{"admission.k8s.io/v1", "admission.k8s.io/v1beta1"} {
+		body := `{"apiVersion": "` + apiVersion + `", "kind": "AdmissionReview", "request": {"uid": "some-uid", "namespace": "some-namespace", "operation": "CREATE", "dryRun": true, "object": {"kind": "Pod"}}}`
+
+		review, err := Decode([]byte(body))
+		if assert.NoError(t, err, apiVersion) {
+			assert.Equal(t, apiVersion, review.APIVersion)
+			assert.Equal(t, "some-uid", string(review.Request.UID), apiVersion)
+			assert.Equal(t, "some-namespace", review.Request.Namespace, apiVersion)
+			assert.Equal(t, v1.Create, review.Request.Operation, apiVersion)
+			assert.True(t, *review.Request.DryRun, apiVersion)
+			assert.JSONEq(t, `{"kind": "Pod"}`, string(review.Request.Object.Raw), apiVersion)
+		}
+	}
+}
+
+func TestDecode_RejectsInvalidReviews(t *testing.T) {
+	testCases := []struct {
+		description string
+		body        string
+	}{
+		{"invalid json", `{"apiVersion": `},
+		{"missing kind", `{"apiVersion": "admission.k8s.io/v1", "request": {"uid": "some-uid"}}`},
+		{"invalid kind", `{"apiVersion": "admission.k8s.io/v1", "kind": "Pod", "request": {"uid": "some-uid"}}`},
+		{"missing apiVersion", `{"kind": "AdmissionReview", "request": {"uid": "some-uid"}}`},
+		{"unknown apiVersion", `{"apiVersion": "admission.k8s.io/v2", "kind": "AdmissionReview", "request": {"uid": "some-uid"}}`},
+		{"invalid v1 request", `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview", "request": []}`},
+		{"invalid v1beta1 request", `{"apiVersion": "admission.k8s.io/v1beta1", "kind": "AdmissionReview", "request": []}`},
+		{"missing v1 request", `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview"}`},
+		{"missing v1beta1 request", `{"apiVersion": "admission.k8s.io/v1beta1", "kind": "AdmissionReview"}`},
+		{"missing uid", `{"apiVersion": "admission.k8s.io/v1beta1", "kind": "AdmissionReview", "request": {}}`},
+	}
+
+	for _, testCase := range testCases {
+		_, err := Decode([]byte(testCase.body))
+		assert.Error(t, err, testCase.description)
+	}
+}
+
+func TestReview_EncodeResponse(t *testing.T) {
+	patchType := v1.PatchTypeJSONPatch
+	response := &v1.AdmissionResponse{
+		UID:              "some-uid",
+		Allowed:          true,
+		Patch:            []byte(`[]`),
+		PatchType:        &patchType,
+		AuditAnnotations: map[string]string{"some-key": "some-value"},
+		Warnings:         []string{"some-warning"},
+	}
+
+	encoded, err := (&Review{APIVersion: "admission.k8s.io/v1"}).EncodeResponse(response)
+	assert.NoError(t, err)
+	v1Review := v1.AdmissionReview{}
+	assert.NoError(t, json.Unmarshal(encoded, &v1Review))
+	assert.Equal(t, "admission.k8s.io/v1", v1Review.APIVersion)
+	assert.Equal(t, "AdmissionReview", v1Review.Kind)
+	assert.Equal(t, response, v1Review.Response)
+
+	encoded, err = (&Review{APIVersion: "admission.k8s.io/v1beta1"}).EncodeResponse(response)
+	assert.NoError(t, err)
+	v1beta1Review := v1beta1.AdmissionReview{}
+	assert.NoError(t, json.Unmarshal(encoded, &v1beta1Review))
+	assert.Equal(t, "admission.k8s.io/v1beta1", v1beta1Review.APIVersion)
+	assert.Equal(t, "AdmissionReview", v1beta1Review.Kind)
+	v1beta1PatchType := v1beta1.PatchTypeJSONPatch
+	assert.Equal(t, &v1beta1.AdmissionResponse{
+		UID:              "some-uid",
+		Allowed:          true,
+		Patch:            []byte(`[]`),
+		PatchType:        &v1beta1PatchType,
+		AuditAnnotations: map[string]string{"some-key": "some-value"},
+		Warnings:         []string{"some-warning"},
+	}, v1beta1Review.Response)
+
+	_, err = (&Review{APIVersion: "admission.k8s.io/v2"}).EncodeResponse(response)
+	assert.Error(t, err)
+}
@@ -0,0 +1,69 @@
+package k8s_client
+
+import (
+	"github.com/sirupsen/logrus"
+	"k8s-pod-mutator-webhook/internal/logger"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sync"
+)
+
+type Settings struct {
+	// Kubeconfig is the path to a kubeconfig file. If neither Kubeconfig nor Context is set, the in-cluster config is used,
+	// falling back to the default kubeconfig ($KUBECONFIG or ~/.kube/config) outside of a cluster.
+	Kubeconfig string
+	// Context overrides the current context of the kubeconfig
+	Context string
+}
+
+// Factory returns a k8s client, so that tests can inject fakes
+type Factory func() (kubernetes.Interface, error)
+
+// NewFactory returns a Factory that creates the client once and then reuses it
+func NewFactory(settings Settings) Factory {
+	var once sync.Once
+	var client kubernetes.Interface
+	var err error
+	return func() (kubernetes.Interface, error) {
+		once.Do(func() {
+			client, err = Create(settings)
+		})
+		return client, err
+	}
+}
+
+func Create(settings Settings) (kubernetes.Interface, error) {
+	logger.Logger.Tracef("creating k8s client...")
+
+	config, err := createConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func createConfig(settings Settings) (*rest.Config, error) {
+	if settings.Kubeconfig == "" && settings.Context == "" {
+		config, err := rest.InClusterConfig()
+		if err != rest.ErrNotInCluster {
+			return config, err
+		}
+		logger.Logger.Debugln("not running in a cluster, falling back to kubeconfig")
+	}
+
+	logger.Logger.WithFields(logrus.Fields{
+		"kubeconfig": settings.Kubeconfig,
+		"context":    settings.Context,
+	}).Debugln("loading kubeconfig")
+
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = settings.Kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: settings.Context}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+}
@@ -0,0 +1,63 @@
+package k8s_client
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+const testKubeconfig = `
+apiVersion: v1
+kind: Config
+clusters:
+  - name: dev
+    cluster:
+      server: https://dev.example.org:6443
+  - name: test
+    cluster:
+      server: https://test.example.org:6443
+users:
+  - name: developer
+    user:
+      token: some-token
+contexts:
+  - name: dev
+    context:
+      cluster: dev
+      user: developer
+  - name: test
+    context:
+      cluster: test
+      user: developer
+current-context: dev
+`
+
+func TestCreateConfig_FromKubeconfig(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	assert.NoError(t, ioutil.WriteFile(kubeconfig, []byte(testKubeconfig), 0600))
+
+	config, err := createConfig(Settings{Kubeconfig: kubeconfig})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://dev.example.org:6443", config.Host)
+	assert.Equal(t, "some-token", config.BearerToken)
+
+	config, err = createConfig(Settings{Kubeconfig: kubeconfig, Context: "test"})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://test.example.org:6443", config.Host)
+
+	_, err = createConfig(Settings{Kubeconfig: kubeconfig, Context: "missing"})
+	assert.Error(t, err)
+}
+
+func TestNewFactory_ReusesClient(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	assert.NoError(t, ioutil.WriteFile(kubeconfig, []byte(testKubeconfig), 0600))
+
+	factory := NewFactory(Settings{Kubeconfig: kubeconfig})
+	first, err := factory()
+	assert.NoError(t, err)
+	second, err := factory()
+	assert.NoError(t, err)
+	assert.Same(t, first, second)
+}
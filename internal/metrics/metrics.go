@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+const namespace = "k8s_pod_mutator"
+
+// outcomes of a mutation request
+const (
+	OutcomeMutated               = "mutated"
+	OutcomeSkippedAlreadyMutated = "skipped_already_mutated"
+	OutcomeSkippedOwnPod         = "skipped_own_pod"
+	OutcomeSkippedRollout        = "skipped_rollout"
+	OutcomeSkippedNotPodCreate   = "skipped_not_pod_create"
+	OutcomeError                 = "error"
+)
+
+// Registry holds all metrics of the webhook, including the Go runtime and process metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	HttpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by handler and status code.",
+	}, []string{"handler", "code"})
+
+	HttpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by handler.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"handler"})
+
+	Mutations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mutations_total",
+		Help:      "Number of mutation requests by namespace, profile, patch and outcome.",
+	}, []string{"namespace", "profile", "patch", "outcome"})
+
+	MutationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "mutation_duration_seconds",
+		Help:      "Duration of mutations by namespace, profile, patch and outcome.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"namespace", "profile", "patch", "outcome"})
+
+	PatchLoadDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "patch_load_duration_seconds",
+		Help:      "Time it took to load and parse the patch.",
+	}, []string{"patch"})
+
+	TlsCertExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tls_cert_expiry_timestamp_seconds",
+		Help:      "Expiry of the served TLS cert as unix timestamp, 0 if TLS is disabled.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		HttpRequests,
+		HttpRequestDuration,
+		Mutations,
+		MutationDuration,
+		PatchLoadDuration,
+		TlsCertExpiry,
+	)
+}
+
+// Handler serves the metrics of Registry
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Instrument counts the requests to handler and observes their latency
+func Instrument(handlerName string, handler http.HandlerFunc) http.Handler {
+	labels := prometheus.Labels{"handler": handlerName}
+	return promhttp.InstrumentHandlerDuration(
+		HttpRequestDuration.MustCurryWith(labels),
+		promhttp.InstrumentHandlerCounter(HttpRequests.MustCurryWith(labels), handler),
+	)
+}
@@ -0,0 +1,94 @@
+package cert_generator
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"k8s-pod-mutator-webhook/internal/logger"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"time"
+)
+
+// CertificateAuthority issues the TLS cert. It is either generated, or an external (e.g. intermediate) CA.
+type CertificateAuthority struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPem []byte
+	keyPem  []byte
+}
+
+// LoadCaFromFiles loads an external CA. certFile may contain the whole chain, starting with the issuing CA cert.
+func LoadCaFromFiles(certFile string, keyFile string) (*CertificateAuthority, error) {
+	logger.Logger.WithFields(logrus.Fields{
+		"certFile": certFile,
+		"keyFile":  keyFile,
+	}).Infoln("loading external ca from files")
+
+	certPem, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read external ca cert: %v", err)
+	}
+	keyPem, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read external ca key: %v", err)
+	}
+	return ParseCa(certPem, keyPem)
+}
+
+// LoadCaFromSecret loads an external CA from a Secret of type "kubernetes.io/tls", e.g. one managed by cert-manager.
+func LoadCaFromSecret(client kubernetes.Interface, name string, namespace string) (*CertificateAuthority, error) {
+	logger.Logger.WithFields(logrus.Fields{
+		"name":      name,
+		"namespace": namespace,
+	}).Infoln("loading external ca from secret")
+
+	secret, err := client.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get external ca secret: %v", err)
+	}
+	return ParseCa(secret.Data[tlsCertSecretKey], secret.Data[tlsKeySecretKey])
+}
+
+// ParseCa parses an external CA and rejects certs that cannot issue certs, are expired or do not match the key.
+func ParseCa(certPem []byte, keyPem []byte) (*CertificateAuthority, error) {
+	keyPair, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return nil, fmt.Errorf("invalid external ca: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid external ca: %v", err)
+	}
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return nil, fmt.Errorf("invalid external ca: cert %q is not a ca", cert.Subject)
+	}
+	if cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, fmt.Errorf("invalid external ca: cert %q is not allowed to sign certs (missing IsCA/KeyUsageCertSign)", cert.Subject)
+	}
+	if cert.NotAfter.Before(time.Now()) {
+		return nil, fmt.Errorf("invalid external ca: cert %q expired at %v", cert.Subject, cert.NotAfter)
+	}
+
+	key, ok := keyPair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("invalid external ca: unsupported key type %T", keyPair.PrivateKey)
+	}
+
+	logger.Logger.WithFields(logrus.Fields{
+		"subject":  cert.Subject.String(),
+		"notAfter": cert.NotAfter,
+		"chain":    len(keyPair.Certificate),
+	}).Infoln("loaded external ca")
+
+	return &CertificateAuthority{
+		cert:    cert,
+		key:     key,
+		certPem: certPem,
+	}, nil
+}
@@ -0,0 +1,129 @@
+package cert_generator
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestParseCa_AcceptsIntermediateCaChain(t *testing.T) {
+	root, intermediateCertPem, intermediateKeyPem := createIntermediateCa(t, true, x509.KeyUsageCertSign)
+	chainPem := append(intermediateCertPem, root.certPem...)
+
+	ca, err := ParseCa(chainPem, intermediateKeyPem)
+	assert.NoError(t, err)
+	assert.Equal(t, "intermediate", ca.cert.Subject.CommonName)
+	assert.Equal(t, chainPem, ca.certPem)
+}
+
+func TestParseCa_RejectsInvalidCa(t *testing.T) {
+	_, notCaCertPem, notCaKeyPem := createIntermediateCa(t, false, x509.KeyUsageDigitalSignature)
+	_, noCertSignCertPem, noCertSignKeyPem := createIntermediateCa(t, true, x509.KeyUsageDigitalSignature)
+	_, validCertPem, _ := createIntermediateCa(t, true, x509.KeyUsageCertSign)
+	_, _, otherKeyPem := createIntermediateCa(t, true, x509.KeyUsageCertSign)
+	expired, _ := createCa(DefaultCertSettings, time.Now().Add(-2*DefaultCertSettings.CaValidity))
+
+	testCases := []struct {
+		description string
+		certPem     []byte
+		keyPem      []byte
+	}{
+		{"not a ca", notCaCertPem, notCaKeyPem},
+		{"not allowed to sign certs", noCertSignCertPem, noCertSignKeyPem},
+		{"key does not match", validCertPem, otherKeyPem},
+		{"expired", expired.certPem, expired.keyPem},
+		{"no cert", []byte{}, otherKeyPem},
+	}
+
+	for _, testCase := range testCases {
+		_, err := ParseCa(testCase.certPem, testCase.keyPem)
+		assert.Error(t, err, testCase.description)
+	}
+}
+
+func TestLoadCaFromSecret(t *testing.T) {
+	root, intermediateCertPem, intermediateKeyPem := createIntermediateCa(t, true, x509.KeyUsageCertSign)
+	chainPem := append(intermediateCertPem, root.certPem...)
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "intermediate-ca", Namespace: "security"},
+		Type:       corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       chainPem,
+			corev1.TLSPrivateKeyKey: intermediateKeyPem,
+		},
+	})
+
+	ca, err := LoadCaFromSecret(client, "intermediate-ca", "security")
+	assert.NoError(t, err)
+	assert.Equal(t, chainPem, ca.certPem)
+
+	_, err = LoadCaFromSecret(client, "missing", "security")
+	assert.Error(t, err)
+}
+
+func TestGenerate_IssuesTlsCertWithExternalCa(t *testing.T) {
+	root, intermediateCertPem, intermediateKeyPem := createIntermediateCa(t, true, x509.KeyUsageCertSign)
+	chainPem := append(intermediateCertPem, root.certPem...)
+	ca, err := ParseCa(chainPem, intermediateKeyPem)
+	assert.NoError(t, err)
+
+	certSettings := DefaultCertSettings
+	certSettings.Ca = ca
+	certSettings.TlsValidity = 10 * certSettings.CaValidity
+
+	certs, err := generate(testServiceMetadata, certSettings, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, chainPem, certs.CaCert, "whole chain is published as caBundle")
+	assert.Empty(t, certs.CaKey, "external ca key must not be spread")
+	assert.NoError(t, validate(certs, testServiceMetadata, certSettings, time.Now()))
+
+	tlsCert, _ := parseCert(certs.TlsCert)
+	assert.Equal(t, "intermediate", tlsCert.Issuer.CommonName)
+	assert.Equal(t, ca.cert.SubjectKeyId, tlsCert.AuthorityKeyId)
+	assert.False(t, tlsCert.NotAfter.After(ca.cert.NotAfter), "tls cert must not outlive its ca")
+
+	// chains to the root via the intermediate
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(ca.cert)
+	_, err = tlsCert.Verify(x509.VerifyOptions{
+		DNSName:       "some-service-name.some-service-namespace.svc",
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	assert.NoError(t, err)
+
+	// certs of a generated ca are not reused once an external ca is configured
+	generatedCerts, _ := generate(testServiceMetadata, DefaultCertSettings, time.Now())
+	assert.Error(t, validate(generatedCerts, testServiceMetadata, certSettings, time.Now()))
+}
+
+func createIntermediateCa(t *testing.T, isCa bool, keyUsage x509.KeyUsage) (*CertificateAuthority, []byte, []byte) {
+	root, err := createCa(DefaultCertSettings, time.Now())
+	assert.NoError(t, err)
+
+	key, err := generateKey(ECDSAP256)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "intermediate"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  isCa,
+		BasicConstraintsValid: true,
+		KeyUsage:              keyUsage,
+	}
+	certPem, err := createCert(template, key.Public(), root.cert, root.key)
+	assert.NoError(t, err)
+	keyPem, err := encode(key)
+	assert.NoError(t, err)
+
+	return root, certPem.Bytes(), keyPem.Bytes()
+}
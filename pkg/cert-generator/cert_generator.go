@@ -2,8 +2,8 @@ package cert_generator
 
 import (
 	"bytes"
+	"crypto"
 	cryptorand "crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
@@ -12,15 +12,35 @@ import (
 	"io/ioutil"
 	"k8s-pod-mutator-webhook/internal/logger"
 	"k8s-pod-mutator-webhook/pkg/webhook"
-	"math/big"
+	"net"
 	"os"
 	"path/filepath"
 	"time"
 )
 
-const organizationName = "k8s-pod-mutator.io"
+type CertSettings struct {
+	KeyAlgorithm KeyAlgorithm
+	CaValidity   time.Duration
+	TlsValidity  time.Duration
+	Organization string
+	CaCommonName string
+	// ClusterDomain adds the fully qualified service name (<name>.<namespace>.svc.<clusterDomain>) to the TLS cert, if set
+	ClusterDomain string
+	// DnsNames and IpAddresses are added to the TLS cert in addition to the names derived from the webhook configuration
+	DnsNames    []string
+	IpAddresses []net.IP
+	// Ca issues the TLS cert instead of a newly generated CA, if set
+	Ca *CertificateAuthority
+}
 
-const keyLength = 2048
+var DefaultCertSettings = CertSettings{
+	KeyAlgorithm:  RSA2048,
+	CaValidity:    365 * 24 * time.Hour,
+	TlsValidity:   365 * 24 * time.Hour,
+	Organization:  "k8s-pod-mutator.io",
+	CaCommonName:  "k8s-pod-mutator-ca",
+	ClusterDomain: "cluster.local",
+}
 
 type CertOutputFiles struct {
 	CaCertOutputFile  string
@@ -30,99 +50,182 @@ type CertOutputFiles struct {
 }
 
 type Certs struct {
-	CaCert  []byte
+	// CaCert contains the whole chain of an external CA
+	CaCert []byte
+	// CaKey is empty for an external CA, so that its key is not spread any further
 	CaKey   []byte
 	TlsCert []byte
 	TlsKey  []byte
 }
 
-func Generate(serviceMetadata webhook.ServiceMetadata, outputFiles CertOutputFiles) (*Certs, error) {
+func Generate(serviceMetadata webhook.ServiceMetadata, certSettings CertSettings, outputFiles CertOutputFiles) (*Certs, error) {
 	logger.Logger.WithFields(logrus.Fields{
 		"serviceMetadata": fmt.Sprintf("%+v", serviceMetadata),
 		"outputFiles":     fmt.Sprintf("%+v", outputFiles),
 	}).Infoln("generating certs")
 
-	logger.Logger.Debugln("generating ca key + cert...")
+	certs, err := generate(serviceMetadata, certSettings, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := write(certs, outputFiles); err != nil {
+		return nil, err
+	}
+
+	logger.Logger.WithFields(logrus.Fields{
+		"serviceMetadata": fmt.Sprintf("%+v", serviceMetadata),
+		"outputFiles":     fmt.Sprintf("%+v", outputFiles),
+	}).Infoln("successfully generated certs")
+
+	return certs, nil
+}
+
+func generate(serviceMetadata webhook.ServiceMetadata, certSettings CertSettings, now time.Time) (*Certs, error) {
+	if err := certSettings.validate(); err != nil {
+		return nil, err
+	}
+
+	ca := certSettings.Ca
+	if ca == nil {
+		var err error
+		if ca, err = createCa(certSettings, now); err != nil {
+			return nil, err
+		}
+	}
+
+	tlsCert, tlsKey, err := issue(serviceMetadata, certSettings, ca, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Certs{
+		ca.certPem,
+		ca.keyPem,
+		tlsCert.Bytes(),
+		tlsKey.Bytes(),
+	}, nil
+}
+
+func createCa(certSettings CertSettings, now time.Time) (*CertificateAuthority, error) {
+	logger.Logger.WithFields(logrus.Fields{
+		"certSettings": fmt.Sprintf("%+v", certSettings),
+	}).Debugln("generating ca key + cert...")
+	caKey, err := generateKey(certSettings.KeyAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	caSerialNumber, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	caSubjectKeyId, err := subjectKeyId(caKey.Public())
+	if err != nil {
+		return nil, err
+	}
 	caX509Cert := &x509.Certificate{
-		SerialNumber: big.NewInt(2020),
+		SerialNumber: caSerialNumber,
 		Subject: pkix.Name{
-			Organization: []string{organizationName},
+			CommonName:   certSettings.CaCommonName,
+			Organization: []string{certSettings.Organization},
 		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(1, 0, 0),
+		NotBefore:             now,
+		NotAfter:              now.Add(certSettings.CaValidity),
 		IsCA:                  true,
+		SubjectKeyId:          caSubjectKeyId,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
 		BasicConstraintsValid: true,
 	}
 
-	caKey, err := rsa.GenerateKey(cryptorand.Reader, keyLength)
+	caCert, err := createCert(caX509Cert, caKey.Public(), caX509Cert, caKey)
 	if err != nil {
 		return nil, err
 	}
-	caCert, err := createCert(caX509Cert, caKey.PublicKey, caX509Cert, *caKey)
+	parsedCaCert, err := parseCert(caCert.Bytes())
 	if err != nil {
 		return nil, err
 	}
-
-	logger.Logger.Debugln("generating tls key + cert")
-	tlsX509Cert := &x509.Certificate{
-		DNSNames: []string{
-			serviceMetadata.Name,
-			fmt.Sprintf("%v.%v", serviceMetadata.Name, serviceMetadata.Namespace),
-			fmt.Sprintf("%v.%v.svc", serviceMetadata.Name, serviceMetadata.Namespace),
-		},
-		SerialNumber: big.NewInt(1658),
-		Subject: pkix.Name{
-			CommonName:   fmt.Sprintf("%v.%v.svc", serviceMetadata.Name, serviceMetadata.Namespace),
-			Organization: []string{organizationName},
-		},
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().AddDate(1, 0, 0),
-		SubjectKeyId: []byte{1, 2, 4, 8},
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:     x509.KeyUsageDigitalSignature,
-	}
-
-	tlsKey, err := rsa.GenerateKey(cryptorand.Reader, keyLength)
+	encodedCaKey, err := encode(caKey)
 	if err != nil {
 		return nil, err
 	}
-	tlsCert, err := createCert(tlsX509Cert, tlsKey.PublicKey, caX509Cert, *caKey)
+
+	return &CertificateAuthority{
+		cert:    parsedCaCert,
+		key:     caKey,
+		certPem: caCert.Bytes(),
+		keyPem:  encodedCaKey.Bytes(),
+	}, nil
+}
+
+func issue(serviceMetadata webhook.ServiceMetadata, certSettings CertSettings, ca *CertificateAuthority, now time.Time) (*bytes.Buffer, *bytes.Buffer, error) {
+	logger.Logger.Debugln("generating tls key + cert")
+	tlsKey, err := generateKey(certSettings.KeyAlgorithm)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-
-	encodedCaKey, err := encode(*caKey)
+	tlsSerialNumber, err := randomSerialNumber()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	encodedTlsKey, err := encode(*tlsKey)
+	tlsSubjectKeyId, err := subjectKeyId(tlsKey.Public())
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	certs := &Certs{
-		caCert.Bytes(),
-		encodedCaKey.Bytes(),
-		tlsCert.Bytes(),
-		encodedTlsKey.Bytes(),
+	notAfter := now.Add(certSettings.TlsValidity)
+	if notAfter.After(ca.cert.NotAfter) {
+		logger.Logger.WithFields(logrus.Fields{
+			"caNotAfter": ca.cert.NotAfter,
+		}).Warnln("tls cert must not outlive its ca, shortening its validity")
+		notAfter = ca.cert.NotAfter
 	}
 
-	if err := write(certs, outputFiles); err != nil {
-		return nil, err
+	dnsNames, ipAddresses := subjectAltNames(serviceMetadata, certSettings)
+	tlsX509Cert := &x509.Certificate{
+		DNSNames:     dnsNames,
+		IPAddresses:  ipAddresses,
+		SerialNumber: tlsSerialNumber,
+		Subject: pkix.Name{
+			CommonName:   serviceMetadata.ServerName(),
+			Organization: []string{certSettings.Organization},
+		},
+		NotBefore:      now,
+		NotAfter:       notAfter,
+		SubjectKeyId:   tlsSubjectKeyId,
+		AuthorityKeyId: ca.cert.SubjectKeyId,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		KeyUsage:       keyUsage(tlsKey),
 	}
 
-	logger.Logger.WithFields(logrus.Fields{
-		"serviceMetadata": fmt.Sprintf("%+v", serviceMetadata),
-		"outputFiles":     fmt.Sprintf("%+v", outputFiles),
-	}).Infoln("successfully generated certs")
+	tlsCert, err := createCert(tlsX509Cert, tlsKey.Public(), ca.cert, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	encodedTlsKey, err := encode(tlsKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tlsCert, encodedTlsKey, nil
+}
 
-	return certs, nil
+// subjectAltNames returns the names the TLS cert is valid for - hosts that are IPs are added as IP SANs
+func subjectAltNames(serviceMetadata webhook.ServiceMetadata, certSettings CertSettings) ([]string, []net.IP) {
+	var dnsNames []string
+	ipAddresses := append([]net.IP{}, certSettings.IpAddresses...)
+	for _, hostname := range append(serviceMetadata.Hostnames(certSettings.ClusterDomain), certSettings.DnsNames...) {
+		if ip := net.ParseIP(hostname); ip != nil {
+			ipAddresses = append(ipAddresses, ip)
+		} else {
+			dnsNames = append(dnsNames, hostname)
+		}
+	}
+	return dnsNames, ipAddresses
 }
 
-func createCert(x509Cert *x509.Certificate, publicKey rsa.PublicKey, caX509Cert *x509.Certificate, caKey rsa.PrivateKey) (*bytes.Buffer, error) {
-	certBytes, err := x509.CreateCertificate(cryptorand.Reader, x509Cert, caX509Cert, &publicKey, &caKey)
+func createCert(x509Cert *x509.Certificate, publicKey crypto.PublicKey, caX509Cert *x509.Certificate, caKey crypto.Signer) (*bytes.Buffer, error) {
+	certBytes, err := x509.CreateCertificate(cryptorand.Reader, x509Cert, caX509Cert, publicKey, caKey)
 	if err != nil {
 		return nil, err
 	}
@@ -132,13 +235,17 @@ func createCert(x509Cert *x509.Certificate, publicKey rsa.PublicKey, caX509Cert
 	return certPem, err
 }
 
-func encode(key rsa.PrivateKey) (*bytes.Buffer, error) {
-	keyPem := &bytes.Buffer{}
-	err := pem.Encode(keyPem, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(&key),
-	})
-	return keyPem, err
+func (s CertSettings) validate() error {
+	if err := s.KeyAlgorithm.validate(); err != nil {
+		return err
+	}
+	if s.CaValidity <= 0 || s.TlsValidity <= 0 {
+		return fmt.Errorf("cert validity must be positive")
+	}
+	if s.Ca == nil && s.TlsValidity > s.CaValidity {
+		return fmt.Errorf("tls cert validity (%v) must not exceed ca validity (%v)", s.TlsValidity, s.CaValidity)
+	}
+	return nil
 }
 
 func write(certs *Certs, outputFiles CertOutputFiles) error {
@@ -157,7 +264,33 @@ func write(certs *Certs, outputFiles CertOutputFiles) error {
 	return nil
 }
 
+func read(outputFiles CertOutputFiles) (*Certs, error) {
+	var err error
+	certs := &Certs{}
+	if certs.CaCert, err = ioutil.ReadFile(outputFiles.CaCertOutputFile); err != nil {
+		return nil, err
+	}
+	// not written for an external CA
+	if certs.CaKey, err = ioutil.ReadFile(outputFiles.CaKeyOutputFile); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if certs.TlsCert, err = ioutil.ReadFile(outputFiles.TlsCertOutputFile); err != nil {
+		return nil, err
+	}
+	if certs.TlsKey, err = ioutil.ReadFile(outputFiles.TlsKeyOutputFile); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
 func writeFile(bytes []byte, path string) error {
+	if len(bytes) == 0 {
+		logger.Logger.WithFields(logrus.Fields{
+			"path": path,
+		}).Debugln("nothing to write, skipping file")
+		return nil
+	}
+
 	logger.Logger.WithFields(logrus.Fields{
 		"path": path,
 	}).Debugln("writing file...")
@@ -1,9 +1,14 @@
 package cert_generator
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"github.com/stretchr/testify/assert"
 	"k8s-pod-mutator-webhook/pkg/webhook"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestGenerate(t *testing.T) {
@@ -12,6 +17,7 @@ func TestGenerate(t *testing.T) {
 			Name:      "some-service-name",
 			Namespace: "some-service-namespace",
 		},
+		DefaultCertSettings,
 		CertOutputFiles{
 			CaCertOutputFile:  "/tmp/ca.crt",
 			CaKeyOutputFile:   "/tmp/ca.key",
@@ -25,3 +31,186 @@ func TestGenerate(t *testing.T) {
 	assert.NotNil(t, certs.TlsCert)
 	assert.NotNil(t, certs.TlsKey)
 }
+
+func TestGenerate_CreatesValidCertsForAllKeyAlgorithms(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, keyAlgorithm := range KeyAlgorithms {
+		certSettings := DefaultCertSettings
+		certSettings.KeyAlgorithm = keyAlgorithm
+		certSettings.CaValidity = 10 * 365 * 24 * time.Hour
+		certSettings.TlsValidity = 90 * 24 * time.Hour
+		certSettings.Organization = "some-organization"
+		certSettings.CaCommonName = "some-ca"
+
+		certs, err := generate(testServiceMetadata, certSettings, now)
+		assert.NoError(t, err, keyAlgorithm)
+
+		caCert, err := parseCert(certs.CaCert)
+		assert.NoError(t, err, keyAlgorithm)
+		tlsCert, err := parseCert(certs.TlsCert)
+		assert.NoError(t, err, keyAlgorithm)
+
+		// chain, SANs and key usages
+		roots := x509.NewCertPool()
+		roots.AddCert(caCert)
+		for _, dnsName := range []string{"some-service-name", "some-service-name.some-service-namespace", "some-service-name.some-service-namespace.svc"} {
+			_, err = tlsCert.Verify(x509.VerifyOptions{
+				DNSName:     dnsName,
+				Roots:       roots,
+				CurrentTime: now.Add(time.Hour),
+				KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			})
+			assert.NoError(t, err, keyAlgorithm)
+		}
+		assert.True(t, caCert.IsCA, keyAlgorithm)
+		assert.NotZero(t, caCert.KeyUsage&x509.KeyUsageCertSign, keyAlgorithm)
+		assert.False(t, tlsCert.IsCA, keyAlgorithm)
+		assert.NotZero(t, tlsCert.KeyUsage&x509.KeyUsageDigitalSignature, keyAlgorithm)
+		assert.Contains(t, tlsCert.ExtKeyUsage, x509.ExtKeyUsageServerAuth, keyAlgorithm)
+
+		// validity and subject
+		assert.Equal(t, now.Add(certSettings.CaValidity), caCert.NotAfter.UTC(), keyAlgorithm)
+		assert.Equal(t, now.Add(certSettings.TlsValidity), tlsCert.NotAfter.UTC(), keyAlgorithm)
+		assert.Equal(t, "some-ca", caCert.Subject.CommonName, keyAlgorithm)
+		assert.Equal(t, []string{"some-organization"}, caCert.Subject.Organization, keyAlgorithm)
+		assert.Equal(t, []string{"some-organization"}, tlsCert.Subject.Organization, keyAlgorithm)
+
+		// key identifiers
+		caSubjectKeyId, _ := subjectKeyId(caCert.PublicKey)
+		tlsSubjectKeyId, _ := subjectKeyId(tlsCert.PublicKey)
+		assert.Len(t, caCert.SubjectKeyId, 20, keyAlgorithm)
+		assert.Equal(t, caSubjectKeyId, caCert.SubjectKeyId, keyAlgorithm)
+		assert.Equal(t, tlsSubjectKeyId, tlsCert.SubjectKeyId, keyAlgorithm)
+		assert.Equal(t, caCert.SubjectKeyId, tlsCert.AuthorityKeyId, keyAlgorithm)
+
+		// PKCS#8 keys matching the certs
+		for _, keyPem := range [][]byte{certs.CaKey, certs.TlsKey} {
+			block, _ := pem.Decode(keyPem)
+			assert.Equal(t, "PRIVATE KEY", block.Type, keyAlgorithm)
+			_, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			assert.NoError(t, err, keyAlgorithm)
+		}
+		_, err = tls.X509KeyPair(certs.CaCert, certs.CaKey)
+		assert.NoError(t, err, keyAlgorithm)
+		_, err = tls.X509KeyPair(certs.TlsCert, certs.TlsKey)
+		assert.NoError(t, err, keyAlgorithm)
+	}
+}
+
+func TestGenerate_SubjectAltNames(t *testing.T) {
+	withClusterDomain := DefaultCertSettings
+	withClusterDomain.ClusterDomain = "example.org"
+
+	withoutClusterDomain := DefaultCertSettings
+	withoutClusterDomain.ClusterDomain = ""
+
+	withExtraSans := DefaultCertSettings
+	withExtraSans.DnsNames = []string{"webhook.example.org"}
+	withExtraSans.IpAddresses = []net.IP{net.ParseIP("10.0.0.1")}
+
+	testCases := []struct {
+		description         string
+		serviceMetadata     webhook.ServiceMetadata
+		certSettings        CertSettings
+		expectedDnsNames    []string
+		expectedIpAddresses []string
+	}{
+		{
+			description:     "service",
+			serviceMetadata: testServiceMetadata,
+			certSettings:    DefaultCertSettings,
+			expectedDnsNames: []string{
+				"some-service-name",
+				"some-service-name.some-service-namespace",
+				"some-service-name.some-service-namespace.svc",
+				"some-service-name.some-service-namespace.svc.cluster.local",
+			},
+		},
+		{
+			description:     "custom cluster domain",
+			serviceMetadata: testServiceMetadata,
+			certSettings:    withClusterDomain,
+			expectedDnsNames: []string{
+				"some-service-name",
+				"some-service-name.some-service-namespace",
+				"some-service-name.some-service-namespace.svc",
+				"some-service-name.some-service-namespace.svc.example.org",
+			},
+		},
+		{
+			description:     "without cluster domain",
+			serviceMetadata: testServiceMetadata,
+			certSettings:    withoutClusterDomain,
+			expectedDnsNames: []string{
+				"some-service-name",
+				"some-service-name.some-service-namespace",
+				"some-service-name.some-service-namespace.svc",
+			},
+		},
+		{
+			description:         "extra sans",
+			serviceMetadata:     webhook.ServiceMetadata{Host: "localhost"},
+			certSettings:        withExtraSans,
+			expectedDnsNames:    []string{"localhost", "webhook.example.org"},
+			expectedIpAddresses: []string{"10.0.0.1"},
+		},
+		{
+			description:         "url host is an ip",
+			serviceMetadata:     webhook.ServiceMetadata{Host: "192.168.0.10"},
+			certSettings:        DefaultCertSettings,
+			expectedIpAddresses: []string{"192.168.0.10"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		certs, err := generate(testCase.serviceMetadata, testCase.certSettings, time.Now())
+		assert.NoError(t, err, testCase.description)
+		assert.NoError(t, validate(certs, testCase.serviceMetadata, testCase.certSettings, time.Now()), testCase.description)
+
+		tlsCert, _ := parseCert(certs.TlsCert)
+		assert.Equal(t, testCase.expectedDnsNames, tlsCert.DNSNames, testCase.description)
+		var ipAddresses []string
+		for _, ipAddress := range tlsCert.IPAddresses {
+			ipAddresses = append(ipAddresses, ipAddress.String())
+		}
+		assert.Equal(t, testCase.expectedIpAddresses, ipAddresses, testCase.description)
+		assert.Equal(t, testCase.serviceMetadata.ServerName(), tlsCert.Subject.CommonName, testCase.description)
+	}
+
+	// certs are regenerated once additional SANs are configured
+	certs, _ := generate(testServiceMetadata, withoutClusterDomain, time.Now())
+	assert.Error(t, validate(certs, testServiceMetadata, DefaultCertSettings, time.Now()))
+	assert.Error(t, validate(certs, testServiceMetadata, withExtraSans, time.Now()))
+}
+
+func TestGenerate_UsesRandomSerialNumbers(t *testing.T) {
+	serialNumbers := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		certs, err := generate(testServiceMetadata, DefaultCertSettings, time.Now())
+		assert.NoError(t, err)
+
+		for _, certPem := range [][]byte{certs.CaCert, certs.TlsCert} {
+			cert, _ := parseCert(certPem)
+			assert.LessOrEqual(t, cert.SerialNumber.BitLen(), 128)
+			serialNumbers[cert.SerialNumber.String()] = true
+		}
+	}
+	assert.Len(t, serialNumbers, 6)
+}
+
+func TestGenerate_RejectsInvalidSettings(t *testing.T) {
+	unknownAlgorithm := DefaultCertSettings
+	unknownAlgorithm.KeyAlgorithm = "dsa-1024"
+
+	tlsOutlivesCa := DefaultCertSettings
+	tlsOutlivesCa.TlsValidity = 2 * tlsOutlivesCa.CaValidity
+
+	noValidity := DefaultCertSettings
+	noValidity.TlsValidity = 0
+
+	for _, certSettings := range []CertSettings{unknownAlgorithm, tlsOutlivesCa, noValidity} {
+		_, err := generate(testServiceMetadata, certSettings, time.Now())
+		assert.Error(t, err, "%+v", certSettings)
+	}
+}
@@ -0,0 +1,104 @@
+package cert_generator
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+)
+
+type KeyAlgorithm string
+
+const (
+	RSA2048   KeyAlgorithm = "rsa-2048"
+	RSA4096   KeyAlgorithm = "rsa-4096"
+	ECDSAP256 KeyAlgorithm = "ecdsa-p256"
+	ECDSAP384 KeyAlgorithm = "ecdsa-p384"
+	Ed25519   KeyAlgorithm = "ed25519"
+)
+
+var KeyAlgorithms = []KeyAlgorithm{RSA2048, RSA4096, ECDSAP256, ECDSAP384, Ed25519}
+
+const serialNumberBits = 128
+
+func (a KeyAlgorithm) validate() error {
+	for _, keyAlgorithm := range KeyAlgorithms {
+		if a == keyAlgorithm {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported key algorithm %q, expected one of %v", a, KeyAlgorithms)
+}
+
+func generateKey(algorithm KeyAlgorithm) (crypto.Signer, error) {
+	switch algorithm {
+	case RSA2048:
+		return rsa.GenerateKey(cryptorand.Reader, 2048)
+	case RSA4096:
+		return rsa.GenerateKey(cryptorand.Reader, 4096)
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	case ECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), cryptorand.Reader)
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(cryptorand.Reader)
+		return key, err
+	default:
+		return nil, algorithm.validate()
+	}
+}
+
+// keyUsage returns the key usages for a TLS cert - RSA keys are also used for key exchange (key encipherment)
+func keyUsage(key crypto.Signer) x509.KeyUsage {
+	if _, isRsa := key.Public().(*rsa.PublicKey); isRsa {
+		return x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	}
+	return x509.KeyUsageDigitalSignature
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	return cryptorand.Int(cryptorand.Reader, new(big.Int).Lsh(big.NewInt(1), serialNumberBits))
+}
+
+// subjectKeyId derives the key identifier from the SHA-1 hash of the public key (RFC 5280, section 4.2.1.2)
+func subjectKeyId(publicKey crypto.PublicKey) ([]byte, error) {
+	publicKeyDer, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var subjectPublicKeyInfo struct {
+		Algorithm        pkix.AlgorithmIdentifier
+		SubjectPublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(publicKeyDer, &subjectPublicKeyInfo); err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum(subjectPublicKeyInfo.SubjectPublicKey.Bytes)
+	return hash[:], nil
+}
+
+func encode(key crypto.Signer) (*bytes.Buffer, error) {
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPem := &bytes.Buffer{}
+	err = pem.Encode(keyPem, &pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: keyDer,
+	})
+	return keyPem, err
+}
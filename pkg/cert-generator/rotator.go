@@ -0,0 +1,242 @@
+package cert_generator
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"k8s-pod-mutator-webhook/internal/logger"
+	"k8s-pod-mutator-webhook/pkg/webhook"
+	"k8s.io/client-go/kubernetes"
+	"time"
+)
+
+const minRotationCheckInterval = time.Minute
+
+type RotationSettings struct {
+	// RenewBefore is the duration before the expiry of the TLS cert at which it is renewed
+	RenewBefore time.Duration
+	// Overlap is the duration for which the previous CA is kept in the caBundle after a renewal,
+	// so that replicas that still serve the previous TLS cert remain trusted
+	Overlap       time.Duration
+	CheckInterval time.Duration
+	// ReconcileCaBundle re-applies the caBundle on every check, e.g. in case it has been overwritten by someone else
+	ReconcileCaBundle bool
+}
+
+// ValidateRotationSettings rejects settings under which the certs would be due for renewal on every check, or the
+// previous CA could be removed from the caBundle before the next check has handed the new TLS cert to all replicas
+func ValidateRotationSettings(settings RotationSettings, certSettings CertSettings) error {
+	if certSettings.TlsValidity <= settings.RenewBefore {
+		return fmt.Errorf("the validity of the TLS cert (%v) must exceed the renewal before expiry (%v)", certSettings.TlsValidity, settings.RenewBefore)
+	}
+	if settings.Overlap <= settings.CheckInterval {
+		return fmt.Errorf("the overlap of the previous CA (%v) must exceed the check interval (%v)", settings.Overlap, settings.CheckInterval)
+	}
+	return nil
+}
+
+// certProvider returns certs that do not need to be renewed yet at now - either the current or new ones
+type certProvider func(current *Certs, now time.Time) (*Certs, error)
+
+// Rotator renews the certs before they expire, publishes the new CA (alongside the previous one for the overlap window)
+// in the webhook configuration and then hands the new TLS cert to the server.
+type Rotator struct {
+	settings      RotationSettings
+	provide       certProvider
+	applyCaBundle func(caBundle []byte) error
+	writeCerts    func(certs *Certs) error
+	reload        func() error
+	now           func() time.Time
+	// externalCa issues the TLS certs if set, its expiry cannot be fixed by renewing them
+	externalCa *CertificateAuthority
+
+	current         *Certs
+	previousCaCert  []byte
+	previousCaUntil time.Time
+}
+
+// NewRotator creates a Rotator that generates new certs locally. Only suitable for a single replica.
+func NewRotator(settings RotationSettings, client kubernetes.Interface, serviceMetadata webhook.ServiceMetadata, certSettings CertSettings, configuration *webhook.Configuration, outputFiles CertOutputFiles, reload func() error) *Rotator {
+	provide := func(current *Certs, now time.Time) (*Certs, error) {
+		if current != nil && validate(current, serviceMetadata, certSettings, now.Add(settings.RenewBefore)) == nil {
+			return current, nil
+		}
+		return generate(serviceMetadata, certSettings, now)
+	}
+	return newRotator(settings, provide, client, certSettings.Ca, configuration, outputFiles, reload)
+}
+
+// NewSecretRotator creates a Rotator that renews the certs in the given Secret, so that all replicas converge on the same certs.
+func NewSecretRotator(settings RotationSettings, client kubernetes.Interface, serviceMetadata webhook.ServiceMetadata, certSettings CertSettings, secretSettings SecretSettings, configuration *webhook.Configuration, outputFiles CertOutputFiles, reload func() error) *Rotator {
+	provide := func(current *Certs, now time.Time) (*Certs, error) {
+		return loadOrStore(client, serviceMetadata, certSettings, secretSettings, now, settings.RenewBefore)
+	}
+	return newRotator(settings, provide, client, certSettings.Ca, configuration, outputFiles, reload)
+}
+
+func newRotator(settings RotationSettings, provide certProvider, client kubernetes.Interface, externalCa *CertificateAuthority, configuration *webhook.Configuration, outputFiles CertOutputFiles, reload func() error) *Rotator {
+	current, err := read(outputFiles)
+	if err != nil {
+		logger.Logger.WithFields(logrus.Fields{
+			"error": err,
+		}).Warnln("could not read current certs, will renew them")
+	}
+
+	return &Rotator{
+		settings: settings,
+		provide:  provide,
+		// the webhook configurations have been applied by the init-container, only the caBundle changes
+		applyCaBundle: func(caBundle []byte) error {
+			return configuration.PatchCaBundle(client, caBundle)
+		},
+		writeCerts: func(certs *Certs) error {
+			return write(certs, outputFiles)
+		},
+		reload:     reload,
+		now:        time.Now,
+		externalCa: externalCa,
+		current:    current,
+	}
+}
+
+func (r *Rotator) Run(stop <-chan struct{}) {
+	logger.Logger.WithFields(logrus.Fields{
+		"settings": fmt.Sprintf("%+v", r.settings),
+	}).Infoln("starting cert rotation")
+
+	for {
+		nextCheck, err := r.reconcile()
+		if err != nil {
+			logger.Logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Errorln("cert rotation failed")
+		}
+
+		logger.Logger.WithFields(logrus.Fields{
+			"nextCheck": nextCheck,
+		}).Debugln("scheduled next cert rotation check")
+
+		timer := time.NewTimer(nextCheck.Sub(r.now()))
+		select {
+		case <-stop:
+			timer.Stop()
+			logger.Logger.Infoln("stopped cert rotation")
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// reconcile renews the certs if necessary, drops the previous CA once the overlap window has passed
+// and returns the time of the next check
+func (r *Rotator) reconcile() (time.Time, error) {
+	now := r.now()
+	nextCheck := now.Add(r.settings.CheckInterval)
+
+	// a TLS cert issued now would expire with the external CA as well, so renewing it would only repeat every check
+	caExpiresFirst := r.caExpiresFirst(now)
+	certs := r.current
+	if caExpiresFirst {
+		logger.Logger.WithFields(logrus.Fields{
+			"caNotAfter": r.externalCa.cert.NotAfter,
+		}).Warnln("external ca expires within the renewal window, not renewing the tls cert until the ca is replaced")
+	} else {
+		var err error
+		if certs, err = r.provide(r.current, now); err != nil {
+			return now.Add(minRotationCheckInterval), err
+		}
+	}
+
+	if r.current == nil || !bytes.Equal(certs.TlsCert, r.current.TlsCert) {
+		if err := r.rotate(certs, now); err != nil {
+			return now.Add(minRotationCheckInterval), err
+		}
+	} else if r.previousCaCert != nil && !now.Before(r.previousCaUntil) {
+		if err := r.dropPreviousCa(); err != nil {
+			return now.Add(minRotationCheckInterval), err
+		}
+	} else if r.settings.ReconcileCaBundle {
+		if err := r.applyCaBundle(caBundle(r.current.CaCert, r.previousCaCert)); err != nil {
+			return now.Add(minRotationCheckInterval), fmt.Errorf("could not reconcile caBundle: %v", err)
+		}
+	}
+
+	tlsCert, err := parseCert(r.current.TlsCert)
+	if err != nil {
+		return now.Add(minRotationCheckInterval), err
+	}
+	if renewAt := tlsCert.NotAfter.Add(-r.settings.RenewBefore); !caExpiresFirst && renewAt.Before(nextCheck) {
+		nextCheck = renewAt
+	}
+	if r.previousCaCert != nil && r.previousCaUntil.Before(nextCheck) {
+		nextCheck = r.previousCaUntil
+	}
+	if minNextCheck := now.Add(minRotationCheckInterval); nextCheck.Before(minNextCheck) {
+		nextCheck = minNextCheck
+	}
+	return nextCheck, nil
+}
+
+// caExpiresFirst reports whether the current TLS cert is only due for renewal because it expires with the external CA,
+// which itself expires within RenewBefore
+func (r *Rotator) caExpiresFirst(now time.Time) bool {
+	if r.externalCa == nil || r.current == nil || !bytes.Equal(r.current.CaCert, r.externalCa.certPem) {
+		return false
+	}
+	caNotAfter := r.externalCa.cert.NotAfter
+	if !now.Before(caNotAfter) || !caNotAfter.Before(now.Add(r.settings.RenewBefore)) {
+		return false
+	}
+	tlsCert, err := parseCert(r.current.TlsCert)
+	if err != nil {
+		return false
+	}
+	return now.Before(tlsCert.NotAfter) && !tlsCert.NotAfter.Before(caNotAfter)
+}
+
+func (r *Rotator) rotate(certs *Certs, now time.Time) error {
+	logger.Logger.Infoln("rotating certs...")
+
+	// the new CA must be trusted before the new TLS cert is served, the previous one as long as the previous TLS cert may still be served
+	previousCaCert := r.previousCaCert
+	previousCaUntil := r.previousCaUntil
+	if r.current != nil && !bytes.Equal(certs.CaCert, r.current.CaCert) {
+		previousCaCert = r.current.CaCert
+		previousCaUntil = now.Add(r.settings.Overlap)
+	}
+
+	if err := r.applyCaBundle(caBundle(certs.CaCert, previousCaCert)); err != nil {
+		return fmt.Errorf("could not apply caBundle: %v", err)
+	}
+	if err := r.writeCerts(certs); err != nil {
+		return fmt.Errorf("could not write certs: %v", err)
+	}
+	if err := r.reload(); err != nil {
+		return fmt.Errorf("could not reload certs: %v", err)
+	}
+
+	r.current = certs
+	r.previousCaCert = previousCaCert
+	r.previousCaUntil = previousCaUntil
+
+	logger.Logger.WithFields(logrus.Fields{
+		"previousCaUntil": previousCaUntil,
+	}).Infoln("successfully rotated certs")
+	return nil
+}
+
+func (r *Rotator) dropPreviousCa() error {
+	logger.Logger.Infoln("overlap window has passed, removing previous ca from caBundle...")
+
+	if err := r.applyCaBundle(caBundle(r.current.CaCert, nil)); err != nil {
+		return fmt.Errorf("could not apply caBundle: %v", err)
+	}
+	r.previousCaCert = nil
+	r.previousCaUntil = time.Time{}
+	return nil
+}
+
+func caBundle(caCert []byte, previousCaCert []byte) []byte {
+	bundle := append([]byte{}, caCert...)
+	return append(bundle, previousCaCert...)
+}
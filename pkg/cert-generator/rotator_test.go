@@ -0,0 +1,213 @@
+package cert_generator
+
+import (
+	"crypto/x509"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var testRotationSettings = RotationSettings{
+	RenewBefore:   30 * 24 * time.Hour,
+	Overlap:       24 * time.Hour,
+	CheckInterval: time.Hour,
+}
+
+type fakeCluster struct {
+	caBundles    [][]byte
+	writtenCerts []*Certs
+	reloads      int
+	calls        []string
+	applyError   error
+}
+
+func newTestRotator(current *Certs, clock *time.Time, cluster *fakeCluster) *Rotator {
+	return &Rotator{
+		settings: testRotationSettings,
+		provide: func(current *Certs, now time.Time) (*Certs, error) {
+			if current != nil && validate(current, testServiceMetadata, DefaultCertSettings, now.Add(testRotationSettings.RenewBefore)) == nil {
+				return current, nil
+			}
+			return generate(testServiceMetadata, DefaultCertSettings, now)
+		},
+		applyCaBundle: func(caBundle []byte) error {
+			cluster.calls = append(cluster.calls, "apply")
+			if cluster.applyError != nil {
+				return cluster.applyError
+			}
+			cluster.caBundles = append(cluster.caBundles, caBundle)
+			return nil
+		},
+		writeCerts: func(certs *Certs) error {
+			cluster.calls = append(cluster.calls, "write")
+			cluster.writtenCerts = append(cluster.writtenCerts, certs)
+			return nil
+		},
+		reload: func() error {
+			cluster.calls = append(cluster.calls, "reload")
+			cluster.reloads++
+			return nil
+		},
+		now: func() time.Time {
+			return *clock
+		},
+		current: current,
+	}
+}
+
+func TestRotator_DoesNotRotateValidCerts(t *testing.T) {
+	issuedAt := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	certs, _ := generate(testServiceMetadata, DefaultCertSettings, issuedAt)
+	clock := issuedAt.Add(24 * time.Hour)
+	cluster := &fakeCluster{}
+	rotator := newTestRotator(certs, &clock, cluster)
+
+	nextCheck, err := rotator.reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, clock.Add(testRotationSettings.CheckInterval), nextCheck)
+	assert.Empty(t, cluster.calls)
+	assert.Equal(t, certs, rotator.current)
+}
+
+func TestRotator_ReconcilesCaBundle(t *testing.T) {
+	issuedAt := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	certs, _ := generate(testServiceMetadata, DefaultCertSettings, issuedAt)
+	clock := issuedAt.Add(24 * time.Hour)
+	cluster := &fakeCluster{}
+	rotator := newTestRotator(certs, &clock, cluster)
+	rotator.settings.ReconcileCaBundle = true
+
+	nextCheck, err := rotator.reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, clock.Add(testRotationSettings.CheckInterval), nextCheck)
+	assert.Equal(t, []string{"apply"}, cluster.calls, "caBundle is re-applied without renewing the certs")
+	assert.Equal(t, [][]byte{certs.CaCert}, cluster.caBundles)
+
+	cluster.applyError = fmt.Errorf("some error")
+	nextCheck, err = rotator.reconcile()
+	assert.Error(t, err)
+	assert.Equal(t, clock.Add(minRotationCheckInterval), nextCheck)
+}
+
+func TestRotator_SchedulesCheckAtRenewalTime(t *testing.T) {
+	issuedAt := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	certs, _ := generate(testServiceMetadata, DefaultCertSettings, issuedAt)
+	renewAt := issuedAt.Add(DefaultCertSettings.TlsValidity).Add(-testRotationSettings.RenewBefore)
+	clock := renewAt.Add(-10 * time.Minute)
+	rotator := newTestRotator(certs, &clock, &fakeCluster{})
+
+	nextCheck, err := rotator.reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, renewAt, nextCheck)
+}
+
+func TestRotator_RotatesCertsBeforeExpiryAndKeepsPreviousCaDuringOverlap(t *testing.T) {
+	issuedAt := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	previousCerts, _ := generate(testServiceMetadata, DefaultCertSettings, issuedAt)
+	clock := issuedAt.Add(DefaultCertSettings.TlsValidity).Add(-testRotationSettings.RenewBefore).Add(time.Minute)
+	cluster := &fakeCluster{}
+	rotator := newTestRotator(previousCerts, &clock, cluster)
+
+	// renewal is due
+	nextCheck, err := rotator.reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"apply", "write", "reload"}, cluster.calls, "new ca must be trusted before the new cert is served")
+	assert.NotEqual(t, previousCerts, rotator.current)
+	assert.Equal(t, rotator.current, cluster.writtenCerts[0])
+	assert.Equal(t, caBundle(rotator.current.CaCert, previousCerts.CaCert), cluster.caBundles[0])
+	assert.Equal(t, clock.Add(testRotationSettings.CheckInterval), nextCheck)
+
+	newTlsCert, _ := parseCert(rotator.current.TlsCert)
+	assert.Equal(t, clock.Add(DefaultCertSettings.TlsValidity), newTlsCert.NotAfter.UTC())
+
+	// within the overlap window
+	clock = clock.Add(23 * time.Hour)
+	nextCheck, err = rotator.reconcile()
+	assert.NoError(t, err)
+	assert.Len(t, cluster.caBundles, 1)
+	assert.Equal(t, clock.Add(time.Hour), nextCheck, "next check at the end of the overlap window")
+
+	// overlap window has passed
+	clock = clock.Add(time.Hour)
+	_, err = rotator.reconcile()
+	assert.NoError(t, err)
+	assert.Len(t, cluster.caBundles, 2)
+	assert.Equal(t, rotator.current.CaCert, cluster.caBundles[1])
+	assert.Equal(t, 1, cluster.reloads)
+	assert.Nil(t, rotator.previousCaCert)
+}
+
+func TestRotator_RotatesIfCurrentCertsAreUnknown(t *testing.T) {
+	clock := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	cluster := &fakeCluster{}
+	rotator := newTestRotator(nil, &clock, cluster)
+
+	_, err := rotator.reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"apply", "write", "reload"}, cluster.calls)
+	assert.Equal(t, rotator.current.CaCert, cluster.caBundles[0])
+}
+
+func TestRotator_RetriesIfCaBundleCannotBeApplied(t *testing.T) {
+	issuedAt := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	previousCerts, _ := generate(testServiceMetadata, DefaultCertSettings, issuedAt)
+	clock := issuedAt.Add(DefaultCertSettings.TlsValidity).Add(-time.Hour)
+	cluster := &fakeCluster{applyError: fmt.Errorf("api server unavailable")}
+	rotator := newTestRotator(previousCerts, &clock, cluster)
+
+	nextCheck, err := rotator.reconcile()
+	assert.Error(t, err)
+	assert.Equal(t, []string{"apply"}, cluster.calls, "certs must not be served before the ca is trusted")
+	assert.Equal(t, previousCerts, rotator.current)
+	assert.Equal(t, clock.Add(minRotationCheckInterval), nextCheck)
+
+	cluster.applyError = nil
+	clock = nextCheck
+	_, err = rotator.reconcile()
+	assert.NoError(t, err)
+	assert.NotEqual(t, previousCerts, rotator.current)
+	assert.Equal(t, 1, cluster.reloads)
+}
+
+func TestRotator_DoesNotRenewTlsCertIfOnlyExternalCaExpires(t *testing.T) {
+	// the external ca is valid for 24h, i.e. within RenewBefore
+	root, intermediateCertPem, intermediateKeyPem := createIntermediateCa(t, true, x509.KeyUsageCertSign)
+	ca, err := ParseCa(append(intermediateCertPem, root.certPem...), intermediateKeyPem)
+	assert.NoError(t, err)
+	certSettings := DefaultCertSettings
+	certSettings.Ca = ca
+
+	issuedAt := time.Now()
+	certs, err := generate(testServiceMetadata, certSettings, issuedAt)
+	assert.NoError(t, err)
+	clock := issuedAt.Add(time.Hour)
+	cluster := &fakeCluster{}
+	rotator := newTestRotator(certs, &clock, cluster)
+	rotator.provide = func(current *Certs, now time.Time) (*Certs, error) {
+		return generate(testServiceMetadata, certSettings, now)
+	}
+	rotator.externalCa = ca
+
+	nextCheck, err := rotator.reconcile()
+	assert.NoError(t, err)
+	assert.Empty(t, cluster.calls)
+	assert.Equal(t, certs, rotator.current)
+	assert.Equal(t, clock.Add(testRotationSettings.CheckInterval), nextCheck, "must not check every minute")
+
+	// once the ca has expired, renewing is attempted again
+	clock = ca.cert.NotAfter.Add(time.Minute)
+	assert.False(t, rotator.caExpiresFirst(clock))
+}
+
+func TestValidateRotationSettings(t *testing.T) {
+	assert.NoError(t, ValidateRotationSettings(testRotationSettings, DefaultCertSettings))
+
+	certSettings := DefaultCertSettings
+	certSettings.TlsValidity = testRotationSettings.RenewBefore
+	assert.Error(t, ValidateRotationSettings(testRotationSettings, certSettings), "TLS cert due for renewal on every check")
+
+	settings := testRotationSettings
+	settings.Overlap = settings.CheckInterval
+	assert.EqualError(t, ValidateRotationSettings(settings, DefaultCertSettings), "the overlap of the previous CA (1h0m0s) must exceed the check interval (1h0m0s)")
+}
@@ -0,0 +1,242 @@
+package cert_generator
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"k8s-pod-mutator-webhook/internal/logger"
+	"k8s-pod-mutator-webhook/pkg/webhook"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"time"
+)
+
+const (
+	caCertSecretKey  = "ca.crt"
+	caKeySecretKey   = "ca.key"
+	tlsCertSecretKey = corev1.TLSCertKey
+	tlsKeySecretKey  = corev1.TLSPrivateKeyKey
+)
+
+const maxSecretAttempts = 5
+
+type SecretSettings struct {
+	Name        string
+	Namespace   string
+	RenewBefore time.Duration
+	// Owner is set as webhook.OwnerLabel, if not empty
+	Owner string
+}
+
+// GenerateOrReuse loads the certs from the given Secret, or generates and stores them if the Secret does not exist
+// or its certs are invalid or about to expire. Concurrent callers (e.g. several replicas starting at once) converge
+// on the same certs, as only the first Create/Update succeeds and everybody else re-reads the Secret.
+func GenerateOrReuse(client kubernetes.Interface, serviceMetadata webhook.ServiceMetadata, certSettings CertSettings, secretSettings SecretSettings, outputFiles CertOutputFiles) (*Certs, error) {
+	logger.Logger.WithFields(logrus.Fields{
+		"serviceMetadata": fmt.Sprintf("%+v", serviceMetadata),
+		"secretSettings":  fmt.Sprintf("%+v", secretSettings),
+		"outputFiles":     fmt.Sprintf("%+v", outputFiles),
+	}).Infoln("generating or reusing certs")
+
+	certs, err := loadOrStore(client, serviceMetadata, certSettings, secretSettings, time.Now(), secretSettings.RenewBefore)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := write(certs, outputFiles); err != nil {
+		return nil, err
+	}
+
+	logger.Logger.WithFields(logrus.Fields{
+		"serviceMetadata": fmt.Sprintf("%+v", serviceMetadata),
+		"secret":          secretSettings.Name,
+		"outputFiles":     fmt.Sprintf("%+v", outputFiles),
+	}).Infoln("successfully provided certs")
+
+	return certs, nil
+}
+
+// loadOrStore returns the certs from the Secret if they do not expire within renewBefore, or generates and stores new ones
+func loadOrStore(client kubernetes.Interface, serviceMetadata webhook.ServiceMetadata, certSettings CertSettings, secretSettings SecretSettings, now time.Time, renewBefore time.Duration) (*Certs, error) {
+	secrets := client.CoreV1().Secrets(secretSettings.Namespace)
+
+	for attempt := 1; attempt <= maxSecretAttempts; attempt++ {
+		logFields := logrus.Fields{
+			"name":      secretSettings.Name,
+			"namespace": secretSettings.Namespace,
+			"attempt":   attempt,
+		}
+
+		logger.Logger.WithFields(logFields).Debugln("checking if secret exists...")
+		existingSecret, err := secrets.Get(context.TODO(), secretSettings.Name, metav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+
+		exists := err == nil
+
+		if exists {
+			certs := certsFromSecret(existingSecret)
+			err := validate(certs, serviceMetadata, certSettings, now.Add(renewBefore))
+			if err == nil {
+				logger.Logger.WithFields(logFields).Infoln("reusing certs from secret")
+				return certs, nil
+			}
+			logger.Logger.WithFields(logFields).WithFields(logrus.Fields{
+				"reason": err,
+			}).Infoln("certs in secret cannot be reused, regenerating...")
+		}
+
+		certs, err := generate(serviceMetadata, certSettings, now)
+		if err != nil {
+			return nil, err
+		}
+
+		if !exists {
+			logger.Logger.WithFields(logFields).Debugln("secret does not exist, creating...")
+			_, err = secrets.Create(context.TODO(), secretWithCerts(secretSettings, certs), metav1.CreateOptions{})
+		} else {
+			logger.Logger.WithFields(logFields).WithFields(logrus.Fields{
+				"resourceVersion": existingSecret.ResourceVersion,
+			}).Debugln("secret already exists, updating...")
+			secret := secretWithCerts(secretSettings, certs)
+			secret.ResourceVersion = existingSecret.ResourceVersion
+			_, err = secrets.Update(context.TODO(), secret, metav1.UpdateOptions{})
+		}
+
+		if err == nil {
+			return certs, nil
+		}
+		if !errors.IsAlreadyExists(err) && !errors.IsConflict(err) {
+			return nil, err
+		}
+		logger.Logger.WithFields(logFields).WithFields(logrus.Fields{
+			"reason": err,
+		}).Infoln("secret was modified concurrently, retrying...")
+	}
+
+	return nil, fmt.Errorf("could not store certs in secret %v/%v after %v attempts", secretSettings.Namespace, secretSettings.Name, maxSecretAttempts)
+}
+
+func secretWithCerts(secretSettings SecretSettings, certs *Certs) *corev1.Secret {
+	var labels map[string]string
+	if secretSettings.Owner != "" {
+		labels = map[string]string{webhook.OwnerLabel: secretSettings.Owner}
+	}
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretSettings.Name,
+			Namespace: secretSettings.Namespace,
+			Labels:    labels,
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			caCertSecretKey:  certs.CaCert,
+			caKeySecretKey:   certs.CaKey,
+			tlsCertSecretKey: certs.TlsCert,
+			tlsKeySecretKey:  certs.TlsKey,
+		},
+	}
+}
+
+// DeleteOwnedSecrets deletes the Secrets of the given names in the namespace that are owned by the given owner. The Secrets
+// are looked up by name instead of listed, so that only access to these Secrets is required.
+func DeleteOwnedSecrets(client kubernetes.Interface, namespace string, names []string, owner string) error {
+	secrets := client.CoreV1().Secrets(namespace)
+	for _, name := range names {
+		logFields := logrus.Fields{
+			"name":      name,
+			"namespace": namespace,
+			"owner":     owner,
+		}
+
+		secret, err := secrets.Get(context.TODO(), name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			logger.Logger.WithFields(logFields).Debugln("secret does not exist, nothing to delete")
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not get secret %q: %v", name, err)
+		}
+		if secret.Labels[webhook.OwnerLabel] != owner {
+			logger.Logger.WithFields(logFields).Warnln("not deleting secret of another owner")
+			continue
+		}
+
+		logger.Logger.WithFields(logFields).Infoln("deleting owned secret")
+		err = secrets.Delete(context.TODO(), name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &secret.UID}})
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("could not delete secret %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func certsFromSecret(secret *corev1.Secret) *Certs {
+	return &Certs{
+		CaCert:  secret.Data[caCertSecretKey],
+		CaKey:   secret.Data[caKeySecretKey],
+		TlsCert: secret.Data[tlsCertSecretKey],
+		TlsKey:  secret.Data[tlsKeySecretKey],
+	}
+}
+
+// validate checks that the certs are complete, belong together, match the service and CA and are still valid at validAt
+func validate(certs *Certs, serviceMetadata webhook.ServiceMetadata, certSettings CertSettings, validAt time.Time) error {
+	if certSettings.Ca != nil {
+		if !bytes.Equal(certs.CaCert, certSettings.Ca.certPem) {
+			return fmt.Errorf("certs were not issued by the configured ca")
+		}
+	} else if _, err := tls.X509KeyPair(certs.CaCert, certs.CaKey); err != nil {
+		return fmt.Errorf("invalid ca key pair: %v", err)
+	}
+	if _, err := tls.X509KeyPair(certs.TlsCert, certs.TlsKey); err != nil {
+		return fmt.Errorf("invalid tls key pair: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(certs.CaCert) {
+		return fmt.Errorf("could not parse ca cert")
+	}
+	tlsCert, err := parseCert(certs.TlsCert)
+	if err != nil {
+		return err
+	}
+
+	_, err = tlsCert.Verify(x509.VerifyOptions{
+		DNSName:     serviceMetadata.ServerName(),
+		Roots:       roots,
+		CurrentTime: validAt,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return err
+	}
+
+	// the SANs may have been changed since the certs were issued
+	dnsNames, ipAddresses := subjectAltNames(serviceMetadata, certSettings)
+	for _, ipAddress := range ipAddresses {
+		dnsNames = append(dnsNames, ipAddress.String())
+	}
+	for _, dnsName := range dnsNames {
+		if err := tlsCert.VerifyHostname(dnsName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseCert(certPem []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPem)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("could not decode cert pem")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,200 @@
+package cert_generator
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"k8s-pod-mutator-webhook/pkg/webhook"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testServiceMetadata = webhook.ServiceMetadata{
+	Name:      "some-service-name",
+	Namespace: "some-service-namespace",
+}
+
+var testSecretSettings = SecretSettings{
+	Name:        "some-secret",
+	Namespace:   "some-service-namespace",
+	RenewBefore: 30 * 24 * time.Hour,
+}
+
+func TestGenerateOrReuse_CreatesSecretIfMissing(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	outputFiles := testOutputFiles(t)
+
+	certs, err := GenerateOrReuse(client, testServiceMetadata, DefaultCertSettings, testSecretSettings, outputFiles)
+	assert.NoError(t, err)
+
+	secret, err := client.CoreV1().Secrets(testSecretSettings.Namespace).Get(context.TODO(), testSecretSettings.Name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, corev1.SecretTypeTLS, secret.Type)
+	assert.Equal(t, certs, certsFromSecret(secret))
+
+	writtenTlsCert, err := ioutil.ReadFile(outputFiles.TlsCertOutputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, certs.TlsCert, writtenTlsCert)
+}
+
+func TestGenerateOrReuse_ReusesValidSecret(t *testing.T) {
+	existingCerts, _ := generate(testServiceMetadata, DefaultCertSettings, time.Now())
+	client := fake.NewSimpleClientset(secretWithCerts(testSecretSettings, existingCerts))
+
+	certs, err := GenerateOrReuse(client, testServiceMetadata, DefaultCertSettings, testSecretSettings, testOutputFiles(t))
+	assert.NoError(t, err)
+	assert.Equal(t, existingCerts, certs)
+	assert.Empty(t, filterActions(client.Actions(), "create", "update"))
+}
+
+func TestGenerateOrReuse_RegeneratesInvalidSecret(t *testing.T) {
+	otherServiceCerts, _ := generate(webhook.ServiceMetadata{Name: "other-service", Namespace: "some-service-namespace"}, DefaultCertSettings, time.Now())
+	expiringCerts, _ := generate(testServiceMetadata, DefaultCertSettings, time.Now())
+
+	testCases := []struct {
+		description string
+		secret      *corev1.Secret
+		renewBefore time.Duration
+	}{
+		{
+			description: "empty secret",
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: testSecretSettings.Name, Namespace: testSecretSettings.Namespace},
+			},
+			renewBefore: testSecretSettings.RenewBefore,
+		},
+		{
+			description: "certs for another service",
+			secret:      secretWithCerts(testSecretSettings, otherServiceCerts),
+			renewBefore: testSecretSettings.RenewBefore,
+		},
+		{
+			description: "certs about to expire",
+			secret:      secretWithCerts(testSecretSettings, expiringCerts),
+			// generated certs are valid for one year
+			renewBefore: 400 * 24 * time.Hour,
+		},
+	}
+
+	for _, testCase := range testCases {
+		client := fake.NewSimpleClientset(testCase.secret)
+
+		secretSettings := testSecretSettings
+		secretSettings.RenewBefore = testCase.renewBefore
+
+		certs, err := GenerateOrReuse(client, testServiceMetadata, DefaultCertSettings, secretSettings, testOutputFiles(t))
+		assert.NoError(t, err, testCase.description)
+		assert.NotEqual(t, certsFromSecret(testCase.secret), certs, testCase.description)
+
+		secret, _ := client.CoreV1().Secrets(testSecretSettings.Namespace).Get(context.TODO(), testSecretSettings.Name, metav1.GetOptions{})
+		assert.Equal(t, certs, certsFromSecret(secret), testCase.description)
+		assert.Len(t, filterActions(client.Actions(), "update"), 1, testCase.description)
+	}
+}
+
+func TestGenerateOrReuse_ReusesSecretCreatedConcurrently(t *testing.T) {
+	concurrentCerts, _ := generate(testServiceMetadata, DefaultCertSettings, time.Now())
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		// another replica wins the race
+		_ = client.Tracker().Add(secretWithCerts(testSecretSettings, concurrentCerts))
+		return true, nil, errors.NewAlreadyExists(schema.GroupResource{Resource: "secrets"}, testSecretSettings.Name)
+	})
+
+	certs, err := GenerateOrReuse(client, testServiceMetadata, DefaultCertSettings, testSecretSettings, testOutputFiles(t))
+	assert.NoError(t, err)
+	assert.Equal(t, concurrentCerts, certs)
+}
+
+func TestGenerateOrReuse_RetriesOnConflict(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: testSecretSettings.Name, Namespace: testSecretSettings.Namespace},
+	})
+	conflicts := 0
+	client.PrependReactor("update", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts < 2 {
+			conflicts++
+			return true, nil, errors.NewConflict(schema.GroupResource{Resource: "secrets"}, testSecretSettings.Name, nil)
+		}
+		return false, nil, nil
+	})
+
+	certs, err := GenerateOrReuse(client, testServiceMetadata, DefaultCertSettings, testSecretSettings, testOutputFiles(t))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, conflicts)
+
+	secret, _ := client.CoreV1().Secrets(testSecretSettings.Namespace).Get(context.TODO(), testSecretSettings.Name, metav1.GetOptions{})
+	assert.Equal(t, certs, certsFromSecret(secret))
+}
+
+func TestGenerateOrReuse_GivesUpAfterMaxAttempts(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewAlreadyExists(schema.GroupResource{Resource: "secrets"}, testSecretSettings.Name)
+	})
+
+	_, err := GenerateOrReuse(client, testServiceMetadata, DefaultCertSettings, testSecretSettings, testOutputFiles(t))
+	assert.Error(t, err)
+	assert.Len(t, filterActions(client.Actions(), "create"), maxSecretAttempts)
+}
+
+func TestGenerateOrReuse_LabelsSecretWithOwner(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	secretSettings := testSecretSettings
+	secretSettings.Owner = "some-owner"
+
+	_, err := GenerateOrReuse(client, testServiceMetadata, DefaultCertSettings, secretSettings, testOutputFiles(t))
+	assert.NoError(t, err)
+
+	secret, _ := client.CoreV1().Secrets(testSecretSettings.Namespace).Get(context.TODO(), testSecretSettings.Name, metav1.GetOptions{})
+	assert.Equal(t, "some-owner", secret.Labels[webhook.OwnerLabel])
+}
+
+func TestDeleteOwnedSecrets(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "owned", Namespace: "some-namespace", Labels: map[string]string{webhook.OwnerLabel: "some-owner"}}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "other-owner", Namespace: "some-namespace", Labels: map[string]string{webhook.OwnerLabel: "other-owner"}}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "unowned", Namespace: "some-namespace"}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "other-namespace", Namespace: "other-namespace", Labels: map[string]string{webhook.OwnerLabel: "some-owner"}}},
+	)
+
+	assert.NoError(t, DeleteOwnedSecrets(client, "some-namespace", []string{"owned", "other-owner", "unowned", "other-namespace", "missing"}, "some-owner"))
+	assert.Empty(t, filterActions(client.Actions(), "list"), "secrets must not be listed")
+
+	secrets, _ := client.CoreV1().Secrets("").List(context.TODO(), metav1.ListOptions{})
+	var names []string
+	for _, secret := range secrets.Items {
+		names = append(names, secret.Name)
+	}
+	assert.ElementsMatch(t, []string{"other-owner", "unowned", "other-namespace"}, names)
+}
+
+func testOutputFiles(t *testing.T) CertOutputFiles {
+	dir := t.TempDir()
+	return CertOutputFiles{
+		CaCertOutputFile:  filepath.Join(dir, "ca.crt"),
+		CaKeyOutputFile:   filepath.Join(dir, "ca.key"),
+		TlsCertOutputFile: filepath.Join(dir, "tls.crt"),
+		TlsKeyOutputFile:  filepath.Join(dir, "tls.key"),
+	}
+}
+
+func filterActions(actions []k8stesting.Action, verbs ...string) []k8stesting.Action {
+	var filtered []k8stesting.Action
+	for _, action := range actions {
+		for _, verb := range verbs {
+			if action.GetVerb() == verb {
+				filtered = append(filtered, action)
+			}
+		}
+	}
+	return filtered
+}
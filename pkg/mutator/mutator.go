@@ -7,18 +7,36 @@ import (
 	"io/ioutil"
 	"k8s-pod-mutator-webhook/internal/admission_review"
 	"k8s-pod-mutator-webhook/internal/logger"
+	"k8s-pod-mutator-webhook/internal/metrics"
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"time"
 )
 
+// SelfLabel marks the webhook's own Pods, which are never mutated
+const SelfLabel = "k8s-pod-mutator.io/webhook"
+
+// DefaultProfile is the profile of mutators created without a profile, it is served on '/mutate'
+const DefaultProfile = "default"
+
 type MutationSettings struct {
-	PatchFile string
+	// Profile names the mutator, e.g. to serve it on '/mutate/<profile>'. Defaults to DefaultProfile.
+	Profile           string
+	PatchFile         string
+	RolloutPercentage int
+	RolloutSeed       string
 }
 
 type Mutator struct {
-	patch *Patch
+	// name identifies the patch in metrics, it is derived from the patch file
+	name    string
+	profile string
+	patch   *Patch
+	rollout *Rollout
 }
 
 func CreateMutator(settings MutationSettings) (*Mutator, error) {
@@ -26,6 +44,13 @@ func CreateMutator(settings MutationSettings) (*Mutator, error) {
 		"settings": fmt.Sprintf("%+v", settings),
 	}).Infoln("creating mutator")
 
+	name := strings.TrimSuffix(filepath.Base(settings.PatchFile), filepath.Ext(settings.PatchFile))
+	profile := settings.Profile
+	if profile == "" {
+		profile = DefaultProfile
+	}
+
+	loadStart := time.Now()
 	patchYaml, err := ioutil.ReadFile(settings.PatchFile)
 	if err != nil {
 		return nil, fmt.Errorf("could not read patch file: %v", err)
@@ -35,43 +60,93 @@ func CreateMutator(settings MutationSettings) (*Mutator, error) {
 	if err != nil {
 		return nil, err
 	}
+	metrics.PatchLoadDuration.WithLabelValues(name).Set(time.Since(loadStart).Seconds())
 
-	return &Mutator{patch}, nil
+	rollout, err := CreateRollout(settings.RolloutPercentage, settings.RolloutSeed)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Mutator{name, profile, patch, rollout}, nil
 }
 
+// Mutate patches the Pod of a Pod CREATE, all other requests (e.g. a DELETE, whose object is empty) are admitted as they are
 func (m *Mutator) Mutate(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	start := time.Now()
+
+	if !isPodCreate(request) {
+		logger.Logger.WithFields(logrus.Fields{
+			"profile":   m.profile,
+			"namespace": request.Namespace,
+			"name":      request.Name,
+			"operation": request.Operation,
+			"kind":      request.Kind.String(),
+		}).Infoln("mutation skipped, not a pod create")
+		m.observe(request.Namespace, metrics.OutcomeSkippedNotPodCreate, start)
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
 	var pod corev1.Pod
 	if err := json.Unmarshal(request.Object.Raw, &pod); err != nil {
 		logger.Logger.WithFields(logrus.Fields{
-			"error": err,
-			"type":  reflect.TypeOf(pod),
+			"profile": m.profile,
+			"error":   err,
+			"type":    reflect.TypeOf(pod),
 		}).Errorln("unmarshalling failed")
-		return admission_review.ErrorResponse(err)
+		m.observe(request.Namespace, metrics.OutcomeError, start)
+		return admission_review.ErrorResponse(admission_review.BadRequest(fmt.Errorf("could not decode pod: %v", err)))
 	}
 
 	podName := maybePodName(pod.ObjectMeta)
 	ensurePodNamespace(request, &pod)
 
 	logger.Logger.WithFields(logrus.Fields{
+		"profile":   m.profile,
 		"namespace": pod.Namespace,
 		"name":      podName,
 	}).Infoln("mutation requested")
 	logger.Logger.Tracef("Object.Raw: %v", string(request.Object.Raw))
 
-	if alreadyMutated(&pod) {
+	decision := m.decide(&pod)
+	if decision.rollout != nil {
 		logger.Logger.WithFields(logrus.Fields{
-			"namespace": podName,
-			"name":      pod.Namespace,
-			"reason":    "already mutated",
-		}).Infoln("mutation skipped")
+			"profile":    m.profile,
+			"namespace":  pod.Namespace,
+			"name":       podName,
+			"rolloutKey": decision.rollout.Key,
+			"bucket":     decision.rollout.Bucket,
+			"percentage": decision.rollout.Percentage,
+			"selected":   decision.rollout.Selected,
+		}).Infoln("rollout decided")
+	}
+
+	if decision.patch == nil {
+		entry := logger.Logger.WithFields(logrus.Fields{
+			"profile":   m.profile,
+			"namespace": pod.Namespace,
+			"name":      podName,
+			"reason":    decision.reason,
+		})
+		if decision.outcome == metrics.OutcomeSkippedOwnPod {
+			entry.Warnln("mutation skipped")
+		} else {
+			entry.Infoln("mutation skipped")
+		}
+		m.observe(pod.Namespace, decision.outcome, start)
 		return &admissionv1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
 
-	jsonPatch, err := m.patch.Apply(&pod)
+	jsonPatch, err := decision.patch.Apply(&pod)
 	if err != nil {
-		logger.Logger.Errorf("could not create json patch: %v", err)
+		logger.Logger.WithFields(logrus.Fields{
+			"profile": m.profile,
+			"error":   err,
+		}).Errorln("could not create json patch")
+		m.observe(pod.Namespace, metrics.OutcomeError, start)
 		return admission_review.ErrorResponse(err)
 	}
 
@@ -85,15 +160,82 @@ func (m *Mutator) Mutate(request *admissionv1.AdmissionRequest) *admissionv1.Adm
 	}
 
 	logger.Logger.WithFields(logrus.Fields{
+		"profile":   m.profile,
 		"namespace": pod.Namespace,
 		"name":      podName,
 	}).Infoln("mutation succeeded")
+	m.observe(pod.Namespace, decision.outcome, start)
 
 	return response
 }
 
-func alreadyMutated(pod *corev1.Pod) bool {
-	return pod.Annotations[statusAnnotation] == "true"
+// decision describes what the mutator does with a Pod
+type decision struct {
+	outcome string
+	reason  string
+	// patch is nil if the Pod is left as is
+	patch *Patch
+	// rollout is nil if the Pod is not decided by a rollout, e.g. because it has been mutated already
+	rollout *RolloutDecision
+}
+
+func (m *Mutator) decide(pod *corev1.Pod) decision {
+	if m.alreadyMutated(pod) {
+		return decision{outcome: metrics.OutcomeSkippedAlreadyMutated, reason: "already mutated"}
+	}
+	if isSelf(pod) {
+		return decision{outcome: metrics.OutcomeSkippedOwnPod, reason: "own pod"}
+	}
+	annotations := map[string]string{profileAnnotation(statusAnnotation, m.profile): "true"}
+	if m.rollout == nil {
+		// e.g. a Mutator that is not created by CreateMutator
+		return decision{outcome: metrics.OutcomeMutated, reason: "patch applies to all pods", patch: m.patch.withAnnotations(annotations)}
+	}
+
+	rolloutDecision := m.rollout.Decide(pod)
+	rolloutKey := profileAnnotation(rolloutAnnotation, m.profile)
+	if rolloutDecision.Selected {
+		annotations[rolloutKey] = rolloutDecision.annotationValue()
+		return decision{
+			outcome: metrics.OutcomeMutated,
+			reason:  "selected by rollout",
+			patch:   m.patch.withAnnotations(annotations),
+			rollout: &rolloutDecision,
+		}
+	}
+	// only record the decision, the pod is left as is otherwise
+	return decision{
+		outcome: metrics.OutcomeSkippedRollout,
+		reason:  "not selected by rollout",
+		patch:   annotationsOnlyPatch(map[string]string{rolloutKey: rolloutDecision.annotationValue()}),
+		rollout: &rolloutDecision,
+	}
+}
+
+func (m *Mutator) observe(namespace string, outcome string, start time.Time) {
+	metrics.Mutations.WithLabelValues(namespace, m.profile, m.name, outcome).Inc()
+	metrics.MutationDuration.WithLabelValues(namespace, m.profile, m.name, outcome).Observe(time.Since(start).Seconds())
+}
+
+// Profile returns the name the mutator is served under
+func (m Mutator) Profile() string {
+	return m.profile
+}
+
+// alreadyMutated is true if the Pod has been mutated by the mutator's profile, other profiles may mutate it as well
+func (m *Mutator) alreadyMutated(pod *corev1.Pod) bool {
+	return pod.Annotations[profileAnnotation(statusAnnotation, m.profile)] == "true"
+}
+
+// isPodCreate is true for the creation of a Pod, the only request the mutator patches
+func isPodCreate(request *admissionv1.AdmissionRequest) bool {
+	return request.Operation == admissionv1.Create && request.Kind.Group == "" && request.Kind.Kind == "Pod"
+}
+
+// isSelf guards against mutating the webhook's own Pods, in case its webhook configuration does not exclude them
+func isSelf(pod *corev1.Pod) bool {
+	_, ok := pod.Labels[SelfLabel]
+	return ok
 }
 
 func maybePodName(metadata metav1.ObjectMeta) string {
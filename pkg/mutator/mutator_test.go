@@ -3,9 +3,12 @@ package mutator
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"gomodules.xyz/jsonpatch/v3"
+	"k8s-pod-mutator-webhook/internal/metrics"
 	v1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"testing"
 )
@@ -313,6 +316,8 @@ spec:
 
 	for testNo, testCase := range testCases {
 		admissionRequest := v1.AdmissionRequest{
+			Kind:      podKind,
+			Operation: v1.Create,
 			Object: runtime.RawExtension{
 				Raw: []byte(testCase.pod),
 			},
@@ -381,6 +386,8 @@ spec:
 `))
 
 	admissionRequest1 := v1.AdmissionRequest{
+		Kind:      podKind,
+		Operation: v1.Create,
 		Object: runtime.RawExtension{
 			Raw: []byte(`
 {
@@ -406,6 +413,8 @@ spec:
 	assert.Equal(t, expected, unmarshalJsonPatch(admissionResponse1.Patch))
 
 	admissionRequest2 := v1.AdmissionRequest{
+		Kind:      podKind,
+		Operation: v1.Create,
 		Object: runtime.RawExtension{
 			Raw: []byte(`
 {
@@ -503,6 +512,8 @@ func TestMutator_MutateConsidersStatusAnnotationForEligibility(t *testing.T) {
 
 	for _, testCase := range testCases {
 		admissionRequest := v1.AdmissionRequest{
+			Kind:      podKind,
+			Operation: v1.Create,
 			Object: runtime.RawExtension{
 				Raw: []byte(testCase.pod),
 			},
@@ -531,6 +542,8 @@ metadata:
 
 func TestMutator_MutateSetsStatusAnnotationTrue(t *testing.T) {
 	admissionRequest := v1.AdmissionRequest{
+		Kind:      podKind,
+		Operation: v1.Create,
 		Object: runtime.RawExtension{
 			Raw: []byte(`
 {
@@ -586,6 +599,62 @@ metadata:
 	assert.Equal(t, expected, actual)
 }
 
+func TestMutator_MutateSkipsOwnPods(t *testing.T) {
+	mutator := &Mutator{
+		patch: createPatch(`
+metadata:
+  labels:
+    mutated: "true"
+`),
+	}
+
+	pod := `
+{
+  "apiVersion": "v1",
+  "kind": "Pod",
+  "metadata": {
+	"name": "k8s-pod-mutator-webhook-abcde",
+	"labels": {
+	  "k8s-pod-mutator.io/webhook": "true"
+	}
+  }
+}`
+	response := mutator.Mutate(&v1.AdmissionRequest{
+		Kind:      podKind,
+		Operation: v1.Create,
+		Object:    runtime.RawExtension{Raw: []byte(pod)},
+	})
+
+	assert.True(t, response.Allowed)
+	assert.Nil(t, response.Patch)
+}
+
+func TestMutator_MutateSkipsAllButPodCreates(t *testing.T) {
+	mutator := &Mutator{
+		patch: createPatch(`
+metadata:
+  labels:
+    mutated: "true"
+`),
+	}
+
+	testCases := []struct {
+		description string
+		request     v1.AdmissionRequest
+	}{
+		{"pod delete without object", v1.AdmissionRequest{Kind: podKind, Operation: v1.Delete, Name: "some-pod"}},
+		{"pod connect", v1.AdmissionRequest{Kind: podKind, Operation: v1.Connect, Object: runtime.RawExtension{Raw: []byte(`{"kind": "PodExecOptions"}`)}}},
+		{"other kind", v1.AdmissionRequest{Kind: metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, Operation: v1.Create, Object: runtime.RawExtension{Raw: []byte(`{"kind": "Deployment"}`)}}},
+	}
+
+	for _, testCase := range testCases {
+		response := mutator.Mutate(&testCase.request)
+		assert.True(t, response.Allowed, testCase.description)
+		assert.Nil(t, response.Patch, testCase.description)
+		assert.Nil(t, response.Result, testCase.description)
+	}
+}
+
 func unmarshalJsonPatch(patchBytes []byte) []jsonpatch.Operation {
 	var patch []jsonpatch.Operation
 	err := json.Unmarshal(patchBytes, &patch)
@@ -602,3 +671,73 @@ func createPatch(patchYaml string) *Patch {
 	}
 	return patch
 }
+
+func TestMutator_MutateRecordsOutcomes(t *testing.T) {
+	rollout, _ := CreateRollout(0, "")
+	mutator := &Mutator{
+		name:    "metrics-test",
+		profile: "some-profile",
+		patch: createPatch(`
+metadata:
+  labels:
+    added-label: test
+`),
+	}
+	notSelected := &Mutator{name: "metrics-test", profile: "some-profile", patch: mutator.patch, rollout: rollout}
+
+	mutate := func(mutator *Mutator, pod string) {
+		mutator.Mutate(&v1.AdmissionRequest{
+			Kind:      podKind,
+			Operation: v1.Create,
+			Namespace: "some-namespace",
+			Object:    runtime.RawExtension{Raw: []byte(pod)},
+		})
+	}
+	mutate(mutator, `{"metadata": {"name": "some-pod"}}`)
+	mutate(mutator, `{"metadata": {"name": "some-pod", "annotations": {"k8s-pod-mutator.io/mutated-some-profile": "true"}}}`)
+	mutate(mutator, `{"metadata": {"name": "some-pod", "labels": {"k8s-pod-mutator.io/webhook": "true"}}}`)
+	mutate(mutator, `not a pod`)
+	mutate(notSelected, `{"metadata": {"name": "some-pod", "generateName": "some-pod-"}}`)
+
+	for _, outcome := range []string{
+		metrics.OutcomeMutated,
+		metrics.OutcomeSkippedAlreadyMutated,
+		metrics.OutcomeSkippedOwnPod,
+		metrics.OutcomeError,
+		metrics.OutcomeSkippedRollout,
+	} {
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.Mutations.WithLabelValues("some-namespace", "some-profile", "metrics-test", outcome)), outcome)
+	}
+}
+
+func TestMutator_MutatesOncePerProfile(t *testing.T) {
+	patch := createPatch("metadata:\n  labels:\n    added-label: test\n")
+	rollout, _ := CreateRollout(0, "")
+	registry := NewRegistry(Mutator{patch: patch})
+	assert.NoError(t, registry.Add(Mutator{profile: "some-profile", patch: patch}))
+	assert.NoError(t, registry.Add(Mutator{profile: "other-profile", patch: patch, rollout: rollout}))
+	defaultMutator, _ := registry.Get(DefaultProfile)
+	someMutator, _ := registry.Get("some-profile")
+	otherMutator, _ := registry.Get("other-profile")
+
+	mutate := func(mutator Mutator, annotations string) string {
+		pod := `{"metadata": {"name": "some-pod", "annotations": {` + annotations + `}}}`
+		return string(mutator.Mutate(&v1.AdmissionRequest{Kind: podKind, Operation: v1.Create, Object: runtime.RawExtension{Raw: []byte(pod)}}).Patch)
+	}
+	mutatedByDefault := `"k8s-pod-mutator.io/mutated": "true"`
+	assert.Empty(t, mutate(defaultMutator, mutatedByDefault))
+
+	// mutated by the default profile only
+	somePatch := mutate(someMutator, mutatedByDefault)
+	assert.Contains(t, somePatch, "k8s-pod-mutator.io~1mutated-some-profile")
+	assert.Contains(t, somePatch, "added-label")
+
+	otherPatch := mutate(otherMutator, mutatedByDefault)
+	assert.Contains(t, otherPatch, "k8s-pod-mutator.io~1rollout-other-profile")
+	assert.NotContains(t, otherPatch, "added-label")
+
+	assert.Empty(t, mutate(someMutator, mutatedByDefault+`, "k8s-pod-mutator.io/mutated-some-profile": "true"`))
+}
+
+// podKind is the kind of the requests the API server sends for Pods
+var podKind = metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}
@@ -7,10 +7,12 @@ import (
 	"gomodules.xyz/jsonpatch/v3"
 	"k8s-pod-mutator-webhook/internal/logger"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/strategicpatch"
 	"sigs.k8s.io/yaml"
 )
 
+// statusAnnotation marks mutated Pods, see profileAnnotation
 const statusAnnotation = "k8s-pod-mutator.io/mutated"
 
 type Patch struct {
@@ -40,10 +42,10 @@ func CreatePatch(patchYaml []byte) (*Patch, error) {
 		return nil, err
 	}
 
+	// the status annotation is added per profile, see Mutator.decide
 	if len(patch.Annotations) == 0 {
 		patch.Annotations = make(map[string]string)
 	}
-	patch.Annotations[statusAnnotation] = "true"
 
 	return &Patch{
 		template:  patch,
@@ -51,6 +53,36 @@ func CreatePatch(patchYaml []byte) (*Patch, error) {
 	}, nil
 }
 
+// profileAnnotation returns the annotation key for profile, i.e. '<key>-<profile>', or key itself for DefaultProfile,
+// so that each profile mutates a Pod once, independently of the other profiles
+func profileAnnotation(key string, profile string) string {
+	if profile == "" || profile == DefaultProfile {
+		return key
+	}
+	return key + "-" + profile
+}
+
+func annotationsOnlyPatch(annotations map[string]string) *Patch {
+	return &Patch{
+		template: &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: annotations,
+			},
+		},
+	}
+}
+
+func (p *Patch) withAnnotations(annotations map[string]string) *Patch {
+	template := p.template.DeepCopy()
+	for key, value := range annotations {
+		template.Annotations[key] = value
+	}
+	return &Patch{
+		template:  template,
+		wildcards: p.wildcards,
+	}
+}
+
 func splitWildcards(patch *corev1.Pod) (*corev1.Pod, *Wildcards, error) {
 	logger.Logger.WithFields(logrus.Fields{
 		"patch": patch,
@@ -0,0 +1,167 @@
+package mutator
+
+import (
+	"encoding/json"
+	"fmt"
+	applypatch "github.com/evanphx/json-patch"
+	"k8s-pod-mutator-webhook/internal/admission_review"
+	"k8s-pod-mutator-webhook/internal/metrics"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sort"
+)
+
+// Preview describes how a Pod would be mutated, e.g. to debug a patch
+type Preview struct {
+	Profile string `json:"profile"`
+	Patch   string `json:"patch"`
+	// Outcome is the outcome of the mutation metrics, Reason explains it
+	Outcome string           `json:"outcome"`
+	Reason  string           `json:"reason"`
+	Rollout *RolloutDecision `json:"rollout,omitempty"`
+	// Matches lists the parts of the patch that apply to the Pod
+	Matches []PatchMatch `json:"matches"`
+	// JsonPatch is returned to the API server, Pod is the result of applying it
+	JsonPatch json.RawMessage `json:"jsonPatch"`
+	Pod       json.RawMessage `json:"pod"`
+}
+
+// PatchMatch is a part of the patch that applies to the Pod, e.g. a container or a label
+type PatchMatch struct {
+	Field  string `json:"field"`
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// Preview decides and applies the mutation of the Pod in request like Mutate, but without recording it in the metrics
+func (m *Mutator) Preview(request *admissionv1.AdmissionRequest) (*Preview, error) {
+	if !isPodCreate(request) {
+		return &Preview{
+			Profile:   m.profile,
+			Patch:     m.name,
+			Outcome:   metrics.OutcomeSkippedNotPodCreate,
+			Reason:    "not a pod create",
+			Matches:   []PatchMatch{},
+			JsonPatch: json.RawMessage("[]"),
+			Pod:       json.RawMessage(request.Object.Raw),
+		}, nil
+	}
+
+	var pod corev1.Pod
+	if err := json.Unmarshal(request.Object.Raw, &pod); err != nil {
+		return nil, admission_review.BadRequest(fmt.Errorf("could not decode pod: %v", err))
+	}
+	ensurePodNamespace(request, &pod)
+
+	podJson, err := json.Marshal(&pod)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal pod to json: %v", err)
+	}
+
+	decision := m.decide(&pod)
+	preview := &Preview{
+		Profile:   m.profile,
+		Patch:     m.name,
+		Outcome:   decision.outcome,
+		Reason:    decision.reason,
+		Rollout:   decision.rollout,
+		Matches:   []PatchMatch{},
+		JsonPatch: json.RawMessage("[]"),
+		Pod:       podJson,
+	}
+	if decision.patch == nil {
+		return preview, nil
+	}
+
+	jsonPatch, err := decision.patch.Apply(&pod)
+	if err != nil {
+		return nil, err
+	}
+	operations, err := applypatch.DecodePatch(jsonPatch)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode json patch: %v", err)
+	}
+	mutatedPod, err := operations.Apply(podJson)
+	if err != nil {
+		return nil, fmt.Errorf("could not apply json patch: %v", err)
+	}
+
+	preview.Matches = decision.patch.matches(&pod)
+	preview.JsonPatch = jsonPatch
+	preview.Pod = mutatedPod
+	return preview, nil
+}
+
+// matches lists the labels, annotations, init-containers, containers and volumes of the patch that apply to the Pod,
+// including those matched by wildcards
+func (p *Patch) matches(pod *corev1.Pod) []PatchMatch {
+	matches := []PatchMatch{}
+	matches = append(matches, mapMatches("metadata.labels", p.template.Labels, pod.Labels)...)
+	matches = append(matches, mapMatches("metadata.annotations", p.template.Annotations, pod.Annotations)...)
+	matches = append(matches, containerMatches("spec.initContainers", p.template.Spec.InitContainers, p.wildcards.initContainer, pod.Spec.InitContainers)...)
+	matches = append(matches, containerMatches("spec.containers", p.template.Spec.Containers, p.wildcards.container, pod.Spec.Containers)...)
+
+	var patchVolumes, podVolumes []string
+	for _, volume := range p.template.Spec.Volumes {
+		patchVolumes = append(patchVolumes, volume.Name)
+	}
+	for _, volume := range pod.Spec.Volumes {
+		podVolumes = append(podVolumes, volume.Name)
+	}
+	matches = append(matches, namedMatches("spec.volumes", "volume", patchVolumes, p.wildcards.volume != nil, podVolumes)...)
+	return matches
+}
+
+func mapMatches(field string, patchValues map[string]string, podValues map[string]string) []PatchMatch {
+	var keys []string
+	for key := range patchValues {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var matches []PatchMatch
+	for _, key := range keys {
+		reason := "added"
+		if podValue, ok := podValues[key]; ok {
+			reason = fmt.Sprintf("replaces %q", podValue)
+			if podValue == patchValues[key] {
+				reason = "already set"
+			}
+		}
+		matches = append(matches, PatchMatch{Field: field, Name: key, Reason: reason})
+	}
+	return matches
+}
+
+func containerMatches(field string, patchContainers []corev1.Container, wildcard *corev1.Container, podContainers []corev1.Container) []PatchMatch {
+	var patchNames, podNames []string
+	for _, container := range patchContainers {
+		patchNames = append(patchNames, container.Name)
+	}
+	for _, container := range podContainers {
+		podNames = append(podNames, container.Name)
+	}
+	return namedMatches(field, "container", patchNames, wildcard != nil, podNames)
+}
+
+func namedMatches(field string, kind string, patchNames []string, wildcard bool, podNames []string) []PatchMatch {
+	existing := map[string]bool{}
+	for _, name := range podNames {
+		existing[name] = true
+	}
+
+	var matches []PatchMatch
+	for _, name := range patchNames {
+		reason := fmt.Sprintf("added, the pod has no %v of this name", kind)
+		if existing[name] {
+			reason = fmt.Sprintf("merged into the existing %v", kind)
+		}
+		matches = append(matches, PatchMatch{Field: field, Name: name, Reason: reason})
+	}
+	if wildcard {
+		for _, name := range podNames {
+			matches = append(matches, PatchMatch{Field: field, Name: name, Reason: fmt.Sprintf("matched by wildcard '*', which applies to every %v of the pod", kind)})
+		}
+	}
+	return matches
+}
@@ -0,0 +1,142 @@
+package mutator
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"k8s-pod-mutator-webhook/internal/admission_review"
+	"k8s-pod-mutator-webhook/internal/metrics"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"testing"
+)
+
+func TestMutator_Preview(t *testing.T) {
+	mutator := &Mutator{
+		name:    "preview-test",
+		profile: "some-profile",
+		patch: createPatch(`
+metadata:
+  labels:
+    added-label: added
+    existing-label: replaced
+spec:
+  initContainers:
+  - name: init
+    image: busybox
+  containers:
+  - name: "*"
+    env:
+    - name: SOME_VAR
+      value: some-value
+  volumes:
+  - name: some-volume
+    emptyDir: {}
+`),
+	}
+	pod := `
+{
+  "metadata": {"name": "some-pod", "labels": {"existing-label": "existing"}},
+  "spec": {
+    "containers": [{"name": "app", "image": "alpine"}, {"name": "sidecar", "image": "alpine"}],
+    "volumes": [{"name": "some-volume", "emptyDir": {}}]
+  }
+}`
+
+	preview, err := mutator.Preview(&v1.AdmissionRequest{
+		Kind:      podKind,
+		Operation: v1.Create,
+		Namespace: "some-namespace",
+		Object:    runtime.RawExtension{Raw: []byte(pod)},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "some-profile", preview.Profile)
+	assert.Equal(t, "preview-test", preview.Patch)
+	assert.Equal(t, metrics.OutcomeMutated, preview.Outcome)
+	assert.Nil(t, preview.Rollout)
+	assert.Equal(t, []PatchMatch{
+		{Field: "metadata.labels", Name: "added-label", Reason: "added"},
+		{Field: "metadata.labels", Name: "existing-label", Reason: `replaces "existing"`},
+		{Field: "metadata.annotations", Name: "k8s-pod-mutator.io/mutated-some-profile", Reason: "added"},
+		{Field: "spec.initContainers", Name: "init", Reason: "added, the pod has no container of this name"},
+		{Field: "spec.containers", Name: "app", Reason: "matched by wildcard '*', which applies to every container of the pod"},
+		{Field: "spec.containers", Name: "sidecar", Reason: "matched by wildcard '*', which applies to every container of the pod"},
+		{Field: "spec.volumes", Name: "some-volume", Reason: "merged into the existing volume"},
+	}, preview.Matches)
+	assert.NotEqual(t, "[]", string(preview.JsonPatch))
+
+	var mutatedPod corev1.Pod
+	assert.NoError(t, json.Unmarshal(preview.Pod, &mutatedPod))
+	assert.Equal(t, "some-namespace", mutatedPod.Namespace)
+	assert.Equal(t, map[string]string{"added-label": "added", "existing-label": "replaced"}, mutatedPod.Labels)
+	assert.Equal(t, "true", mutatedPod.Annotations["k8s-pod-mutator.io/mutated-some-profile"])
+	if assert.Len(t, mutatedPod.Spec.InitContainers, 1) {
+		assert.Equal(t, "busybox", mutatedPod.Spec.InitContainers[0].Image)
+	}
+	if assert.Len(t, mutatedPod.Spec.Containers, 2) {
+		for _, container := range mutatedPod.Spec.Containers {
+			assert.Equal(t, []corev1.EnvVar{{Name: "SOME_VAR", Value: "some-value"}}, container.Env, container.Name)
+			assert.Equal(t, "alpine", container.Image, container.Name)
+		}
+	}
+	assert.Len(t, mutatedPod.Spec.Volumes, 1)
+
+	// previews are not counted as mutations
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.Mutations.WithLabelValues("some-namespace", "some-profile", "preview-test", metrics.OutcomeMutated)))
+}
+
+func TestMutator_PreviewSkips(t *testing.T) {
+	patch := createPatch("metadata:\n  labels:\n    added-label: added\n")
+	rollout, _ := CreateRollout(0, "")
+
+	testCases := []struct {
+		description     string
+		mutator         *Mutator
+		pod             string
+		expectedOutcome string
+		expectedMatches []PatchMatch
+	}{
+		{
+			description:     "already mutated",
+			mutator:         &Mutator{patch: patch},
+			pod:             `{"metadata": {"name": "some-pod", "annotations": {"k8s-pod-mutator.io/mutated": "true"}}}`,
+			expectedOutcome: metrics.OutcomeSkippedAlreadyMutated,
+			expectedMatches: []PatchMatch{},
+		},
+		{
+			description:     "own pod",
+			mutator:         &Mutator{patch: patch},
+			pod:             `{"metadata": {"name": "some-pod", "labels": {"k8s-pod-mutator.io/webhook": "true"}}}`,
+			expectedOutcome: metrics.OutcomeSkippedOwnPod,
+			expectedMatches: []PatchMatch{},
+		},
+		{
+			description:     "not selected by rollout",
+			mutator:         &Mutator{patch: patch, rollout: rollout},
+			pod:             `{"metadata": {"name": "some-pod", "namespace": "some-namespace"}}`,
+			expectedOutcome: metrics.OutcomeSkippedRollout,
+			expectedMatches: []PatchMatch{{Field: "metadata.annotations", Name: rolloutAnnotation, Reason: "added"}},
+		},
+	}
+
+	for _, testCase := range testCases {
+		preview, err := testCase.mutator.Preview(&v1.AdmissionRequest{Kind: podKind, Operation: v1.Create, Object: runtime.RawExtension{Raw: []byte(testCase.pod)}})
+		if assert.NoError(t, err, testCase.description) {
+			assert.Equal(t, testCase.expectedOutcome, preview.Outcome, testCase.description)
+			assert.Equal(t, testCase.expectedMatches, preview.Matches, testCase.description)
+
+			var mutatedPod corev1.Pod
+			assert.NoError(t, json.Unmarshal(preview.Pod, &mutatedPod), testCase.description)
+			assert.NotContains(t, mutatedPod.Labels, "added-label", testCase.description)
+		}
+	}
+}
+
+func TestMutator_PreviewRejectsInvalidPods(t *testing.T) {
+	mutator := &Mutator{patch: createPatch("metadata: {}\n")}
+
+	_, err := mutator.Preview(&v1.AdmissionRequest{Kind: podKind, Operation: v1.Create, Object: runtime.RawExtension{Raw: []byte(`not a pod`)}})
+	assert.True(t, admission_review.IsBadRequest(err))
+}
@@ -0,0 +1,55 @@
+package mutator
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sort"
+	"strings"
+)
+
+// Registry holds the Mutators of all profiles by their profile, one of them for DefaultProfile
+type Registry struct {
+	mutators map[string]Mutator
+}
+
+// NewRegistry creates a Registry with defaultMutator for DefaultProfile, further profiles are added with Add
+func NewRegistry(defaultMutator Mutator) *Registry {
+	defaultMutator.profile = DefaultProfile
+	return &Registry{
+		mutators: map[string]Mutator{DefaultProfile: defaultMutator},
+	}
+}
+
+// Add registers mutator for its profile, which must be a DNS label short enough for the annotations of the profile and must
+// not be registered yet
+func (r *Registry) Add(mutator Mutator) error {
+	if errs := validation.IsDNS1123Label(mutator.profile); len(errs) > 0 {
+		return fmt.Errorf("invalid profile %q: %v", mutator.profile, strings.Join(errs, ", "))
+	}
+	for _, key := range []string{statusAnnotation, rolloutAnnotation} {
+		if errs := validation.IsQualifiedName(profileAnnotation(key, mutator.profile)); len(errs) > 0 {
+			return fmt.Errorf("invalid profile %q: annotation %v", mutator.profile, strings.Join(errs, ", "))
+		}
+	}
+	if _, ok := r.mutators[mutator.profile]; ok {
+		return fmt.Errorf("duplicate profile %q", mutator.profile)
+	}
+	r.mutators[mutator.profile] = mutator
+	return nil
+}
+
+// Get returns the Mutator of profile, if it is registered
+func (r *Registry) Get(profile string) (Mutator, bool) {
+	mutator, ok := r.mutators[profile]
+	return mutator, ok
+}
+
+// Profiles returns the registered profiles in alphabetical order
+func (r *Registry) Profiles() []string {
+	var profiles []string
+	for profile := range r.mutators {
+		profiles = append(profiles, profile)
+	}
+	sort.Strings(profiles)
+	return profiles
+}
@@ -0,0 +1,50 @@
+package mutator
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	patch := createPatch("metadata:\n  labels:\n    some-label: some-value\n")
+	registry := NewRegistry(Mutator{name: "default-patch", patch: patch})
+
+	assert.NoError(t, registry.Add(Mutator{name: "some-patch", profile: "some-profile", patch: patch}))
+	assert.NoError(t, registry.Add(Mutator{name: "other-patch", profile: "other-profile", patch: patch}))
+	assert.Equal(t, []string{"default", "other-profile", "some-profile"}, registry.Profiles())
+
+	defaultMutator, ok := registry.Get(DefaultProfile)
+	assert.True(t, ok)
+	assert.Equal(t, "default-patch", defaultMutator.name)
+	assert.Equal(t, DefaultProfile, defaultMutator.Profile())
+
+	someMutator, ok := registry.Get("some-profile")
+	assert.True(t, ok)
+	assert.Equal(t, "some-patch", someMutator.name)
+
+	_, ok = registry.Get("unknown-profile")
+	assert.False(t, ok)
+}
+
+func TestRegistry_RejectsInvalidProfiles(t *testing.T) {
+	patch := createPatch("metadata:\n  labels:\n    some-label: some-value\n")
+	registry := NewRegistry(Mutator{patch: patch})
+	assert.NoError(t, registry.Add(Mutator{profile: "some-profile", patch: patch}))
+
+	testCases := []struct {
+		description string
+		profile     string
+	}{
+		{"empty profile", ""},
+		{"duplicate profile", "some-profile"},
+		{"duplicate default profile", DefaultProfile},
+		{"nested profile", "some/profile"},
+		{"upper case profile", "Some-Profile"},
+		{"profile too long for its annotations", strings.Repeat("a", 56)},
+	}
+
+	for _, testCase := range testCases {
+		assert.Error(t, registry.Add(Mutator{profile: testCase.profile, patch: patch}), testCase.description)
+	}
+}
@@ -0,0 +1,73 @@
+package mutator
+
+import (
+	"fmt"
+	"hash/fnv"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const rolloutAnnotation = "k8s-pod-mutator.io/rollout"
+
+const rolloutBuckets = 100
+
+type Rollout struct {
+	Percentage int
+	Seed       string
+}
+
+type RolloutDecision struct {
+	Key        string `json:"key"`
+	Bucket     int    `json:"bucket"`
+	Percentage int    `json:"percentage"`
+	Selected   bool   `json:"selected"`
+}
+
+// CreateRollout creates a Rollout of the percentage of workloads. At 100%, every Pod is selected, but the decision is
+// still recorded, so that the annotations of mutated Pods are the same at every percentage.
+func CreateRollout(percentage int, seed string) (*Rollout, error) {
+	if percentage < 0 || percentage > rolloutBuckets {
+		return nil, fmt.Errorf("rollout percentage must be between 0 and %v, got %v", rolloutBuckets, percentage)
+	}
+	return &Rollout{
+		Percentage: percentage,
+		Seed:       seed,
+	}, nil
+}
+
+func (r *Rollout) Decide(pod *corev1.Pod) RolloutDecision {
+	key := rolloutKey(pod)
+	bucket := rolloutBucket(r.Seed, key)
+	return RolloutDecision{
+		Key:        key,
+		Bucket:     bucket,
+		Percentage: r.Percentage,
+		Selected:   bucket < r.Percentage,
+	}
+}
+
+func (d RolloutDecision) annotationValue() string {
+	return fmt.Sprintf("bucket=%v,percentage=%v,selected=%v", d.Bucket, d.Percentage, d.Selected)
+}
+
+// rolloutKey returns a key that is identical for all replicas of a workload, so that they share the same decision
+func rolloutKey(pod *corev1.Pod) string {
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		return fmt.Sprintf("%v/%v/%v", pod.Namespace, owner.Kind, owner.Name)
+	}
+	if len(pod.OwnerReferences) > 0 {
+		return fmt.Sprintf("%v/%v/%v", pod.Namespace, pod.OwnerReferences[0].Kind, pod.OwnerReferences[0].Name)
+	}
+	if pod.GenerateName != "" {
+		return fmt.Sprintf("%v/%v", pod.Namespace, pod.GenerateName)
+	}
+	return fmt.Sprintf("%v/%v", pod.Namespace, pod.Name)
+}
+
+func rolloutBucket(seed string, key string) int {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(seed))
+	_, _ = hash.Write([]byte{0})
+	_, _ = hash.Write([]byte(key))
+	return int(hash.Sum32() % rolloutBuckets)
+}
@@ -0,0 +1,288 @@
+package mutator
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateRollout(t *testing.T) {
+	rollout, err := CreateRollout(100, "seed")
+	assert.NoError(t, err)
+	assert.Equal(t, &Rollout{Percentage: 100, Seed: "seed"}, rollout)
+
+	rollout, err = CreateRollout(10, "seed")
+	assert.NoError(t, err)
+	assert.Equal(t, &Rollout{Percentage: 10, Seed: "seed"}, rollout)
+
+	_, err = CreateRollout(-1, "seed")
+	assert.Error(t, err)
+
+	_, err = CreateRollout(101, "seed")
+	assert.Error(t, err)
+}
+
+func TestRollout_DecideIsDeterministicForFixedSeed(t *testing.T) {
+	rollout := &Rollout{Percentage: 50, Seed: "fixed-seed"}
+
+	decision := rollout.Decide(ownedPod("default", "my-app-7d9f8", "my-app-7d9f8-abcde"))
+	assert.Equal(t, RolloutDecision{Key: "default/ReplicaSet/my-app-7d9f8", Bucket: 23, Percentage: 50, Selected: true}, decision)
+
+	decision = rollout.Decide(ownedPod("default", "worker-59d8c", "worker-59d8c-fghij"))
+	assert.Equal(t, RolloutDecision{Key: "default/ReplicaSet/worker-59d8c", Bucket: 98, Percentage: 50, Selected: false}, decision)
+}
+
+func TestRollout_DecideIsIdenticalForAllReplicas(t *testing.T) {
+	rollout := &Rollout{Percentage: 50, Seed: "fixed-seed"}
+
+	expected := rollout.Decide(ownedPod("default", "my-app-7d9f8", "my-app-7d9f8-abcde"))
+	for _, podName := range []string{"my-app-7d9f8-fghij", "my-app-7d9f8-klmno", "my-app-7d9f8-pqrst"} {
+		assert.Equal(t, expected, rollout.Decide(ownedPod("default", "my-app-7d9f8", podName)))
+	}
+}
+
+func TestRollout_DecideSelectsRoughlyThePercentage(t *testing.T) {
+	for _, percentage := range []int{0, 10, 50, 90} {
+		rollout := &Rollout{Percentage: percentage, Seed: "fixed-seed"}
+
+		selected := 0
+		for i := 0; i < 10000; i++ {
+			if rollout.Decide(ownedPod("default", fmt.Sprintf("app-%v", i), "")).Selected {
+				selected++
+			}
+		}
+		assert.InDelta(t, percentage*100, selected, 300, "percentage: %v", percentage)
+	}
+}
+
+func TestRollout_DecideDependsOnSeed(t *testing.T) {
+	pods := make([]*corev1.Pod, 100)
+	for i := range pods {
+		pods[i] = ownedPod("default", fmt.Sprintf("app-%v", i), "")
+	}
+
+	differences := 0
+	for _, pod := range pods {
+		if (&Rollout{Percentage: 50, Seed: "seed-1"}).Decide(pod).Bucket != (&Rollout{Percentage: 50, Seed: "seed-2"}).Decide(pod).Bucket {
+			differences++
+		}
+	}
+	assert.Greater(t, differences, 50)
+}
+
+func TestRolloutKey(t *testing.T) {
+	testCases := []struct {
+		pod         *corev1.Pod
+		expectedKey string
+	}{
+		{
+			pod:         ownedPod("ns", "my-app-7d9f8", "my-app-7d9f8-abcde"),
+			expectedKey: "ns/ReplicaSet/my-app-7d9f8",
+		},
+		{
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:    "ns",
+					GenerateName: "my-job-",
+					OwnerReferences: []metav1.OwnerReference{
+						{Kind: "Job", Name: "my-job"},
+					},
+				},
+			},
+			expectedKey: "ns/Job/my-job",
+		},
+		{
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:    "ns",
+					GenerateName: "my-pod-",
+				},
+			},
+			expectedKey: "ns/my-pod-",
+		},
+		{
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "ns",
+					Name:      "my-pod",
+				},
+			},
+			expectedKey: "ns/my-pod",
+		},
+	}
+
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.expectedKey, rolloutKey(testCase.pod))
+	}
+}
+
+func TestMutator_MutateRecordsRolloutDecision(t *testing.T) {
+	testCases := []struct {
+		percentage        int
+		expectedJsonPatch string
+	}{
+		{
+			percentage: 0,
+			expectedJsonPatch: `
+[
+  {
+    "op": "add",
+    "path": "/metadata/annotations",
+    "value": {
+      "k8s-pod-mutator.io/rollout": "bucket=23,percentage=0,selected=false"
+    }
+  }
+]
+`,
+		},
+		{
+			percentage: 50,
+			expectedJsonPatch: `
+[
+  {
+    "op": "add",
+    "path": "/metadata/annotations",
+    "value": {
+      "k8s-pod-mutator.io/mutated": "true",
+      "k8s-pod-mutator.io/rollout": "bucket=23,percentage=50,selected=true"
+    }
+  },
+  {
+    "op": "add",
+    "path": "/metadata/labels",
+    "value": {
+      "added-label": "test"
+    }
+  }
+]
+`,
+		},
+		{
+			// every pod is selected, but the decision is recorded as well
+			percentage: 100,
+			expectedJsonPatch: `
+[
+  {
+    "op": "add",
+    "path": "/metadata/annotations",
+    "value": {
+      "k8s-pod-mutator.io/mutated": "true",
+      "k8s-pod-mutator.io/rollout": "bucket=23,percentage=100,selected=true"
+    }
+  },
+  {
+    "op": "add",
+    "path": "/metadata/labels",
+    "value": {
+      "added-label": "test"
+    }
+  }
+]
+`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		admissionRequest := v1.AdmissionRequest{
+			Kind:      podKind,
+			Operation: v1.Create,
+			Namespace: "default",
+			Object: runtime.RawExtension{
+				Raw: []byte(`
+{
+  "apiVersion": "v1",
+  "kind": "Pod",
+  "metadata": {
+	"generateName": "my-app-7d9f8-",
+	"ownerReferences": [
+	  {
+		"apiVersion": "apps/v1",
+		"kind": "ReplicaSet",
+		"name": "my-app-7d9f8",
+		"uid": "8d6a7c3e-5e8f-4a3b-9a3c-1f2e3d4c5b6a",
+		"controller": true
+	  }
+	]
+  },
+  "spec": {
+	"containers": [
+	  {
+		"name": "alpine",
+		"image": "alpine"
+	  }
+	]
+  }
+}`),
+			},
+		}
+		mutator := &Mutator{
+			patch: createPatch(`
+metadata:
+  labels:
+    added-label: test
+`,
+			),
+			rollout: &Rollout{Percentage: testCase.percentage, Seed: "fixed-seed"},
+		}
+
+		admissionResponse := mutator.Mutate(&admissionRequest)
+		assert.True(t, admissionResponse.Allowed)
+
+		expected := unmarshalJsonPatch([]byte(testCase.expectedJsonPatch))
+		actual := unmarshalJsonPatch(admissionResponse.Patch)
+		assert.ElementsMatch(t, expected, actual)
+	}
+}
+
+func ownedPod(namespace string, replicaSetName string, podName string) *corev1.Pod {
+	controller := true
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:    namespace,
+			Name:         podName,
+			GenerateName: replicaSetName + "-",
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: "apps/v1",
+					Kind:       "ReplicaSet",
+					Name:       replicaSetName,
+					Controller: &controller,
+				},
+			},
+		},
+	}
+}
+
+func TestCreateMutator_RolloutPerProfile(t *testing.T) {
+	patchFile := filepath.Join(t.TempDir(), "patch.yaml")
+	assert.NoError(t, ioutil.WriteFile(patchFile, []byte("metadata:\n  labels:\n    added-label: test\n"), 0600))
+
+	registry := NewRegistry(Mutator{patch: createPatch("metadata: {}\n")})
+	for profile, percentage := range map[string]int{"some-profile": 10, "other-profile": 90} {
+		profileMutator, err := CreateMutator(MutationSettings{Profile: profile, PatchFile: patchFile, RolloutPercentage: percentage, RolloutSeed: "fixed-seed"})
+		assert.NoError(t, err)
+		assert.NoError(t, registry.Add(*profileMutator))
+	}
+	someMutator, _ := registry.Get("some-profile")
+	otherMutator, _ := registry.Get("other-profile")
+
+	// bucket 23 is only selected by the higher percentage
+	pod, _ := json.Marshal(ownedPod("default", "my-app-7d9f8", "my-app-7d9f8-abcde"))
+	mutate := func(mutator Mutator) string {
+		return string(mutator.Mutate(&v1.AdmissionRequest{Kind: podKind, Operation: v1.Create, Object: runtime.RawExtension{Raw: pod}}).Patch)
+	}
+	somePatch := mutate(someMutator)
+	assert.Contains(t, somePatch, `"k8s-pod-mutator.io/rollout-some-profile":"bucket=23,percentage=10,selected=false"`)
+	assert.NotContains(t, somePatch, "added-label")
+
+	otherPatch := mutate(otherMutator)
+	assert.Contains(t, otherPatch, `"k8s-pod-mutator.io/rollout-other-profile":"bucket=23,percentage=90,selected=true"`)
+	assert.Contains(t, otherPatch, "added-label")
+}
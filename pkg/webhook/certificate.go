@@ -0,0 +1,110 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"k8s-pod-mutator-webhook/internal/logger"
+	"k8s-pod-mutator-webhook/internal/metrics"
+	"sync"
+	"time"
+)
+
+// certificateHolder serves the TLS certificate from certFile/keyFile and reloads it when the files change.
+// If the files cannot be parsed (e.g. while they are being replaced), the last good certificate is served.
+type certificateHolder struct {
+	certFile string
+	keyFile  string
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	notAfter    time.Time
+	certPem     []byte
+	keyPem      []byte
+}
+
+func (h *certificateHolder) load() error {
+	certPem, err := ioutil.ReadFile(h.certFile)
+	if err != nil {
+		return fmt.Errorf("could not read tls certificate: %v", err)
+	}
+	keyPem, err := ioutil.ReadFile(h.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not read tls key: %v", err)
+	}
+
+	h.mutex.RLock()
+	unchanged := bytes.Equal(certPem, h.certPem) && bytes.Equal(keyPem, h.keyPem)
+	h.mutex.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	logger.Logger.WithFields(logrus.Fields{
+		"certFile": h.certFile,
+		"keyFile":  h.keyFile,
+	}).Infoln("loading tls certificate")
+
+	certificate, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return fmt.Errorf("could not load tls certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("could not parse tls certificate: %v", err)
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.certificate = &certificate
+	h.notAfter = leaf.NotAfter
+	h.certPem = certPem
+	h.keyPem = keyPem
+	metrics.TlsCertExpiry.Set(float64(leaf.NotAfter.Unix()))
+
+	logger.Logger.WithFields(logrus.Fields{
+		"notAfter": leaf.NotAfter,
+	}).Infoln("loaded tls certificate")
+	return nil
+}
+
+func (h *certificateHolder) watch(interval time.Duration, stop <-chan struct{}) {
+	logger.Logger.WithFields(logrus.Fields{
+		"certFile": h.certFile,
+		"keyFile":  h.keyFile,
+		"interval": interval,
+	}).Debugln("watching tls certificate")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := h.load(); err != nil {
+				logger.Logger.WithFields(logrus.Fields{
+					"error": err,
+				}).Errorln("could not reload tls certificate, serving last good certificate")
+			}
+		}
+	}
+}
+
+func (h *certificateHolder) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if h.certificate == nil {
+		return nil, fmt.Errorf("no tls certificate loaded")
+	}
+	return h.certificate, nil
+}
+
+func (h *certificateHolder) getNotAfter() time.Time {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.notAfter
+}
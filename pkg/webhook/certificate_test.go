@@ -0,0 +1,112 @@
+package webhook
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertificateHolder_LoadsCertificate(t *testing.T) {
+	holder := testCertificateHolder(t)
+	notAfter := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeKeyPair(t, holder, "first", notAfter)
+
+	assert.NoError(t, holder.load())
+	assert.Equal(t, "first", servedCommonName(t, holder))
+	assert.Equal(t, notAfter, holder.getNotAfter().UTC())
+}
+
+func TestCertificateHolder_GetCertificateFailsWithoutCertificate(t *testing.T) {
+	holder := testCertificateHolder(t)
+
+	assert.Error(t, holder.load())
+	_, err := holder.getCertificate(&tls.ClientHelloInfo{})
+	assert.Error(t, err)
+}
+
+func TestCertificateHolder_ReloadsChangedCertificate(t *testing.T) {
+	holder := testCertificateHolder(t)
+	writeKeyPair(t, holder, "first", time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.NoError(t, holder.load())
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go holder.watch(10*time.Millisecond, stop)
+
+	secondNotAfter := time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeKeyPair(t, holder, "second", secondNotAfter)
+
+	assert.Eventually(t, func() bool {
+		return servedCommonName(t, holder) == "second"
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, secondNotAfter, holder.getNotAfter().UTC())
+}
+
+func TestCertificateHolder_KeepsLastGoodCertificateOnParseErrors(t *testing.T) {
+	holder := testCertificateHolder(t)
+	notAfter := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeKeyPair(t, holder, "first", notAfter)
+	assert.NoError(t, holder.load())
+
+	// e.g. a half-written file
+	assert.NoError(t, ioutil.WriteFile(holder.certFile, []byte("-----BEGIN CERTIFICATE-----\nMIIB"), 0640))
+	assert.Error(t, holder.load())
+	assert.Equal(t, "first", servedCommonName(t, holder))
+	assert.Equal(t, notAfter, holder.getNotAfter().UTC())
+
+	// key does not match cert
+	writeKeyPair(t, holder, "second", notAfter)
+	otherHolder := testCertificateHolder(t)
+	writeKeyPair(t, otherHolder, "other", notAfter)
+	otherKey, _ := ioutil.ReadFile(otherHolder.keyFile)
+	assert.NoError(t, ioutil.WriteFile(holder.keyFile, otherKey, 0640))
+	assert.Error(t, holder.load())
+	assert.Equal(t, "first", servedCommonName(t, holder))
+}
+
+func testCertificateHolder(t *testing.T) *certificateHolder {
+	dir := t.TempDir()
+	return &certificateHolder{
+		certFile: filepath.Join(dir, "tls.crt"),
+		keyFile:  filepath.Join(dir, "tls.key"),
+	}
+}
+
+func writeKeyPair(t *testing.T, holder *certificateHolder, commonName string, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    notAfter.AddDate(-1, 0, 0),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	certDer, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(holder.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}), 0640))
+	assert.NoError(t, ioutil.WriteFile(holder.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0640))
+}
+
+func servedCommonName(t *testing.T, holder *certificateHolder) string {
+	certificate, err := holder.getCertificate(&tls.ClientHelloInfo{})
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	assert.NoError(t, err)
+	return leaf.Subject.CommonName
+}
@@ -0,0 +1,85 @@
+package webhook
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"k8s-pod-mutator-webhook/internal/logger"
+	"net/http"
+)
+
+// loadClientCas reads the CA bundle that client certs are verified against
+func loadClientCas(clientCaFile string) (*x509.CertPool, error) {
+	clientCaBundle, err := ioutil.ReadFile(clientCaFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read client CA bundle: %v", err)
+	}
+	clientCas := x509.NewCertPool()
+	if !clientCas.AppendCertsFromPEM(clientCaBundle) {
+		return nil, fmt.Errorf("client CA bundle %q does not contain any PEM encoded certs", clientCaFile)
+	}
+	return clientCas, nil
+}
+
+// requireClientCert only passes requests with a client cert that has been verified during the TLS handshake and, if
+// allowedNames is not empty, whose common name or one of whose DNS or URI SANs is allowed. The handshake only verifies
+// client certs if given, so that e.g. the kubelet's probes do not need one.
+func requireClientCert(allowedNames []string, handler http.HandlerFunc) http.HandlerFunc {
+	allowed := map[string]bool{}
+	for _, name := range allowedNames {
+		allowed[name] = true
+	}
+
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 {
+			logger.Logger.WithFields(logrus.Fields{
+				"remoteAddr": request.RemoteAddr,
+			}).Warnln("rejecting request without verified client cert")
+			http.Error(responseWriter, "client cert required", http.StatusUnauthorized)
+			return
+		}
+
+		clientCert := request.TLS.VerifiedChains[0][0]
+		if len(allowed) > 0 && !isAllowedClient(clientCert, allowed) {
+			logger.Logger.WithFields(logrus.Fields{
+				"remoteAddr": request.RemoteAddr,
+				"subject":    clientCert.Subject.String(),
+				"dnsNames":   clientCert.DNSNames,
+			}).Warnln("rejecting request of client that is not allowed")
+			http.Error(responseWriter, "client not allowed", http.StatusForbidden)
+			return
+		}
+
+		handler(responseWriter, request)
+	}
+}
+
+func isAllowedClient(clientCert *x509.Certificate, allowed map[string]bool) bool {
+	if allowed[clientCert.Subject.CommonName] {
+		return true
+	}
+	for _, dnsName := range clientCert.DNSNames {
+		if allowed[dnsName] {
+			return true
+		}
+	}
+	for _, uri := range clientCert.URIs {
+		if allowed[uri.String()] {
+			return true
+		}
+	}
+	return false
+}
+
+// applyClientAuth makes the TLS handshake verify client certs against the client CA bundle
+func applyClientAuth(tlsConfig *tls.Config, clientCaFile string) error {
+	clientCas, err := loadClientCas(clientCaFile)
+	if err != nil {
+		return err
+	}
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	tlsConfig.ClientCAs = clientCas
+	return nil
+}
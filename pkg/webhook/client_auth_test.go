@@ -0,0 +1,136 @@
+package webhook
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_ClientCertVerification(t *testing.T) {
+	clientCa := newTestCa(t)
+	otherCa := newTestCa(t)
+	clientCaFile := filepath.Join(t.TempDir(), "client-ca.crt")
+	assert.NoError(t, ioutil.WriteFile(clientCaFile, clientCa.certPem, 0640))
+
+	server, err := CreateServer(ServerSettings{
+		Tls:                true,
+		ClientCaFile:       clientCaFile,
+		AllowedClientNames: []string{"kube-apiserver", "apiserver.example.org"},
+	}, testMutators(t))
+	assert.NoError(t, err)
+
+	tlsServer := httptest.NewUnstartedServer(server.httpServer.Handler)
+	tlsServer.TLS = server.httpServer.TLSConfig.Clone()
+	// the test server provides its own cert
+	tlsServer.TLS.GetCertificate = nil
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+
+	testCases := []struct {
+		description    string
+		clientCert     *tls.Certificate
+		path           string
+		expectedStatus int
+	}{
+		{"allowed common name", clientCa.issue(t, "kube-apiserver", nil), mutatePath, http.StatusOK},
+		{"allowed dns name", clientCa.issue(t, "some-client", []string{"apiserver.example.org"}), mutatePath, http.StatusOK},
+		{"name not allowed", clientCa.issue(t, "some-client", []string{"client.example.org"}), mutatePath, http.StatusForbidden},
+		{"no client cert", nil, mutatePath, http.StatusUnauthorized},
+		{"probes do not require a client cert", nil, livezPath, http.StatusOK},
+	}
+
+	baseTransport := tlsServer.Client().Transport.(*http.Transport)
+	for _, testCase := range testCases {
+		transport := baseTransport.Clone()
+		if testCase.clientCert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*testCase.clientCert}
+		}
+		client := &http.Client{Transport: transport}
+
+		response, err := client.Post(tlsServer.URL+testCase.path, "application/json", strings.NewReader(`{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview", "request": {"uid": "some-uid"}}`))
+		if assert.NoError(t, err, testCase.description) {
+			_ = response.Body.Close()
+			assert.Equal(t, testCase.expectedStatus, response.StatusCode, testCase.description)
+		}
+	}
+
+	// certs of other CAs fail the handshake
+	transport := baseTransport.Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{*otherCa.issue(t, "kube-apiserver", nil)}
+	client := &http.Client{Transport: transport}
+	_, err = client.Post(tlsServer.URL+mutatePath, "application/json", strings.NewReader(`{}`))
+	assert.Error(t, err)
+}
+
+func TestCreateServer_RejectsInvalidClientAuthSettings(t *testing.T) {
+	_, err := CreateServer(ServerSettings{Tls: true, ClientCaFile: filepath.Join(t.TempDir(), "missing.crt")}, testMutators(t))
+	assert.Error(t, err)
+
+	clientCaFile := filepath.Join(t.TempDir(), "client-ca.crt")
+	assert.NoError(t, ioutil.WriteFile(clientCaFile, newTestCa(t).certPem, 0640))
+	_, err = CreateServer(ServerSettings{Tls: false, ClientCaFile: clientCaFile}, testMutators(t))
+	assert.Error(t, err, "requires TLS")
+}
+
+type testCa struct {
+	cert    *x509.Certificate
+	certPem []byte
+	key     *ecdsa.PrivateKey
+}
+
+func newTestCa(t *testing.T) *testCa {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "some-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	certDer, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(certDer)
+	assert.NoError(t, err)
+
+	return &testCa{
+		cert:    cert,
+		certPem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}),
+		key:     key,
+	}
+}
+
+func (ca *testCa) issue(t *testing.T, commonName string, dnsNames []string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	certDer, err := x509.CreateCertificate(cryptorand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+
+	return &tls.Certificate{Certificate: [][]byte{certDer}, PrivateKey: key}
+}
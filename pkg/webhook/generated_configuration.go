@@ -0,0 +1,263 @@
+package webhook
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"k8s-pod-mutator-webhook/internal/admission_review"
+	"k8s-pod-mutator-webhook/internal/logger"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"strings"
+)
+
+const admissionregistrationApiVersion = "admissionregistration.k8s.io/v1"
+
+// GeneratedConfigurationSettings describe a MutatingWebhookConfiguration with a single webhook for Pods, as an
+// alternative to a template
+type GeneratedConfigurationSettings struct {
+	Name               string
+	WebhookName        string
+	ServiceName        string
+	ServiceNamespace   string
+	ServicePath        string
+	ServicePort        int32
+	Operations         []string
+	FailurePolicy      string
+	TimeoutSeconds     int32
+	ReinvocationPolicy string
+	// AdmissionReviewVersions are advertised in order of preference, the API server sends the first one it supports.
+	// Only v1 is advertised if empty.
+	AdmissionReviewVersions []string
+	// NamespaceSelector and ObjectSelector use the label selector syntax, e.g. "!control-plane,environment in (dev,test)"
+	NamespaceSelector string
+	ObjectSelector    string
+}
+
+var DefaultGeneratedConfigurationSettings = GeneratedConfigurationSettings{
+	Name:                    "k8s-pod-mutator-webhook",
+	WebhookName:             "webhook.k8s-pod-mutator.io",
+	ServicePath:             "/mutate",
+	ServicePort:             443,
+	Operations:              []string{string(admissionregistrationv1.Create)},
+	FailurePolicy:           string(admissionregistrationv1.Ignore),
+	TimeoutSeconds:          2,
+	ReinvocationPolicy:      string(admissionregistrationv1.NeverReinvocationPolicy),
+	AdmissionReviewVersions: []string{"v1", "v1beta1"},
+	NamespaceSelector:       "!control-plane",
+}
+
+var operations = []admissionregistrationv1.OperationType{
+	admissionregistrationv1.Create,
+	admissionregistrationv1.Update,
+	admissionregistrationv1.Delete,
+	admissionregistrationv1.Connect,
+	admissionregistrationv1.OperationAll,
+}
+
+var failurePolicies = []admissionregistrationv1.FailurePolicyType{
+	admissionregistrationv1.Ignore,
+	admissionregistrationv1.Fail,
+}
+
+var reinvocationPolicies = []admissionregistrationv1.ReinvocationPolicyType{
+	admissionregistrationv1.NeverReinvocationPolicy,
+	admissionregistrationv1.IfNeededReinvocationPolicy,
+}
+
+const (
+	// TemplateConfigurationSource reads the webhook configurations from a template, see ConfigurationFromTemplate
+	TemplateConfigurationSource = "template"
+	// FlagsConfigurationSource builds the webhook configuration from GeneratedConfigurationSettings, see ConfigurationFromSettings
+	FlagsConfigurationSource = "flags"
+)
+
+// ConfigurationSourceSettings select where the webhook configurations come from, so that the init-container and the
+// webhook (e.g. with self-registration) load them alike
+type ConfigurationSourceSettings struct {
+	// Source is TemplateConfigurationSource or FlagsConfigurationSource
+	Source    string
+	Template  string
+	Generated GeneratedConfigurationSettings
+}
+
+// LoadConfiguration reads the webhook configurations from the template or builds them from the settings, depending on
+// the source of settings
+func LoadConfiguration(settings ConfigurationSourceSettings) (*Configuration, error) {
+	switch settings.Source {
+	case TemplateConfigurationSource:
+		return ConfigurationFromTemplate(settings.Template)
+	case FlagsConfigurationSource:
+		return ConfigurationFromSettings(settings.Generated)
+	default:
+		return nil, fmt.Errorf("unknown webhook config source %q, expected %q or %q", settings.Source, TemplateConfigurationSource, FlagsConfigurationSource)
+	}
+}
+
+// ConfigurationFromSettings builds the webhook configuration from settings instead of a template
+func ConfigurationFromSettings(settings GeneratedConfigurationSettings) (*Configuration, error) {
+	logger.Logger.WithFields(logrus.Fields{
+		"settings": settings,
+	}).Infoln("creating k8s configuration from settings")
+
+	template, err := generateMutatingWebhookConfiguration(settings)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook configuration settings: %v", err)
+	}
+
+	configuration := &Configuration{
+		mutatingTemplates: []*admissionregistrationv1.MutatingWebhookConfiguration{template},
+	}
+
+	logger.Logger.Debugf("configuration: %+v", configuration)
+
+	return configuration, nil
+}
+
+func generateMutatingWebhookConfiguration(settings GeneratedConfigurationSettings) (*admissionregistrationv1.MutatingWebhookConfiguration, error) {
+	if errs := validation.IsDNS1123Subdomain(settings.Name); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid name %q: %v", settings.Name, strings.Join(errs, ", "))
+	}
+	if errs := validation.IsDNS1123Subdomain(settings.WebhookName); len(errs) > 0 || len(strings.Split(settings.WebhookName, ".")) < 3 {
+		return nil, fmt.Errorf("invalid webhook name %q: must be a fully qualified domain name with at least three segments", settings.WebhookName)
+	}
+	if errs := validation.IsDNS1035Label(settings.ServiceName); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid service name %q: %v", settings.ServiceName, strings.Join(errs, ", "))
+	}
+	if errs := validation.IsDNS1123Label(settings.ServiceNamespace); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid service namespace %q: %v", settings.ServiceNamespace, strings.Join(errs, ", "))
+	}
+	if !strings.HasPrefix(settings.ServicePath, "/") {
+		return nil, fmt.Errorf("invalid service path %q: must start with '/'", settings.ServicePath)
+	}
+	if errs := validation.IsValidPortNum(int(settings.ServicePort)); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid service port %v: %v", settings.ServicePort, strings.Join(errs, ", "))
+	}
+	if settings.TimeoutSeconds < 1 || settings.TimeoutSeconds > 30 {
+		return nil, fmt.Errorf("invalid timeout %vs: must be between 1 and 30 seconds", settings.TimeoutSeconds)
+	}
+
+	if len(settings.Operations) == 0 {
+		return nil, fmt.Errorf("no operations configured")
+	}
+	var webhookOperations []admissionregistrationv1.OperationType
+	for _, operation := range settings.Operations {
+		webhookOperation := admissionregistrationv1.OperationType(strings.ToUpper(operation))
+		if !containsOperation(operations, webhookOperation) {
+			return nil, fmt.Errorf("invalid operation %q, expected one of %v", operation, operations)
+		}
+		webhookOperations = append(webhookOperations, webhookOperation)
+	}
+
+	failurePolicy := admissionregistrationv1.FailurePolicyType(settings.FailurePolicy)
+	if !containsFailurePolicy(failurePolicies, failurePolicy) {
+		return nil, fmt.Errorf("invalid failure policy %q, expected one of %v", settings.FailurePolicy, failurePolicies)
+	}
+
+	reinvocationPolicy := admissionregistrationv1.ReinvocationPolicyType(settings.ReinvocationPolicy)
+	if !containsReinvocationPolicy(reinvocationPolicies, reinvocationPolicy) {
+		return nil, fmt.Errorf("invalid reinvocation policy %q, expected one of %v", settings.ReinvocationPolicy, reinvocationPolicies)
+	}
+
+	admissionReviewVersions := settings.AdmissionReviewVersions
+	if len(admissionReviewVersions) == 0 {
+		admissionReviewVersions = []string{"v1"}
+	}
+	for _, version := range admissionReviewVersions {
+		if !containsString(admission_review.SupportedVersions, version) {
+			return nil, fmt.Errorf("invalid admission review version %q, expected one of %v", version, admission_review.SupportedVersions)
+		}
+	}
+
+	namespaceSelector, err := metav1.ParseToLabelSelector(settings.NamespaceSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespace selector %q: %v", settings.NamespaceSelector, err)
+	}
+	objectSelector, err := metav1.ParseToLabelSelector(settings.ObjectSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object selector %q: %v", settings.ObjectSelector, err)
+	}
+
+	matchPolicy := admissionregistrationv1.Equivalent
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	timeoutSeconds := settings.TimeoutSeconds
+	servicePath := settings.ServicePath
+	servicePort := settings.ServicePort
+
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: admissionregistrationApiVersion,
+			Kind:       mutatingWebhookConfigurationKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: settings.Name,
+		},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{
+				Name:                    settings.WebhookName,
+				AdmissionReviewVersions: admissionReviewVersions,
+				ClientConfig: admissionregistrationv1.WebhookClientConfig{
+					Service: &admissionregistrationv1.ServiceReference{
+						Name:      settings.ServiceName,
+						Namespace: settings.ServiceNamespace,
+						Path:      &servicePath,
+						Port:      &servicePort,
+					},
+				},
+				Rules: []admissionregistrationv1.RuleWithOperations{
+					{
+						Operations: webhookOperations,
+						Rule: admissionregistrationv1.Rule{
+							APIGroups:   []string{""},
+							APIVersions: []string{"v1"},
+							Resources:   []string{"pods"},
+						},
+					},
+				},
+				MatchPolicy:        &matchPolicy,
+				SideEffects:        &sideEffects,
+				ReinvocationPolicy: &reinvocationPolicy,
+				FailurePolicy:      &failurePolicy,
+				TimeoutSeconds:     &timeoutSeconds,
+				NamespaceSelector:  namespaceSelector,
+				ObjectSelector:     objectSelector,
+			},
+		},
+	}, nil
+}
+
+func containsOperation(operations []admissionregistrationv1.OperationType, operation admissionregistrationv1.OperationType) bool {
+	for _, o := range operations {
+		if o == operation {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFailurePolicy(failurePolicies []admissionregistrationv1.FailurePolicyType, failurePolicy admissionregistrationv1.FailurePolicyType) bool {
+	for _, f := range failurePolicies {
+		if f == failurePolicy {
+			return true
+		}
+	}
+	return false
+}
+
+func containsReinvocationPolicy(reinvocationPolicies []admissionregistrationv1.ReinvocationPolicyType, reinvocationPolicy admissionregistrationv1.ReinvocationPolicyType) bool {
+	for _, r := range reinvocationPolicies {
+		if r == reinvocationPolicy {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
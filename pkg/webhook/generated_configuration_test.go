@@ -0,0 +1,100 @@
+package webhook
+
+import (
+	"github.com/stretchr/testify/assert"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func TestConfigurationFromSettings(t *testing.T) {
+	settings := testGeneratedConfigurationSettings()
+	settings.Operations = []string{"create", "UPDATE"}
+	settings.FailurePolicy = "Fail"
+	settings.TimeoutSeconds = 5
+	settings.ReinvocationPolicy = "IfNeeded"
+	settings.ObjectSelector = "app notin (some-app),inject=true"
+
+	configuration, err := ConfigurationFromSettings(settings)
+	assert.NoError(t, err)
+
+	serviceMetadata, err := configuration.GetServiceMetadata()
+	assert.NoError(t, err)
+	assert.Equal(t, ServiceMetadata{Name: "some-service", Namespace: "some-namespace"}, serviceMetadata)
+
+	assert.Len(t, configuration.mutatingTemplates, 1)
+	template := configuration.mutatingTemplates[0]
+	assert.Equal(t, metav1.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1", Kind: "MutatingWebhookConfiguration"}, template.TypeMeta)
+	assert.Equal(t, "some-configuration", template.Name)
+
+	assert.Len(t, template.Webhooks, 1)
+	webhook := template.Webhooks[0]
+	assert.Equal(t, "webhook.example.org", webhook.Name)
+	assert.Equal(t, "/mutate", *webhook.ClientConfig.Service.Path)
+	assert.Equal(t, int32(443), *webhook.ClientConfig.Service.Port)
+	assert.Equal(t, []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update}, webhook.Rules[0].Operations)
+	assert.Equal(t, []string{"pods"}, webhook.Rules[0].Resources)
+	assert.Equal(t, admissionregistrationv1.Fail, *webhook.FailurePolicy)
+	assert.Equal(t, int32(5), *webhook.TimeoutSeconds)
+	assert.Equal(t, admissionregistrationv1.IfNeededReinvocationPolicy, *webhook.ReinvocationPolicy)
+	assert.Equal(t, admissionregistrationv1.SideEffectClassNone, *webhook.SideEffects)
+	assert.Equal(t, []string{"v1", "v1beta1"}, webhook.AdmissionReviewVersions)
+	assert.Equal(t, "!control-plane", metav1.FormatLabelSelector(webhook.NamespaceSelector))
+	assert.Equal(t, "app notin (some-app),inject=true", metav1.FormatLabelSelector(webhook.ObjectSelector))
+}
+
+func TestConfigurationFromSettings_RejectsInvalidSettings(t *testing.T) {
+	testCases := []struct {
+		description string
+		modify      func(settings *GeneratedConfigurationSettings)
+	}{
+		{"missing name", func(s *GeneratedConfigurationSettings) { s.Name = "" }},
+		{"webhook name not fully qualified", func(s *GeneratedConfigurationSettings) { s.WebhookName = "webhook" }},
+		{"missing service name", func(s *GeneratedConfigurationSettings) { s.ServiceName = "" }},
+		{"invalid service namespace", func(s *GeneratedConfigurationSettings) { s.ServiceNamespace = "Some_Namespace" }},
+		{"relative service path", func(s *GeneratedConfigurationSettings) { s.ServicePath = "mutate" }},
+		{"invalid service port", func(s *GeneratedConfigurationSettings) { s.ServicePort = 0 }},
+		{"no operations", func(s *GeneratedConfigurationSettings) { s.Operations = nil }},
+		{"unknown operation", func(s *GeneratedConfigurationSettings) { s.Operations = []string{"PATCH"} }},
+		{"unknown admission review version", func(s *GeneratedConfigurationSettings) { s.AdmissionReviewVersions = []string{"v2"} }},
+		{"unknown failure policy", func(s *GeneratedConfigurationSettings) { s.FailurePolicy = "Retry" }},
+		{"timeout too short", func(s *GeneratedConfigurationSettings) { s.TimeoutSeconds = 0 }},
+		{"timeout too long", func(s *GeneratedConfigurationSettings) { s.TimeoutSeconds = 31 }},
+		{"unknown reinvocation policy", func(s *GeneratedConfigurationSettings) { s.ReinvocationPolicy = "Always" }},
+		{"invalid namespace selector", func(s *GeneratedConfigurationSettings) { s.NamespaceSelector = "a in b" }},
+		{"invalid object selector", func(s *GeneratedConfigurationSettings) { s.ObjectSelector = "=value" }},
+	}
+
+	for _, testCase := range testCases {
+		settings := testGeneratedConfigurationSettings()
+		testCase.modify(&settings)
+
+		_, err := ConfigurationFromSettings(settings)
+		assert.Error(t, err, testCase.description)
+	}
+}
+
+func testGeneratedConfigurationSettings() GeneratedConfigurationSettings {
+	settings := DefaultGeneratedConfigurationSettings
+	settings.Name = "some-configuration"
+	settings.WebhookName = "webhook.example.org"
+	settings.ServiceName = "some-service"
+	settings.ServiceNamespace = "some-namespace"
+	return settings
+}
+
+func TestLoadConfiguration(t *testing.T) {
+	configuration, err := LoadConfiguration(ConfigurationSourceSettings{
+		Source:    FlagsConfigurationSource,
+		Template:  "/does/not/exist.yaml",
+		Generated: testGeneratedConfigurationSettings(),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "some-configuration", configuration.mutatingTemplates[0].Name)
+
+	_, err = LoadConfiguration(ConfigurationSourceSettings{Source: TemplateConfigurationSource, Template: "/does/not/exist.yaml"})
+	assert.Error(t, err)
+
+	_, err = LoadConfiguration(ConfigurationSourceSettings{Source: "some-source"})
+	assert.EqualError(t, err, `unknown webhook config source "some-source", expected "template" or "flags"`)
+}
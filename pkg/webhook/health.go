@@ -0,0 +1,134 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"k8s-pod-mutator-webhook/internal/logger"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthCheck reports whether a subsystem of the webhook is healthy, Check returns an error if it is not
+type HealthCheck struct {
+	Name  string
+	Check func() error
+}
+
+// healthChecks are the checks of one health endpoint, further checks can be added at any time
+type healthChecks struct {
+	mutex  sync.RWMutex
+	checks []HealthCheck
+}
+
+type healthCheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthStatus struct {
+	Status string              `json:"status"`
+	Checks []healthCheckResult `json:"checks"`
+}
+
+const (
+	healthyStatus   = "ok"
+	unhealthyStatus = "failed"
+)
+
+func (h *healthChecks) add(check HealthCheck) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.checks = append(h.checks, check)
+}
+
+func (h *healthChecks) run() healthStatus {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	status := healthStatus{Status: healthyStatus, Checks: []healthCheckResult{}}
+	for _, check := range h.checks {
+		result := healthCheckResult{Name: check.Name, Status: healthyStatus}
+		if err := check.Check(); err != nil {
+			result.Status = unhealthyStatus
+			result.Error = err.Error()
+			status.Status = unhealthyStatus
+		}
+		status.Checks = append(status.Checks, result)
+	}
+	return status
+}
+
+// healthHandleFunc responds with 503 if any check fails, and with successStatusCode otherwise. With '?verbose', the
+// results of all checks are returned as JSON.
+func healthHandleFunc(checks *healthChecks, successStatusCode int) func(responseWriter http.ResponseWriter, request *http.Request) {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		status := checks.run()
+
+		statusCode := successStatusCode
+		if status.Status != healthyStatus {
+			statusCode = http.StatusServiceUnavailable
+
+			var failed []string
+			for _, result := range status.Checks {
+				if result.Status != healthyStatus {
+					failed = append(failed, fmt.Sprintf("%v: %v", result.Name, result.Error))
+				}
+			}
+			logger.Logger.WithFields(logrus.Fields{
+				"path":   request.URL.Path,
+				"failed": failed,
+			}).Debugln("health check failed")
+		}
+
+		if _, verbose := request.URL.Query()["verbose"]; verbose {
+			response, err := json.Marshal(status)
+			if err != nil {
+				http.Error(responseWriter, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+				return
+			}
+			// a 204 response cannot carry the body
+			if statusCode == http.StatusNoContent {
+				statusCode = http.StatusOK
+			}
+			responseWriter.Header().Set("Content-Type", "application/json")
+			responseWriter.WriteHeader(statusCode)
+			_, _ = responseWriter.Write(response)
+			return
+		}
+
+		if statusCode == http.StatusNoContent {
+			responseWriter.WriteHeader(statusCode)
+			return
+		}
+		responseWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		responseWriter.WriteHeader(statusCode)
+		if status.Status == healthyStatus {
+			_, _ = fmt.Fprintln(responseWriter, healthyStatus)
+			return
+		}
+		for _, result := range status.Checks {
+			if result.Status != healthyStatus {
+				_, _ = fmt.Fprintf(responseWriter, "%v failed: %v\n", result.Name, result.Error)
+			}
+		}
+	}
+}
+
+// tlsHealthCheck fails if no TLS cert is loaded or it has expired
+func tlsHealthCheck(certificate *certificateHolder, now func() time.Time) HealthCheck {
+	return HealthCheck{
+		Name: "tls",
+		Check: func() error {
+			if _, err := certificate.getCertificate(nil); err != nil {
+				return err
+			}
+			if notAfter := certificate.getNotAfter(); now().After(notAfter) {
+				return fmt.Errorf("tls certificate expired at %v", notAfter.Format(time.RFC3339))
+			}
+			return nil
+		},
+	}
+}
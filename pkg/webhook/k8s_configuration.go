@@ -1,21 +1,42 @@
 package webhook
 
 import (
-	"context"
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"gomodules.xyz/jsonpatch/v3"
+	"io"
 	"io/ioutil"
 	"k8s-pod-mutator-webhook/internal/logger"
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"sigs.k8s.io/yaml"
+	"k8s.io/apimachinery/pkg/types"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+	"net/url"
+	"sigs.k8s.io/yaml"
+	"strings"
 )
 
+const certManagerInjectCaFromAnnotation = "cert-manager.io/inject-ca-from"
+
+// FieldManager manages the fields of the webhook configurations that are applied from the template
+const FieldManager = "k8s-pod-mutator"
+
+const (
+	mutatingWebhookConfigurationKind   = "MutatingWebhookConfiguration"
+	validatingWebhookConfigurationKind = "ValidatingWebhookConfiguration"
+)
+
+// Configuration consists of all webhook configurations of the template. The webhook's own service is the one of the
+// first mutating webhook (or the first validating webhook, if there are no mutating webhooks).
 type Configuration struct {
-	template *admissionregistrationv1.MutatingWebhookConfiguration
+	mutatingTemplates   []*admissionregistrationv1.MutatingWebhookConfiguration
+	validatingTemplates []*admissionregistrationv1.ValidatingWebhookConfiguration
 }
 
 func ConfigurationFromTemplate(templateFile string) (*Configuration, error) {
@@ -23,116 +44,353 @@ func ConfigurationFromTemplate(templateFile string) (*Configuration, error) {
 		"templateFile": templateFile,
 	}).Infoln("creating k8s configuration from template")
 
-	template, err := readAsMutatingWebhookConfiguration(templateFile)
+	templateYamlBytes, err := ioutil.ReadFile(templateFile)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(template.Webhooks) != 1 {
-		logger.Logger.WithFields(logrus.Fields{
-			"reason":   "unexpected number of webhooks",
-			"expected": "1",
-			"actual":   fmt.Sprintf("%v", len(template.Webhooks)),
-		}).Fatalln("invalid webhook configuration")
+	configuration, err := parseTemplate(templateYamlBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook configuration template %q: %v", templateFile, err)
 	}
 
-	logger.Logger.Debugf("template: %+v", template)
+	logger.Logger.Debugf("configuration: %+v", configuration)
 
-	return &Configuration{template}, nil
+	return configuration, nil
 }
 
-func (c *Configuration) GetServiceMetadata() ServiceMetadata {
-	return ServiceMetadata{
-		Name:      c.template.Webhooks[0].ClientConfig.Service.Name,
-		Namespace: c.template.Webhooks[0].ClientConfig.Service.Namespace,
+// GetServiceMetadata returns where the webhook is reachable, either by its service or by its URL
+func (c *Configuration) GetServiceMetadata() (ServiceMetadata, error) {
+	clientConfigs := c.clientConfigs()
+	if len(clientConfigs) == 0 {
+		return ServiceMetadata{}, fmt.Errorf("no webhooks configured")
 	}
+	return serviceMetadataOf(*clientConfigs[0])
 }
 
-func (c *Configuration) ApplyInCluster(caBundle []byte) error {
-	logger.Logger.WithFields(logrus.Fields{
-		"name": c.template.Name,
-	}).Infoln("applying k8s configuration...")
+// InjectCaFromCertManager makes cert-manager's cainjector manage the caBundle, using the CA of the given Certificate ("<namespace>/<name>")
+func (c *Configuration) InjectCaFromCertManager(certificate string) {
+	for _, document := range c.documents() {
+		objectMeta := document.objectMeta
+		logger.Logger.WithFields(logrus.Fields{
+			"name":        objectMeta.Name,
+			"certificate": certificate,
+		}).Infoln("caBundle is injected by cert-manager")
 
-	c.template.Webhooks[0].ClientConfig.CABundle = caBundle
+		if objectMeta.Annotations == nil {
+			objectMeta.Annotations = make(map[string]string)
+		}
+		objectMeta.Annotations[certManagerInjectCaFromAnnotation] = certificate
+	}
+}
+
+// ApplyInCluster creates or updates all webhook configurations by server-side apply. The apply is not forced, so it fails
+// instead of taking over fields of the template that have been changed by other field managers, e.g. a namespaceSelector
+// extended by an operator, and reports these fields. Fields that are not in the template, e.g. webhooks added by others,
+// are kept. Other conflicts, e.g. of concurrent applies, are retried with backoff.
+// The webhooks that point at the webhook's own service are created with caBundle, so that a new configuration is never
+// live without it. Existing webhooks keep their caBundle in the apply, which is then set by patchCaBundle like in
+// PatchCaBundle, because an applied caBundle could overwrite a newer one of a concurrent rotation. If caBundle is nil,
+// the caBundle is managed externally (e.g. by cert-manager) and left untouched. These webhooks never receive the
+// webhook's own Pods, see excludeSelf.
+func (c *Configuration) ApplyInCluster(client kubernetes.Interface, caBundle []byte) error {
+	logger.Logger.Infoln("applying k8s configuration...")
 
-	client, err := createK8sClient()
+	serviceMetadata, err := c.GetServiceMetadata()
 	if err != nil {
 		return err
 	}
+	c.excludeSelf(serviceMetadata)
+	warnIfNamespacesNotExcluded(client, serviceMetadata)
 
-	logger.Logger.WithFields(logrus.Fields{
-		"name": c.template.Name,
-	}).Debugln("checking if k8s configuration exists...")
-	existingConfig, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.TODO(), c.template.Name, metav1.GetOptions{})
-	if err != nil {
-		if !errors.IsNotFound(err) {
-			return err
+	var existingDocument *document
+	for _, document := range c.documents() {
+		err := retry.OnError(retry.DefaultBackoff, isTransientConflict, func() error {
+			var err error
+			existingDocument, err = getDocument(client, document.kind, document.objectMeta.Name)
+			if errors.IsNotFound(err) {
+				existingDocument = nil
+			} else if err != nil {
+				return err
+			}
+			prepareApply(document, existingDocument, serviceMetadata, caBundle)
+			return applyDocument(client, document)
+		})
+		if conflicts := ownershipConflicts(err); len(conflicts) > 0 {
+			return fmt.Errorf("could not apply %v %q, fields of the template have been changed by others - change them in the template as well or revert them: %v",
+				document.kind, document.objectMeta.Name, strings.Join(conflicts, "; "))
+		}
+		if err != nil {
+			return fmt.Errorf("could not apply %v %q: %v", document.kind, document.objectMeta.Name, err)
 		}
-		if err := c.createConfig(client); err != nil {
-			return err
+		if caBundle == nil || existingDocument == nil {
+			continue
 		}
-	} else {
-		if err := c.updateConfig(existingConfig, client); err != nil {
-			return err
+		err = retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+			return patchCaBundle(client, document, serviceMetadata, caBundle)
+		})
+		if err != nil {
+			return fmt.Errorf("could not patch caBundle of %v %q: %v", document.kind, document.objectMeta.Name, err)
 		}
 	}
 
-	logger.Logger.WithFields(logrus.Fields{
-		"name": c.template.Name,
-	}).Infoln("successfully applied k8s configuration")
+	logger.Logger.Infoln("successfully applied k8s configuration")
 
 	return nil
 }
 
-func (c *Configuration) createConfig(client *kubernetes.Clientset) error {
-	logger.Logger.WithFields(logrus.Fields{
-		"name": c.template.Name,
-	}).Debugln("k8s configuration does not exist, creating...")
+// PatchCaBundle only sets the caBundle of the webhooks that point at the webhook's own service and leaves everything else
+// untouched. The webhook configurations must already exist, e.g. because they are managed by helm.
+func (c *Configuration) PatchCaBundle(client kubernetes.Interface, caBundle []byte) error {
+	if caBundle == nil {
+		logger.Logger.Infoln("caBundle is managed externally, not patching it")
+		return nil
+	}
+
+	logger.Logger.Infoln("patching caBundle...")
+
+	serviceMetadata, err := c.GetServiceMetadata()
+	if err != nil {
+		return err
+	}
+
+	for _, document := range c.documents() {
+		err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+			return patchCaBundle(client, document, serviceMetadata, caBundle)
+		})
+		if err != nil {
+			return fmt.Errorf("could not patch caBundle of %v %q: %v", document.kind, document.objectMeta.Name, err)
+		}
+	}
 
-	_, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Create(context.TODO(), c.template, metav1.CreateOptions{})
-	return err
+	logger.Logger.Infoln("successfully patched caBundle")
+
+	return nil
 }
 
-func (c *Configuration) updateConfig(existingConfig *admissionregistrationv1.MutatingWebhookConfiguration, client *kubernetes.Clientset) error {
-	logger.Logger.WithFields(logrus.Fields{
-		"name":            c.template.Name,
-		"resourceVersion": existingConfig.ResourceVersion,
-	}).Debugln("k8s configuration already exists, updating...")
+func (c *Configuration) injectCaBundle(caBundle []byte) error {
+	serviceMetadata, err := c.GetServiceMetadata()
+	if err != nil {
+		return err
+	}
 
-	c.template.ResourceVersion = existingConfig.ResourceVersion
+	for _, clientConfig := range c.clientConfigs() {
+		if pointsAt(*clientConfig, serviceMetadata) {
+			clientConfig.CABundle = caBundle
+		}
+	}
+	return nil
+}
+
+// prepareApply sets the caBundle of the webhooks that point at the service: the given caBundle for webhooks that do not
+// exist yet, the existing one otherwise, so that the apply neither removes nor overwrites it. The resourceVersion of the
+// existing configuration makes the apply fail with a conflict if it has been changed meanwhile, e.g. by a rotation.
+func prepareApply(document *document, existingDocument *document, serviceMetadata ServiceMetadata, caBundle []byte) {
+	existingCaBundles := map[string][]byte{}
+	document.objectMeta.ResourceVersion = ""
+	if existingDocument != nil {
+		for _, existingWebhook := range existingDocument.webhooks {
+			existingCaBundles[existingWebhook.name] = existingWebhook.clientConfig.CABundle
+		}
+		document.objectMeta.ResourceVersion = existingDocument.objectMeta.ResourceVersion
+	}
 
-	_, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Update(context.TODO(), c.template, metav1.UpdateOptions{})
-	return err
+	for _, webhook := range document.webhooks {
+		if !pointsAt(*webhook.clientConfig, serviceMetadata) {
+			continue
+		}
+		existingCaBundle, exists := existingCaBundles[webhook.name]
+		switch {
+		case caBundle == nil:
+			webhook.clientConfig.CABundle = nil
+		case exists:
+			webhook.clientConfig.CABundle = existingCaBundle
+		default:
+			webhook.clientConfig.CABundle = caBundle
+		}
+	}
 }
 
-func readAsMutatingWebhookConfiguration(templateFile string) (*admissionregistrationv1.MutatingWebhookConfiguration, error) {
+func applyDocument(client kubernetes.Interface, document *document) error {
 	logger.Logger.WithFields(logrus.Fields{
-		"templateFile": templateFile,
-	}).Tracef("reading template file...")
-	templateYamlBytes, err := ioutil.ReadFile(templateFile)
+		"kind":         document.kind,
+		"name":         document.objectMeta.Name,
+		"fieldManager": FieldManager,
+	}).Debugln("applying k8s configuration...")
+
+	data, err := json.Marshal(document.object)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return patchDocument(client, document.kind, document.objectMeta.Name, types.ApplyPatchType, data, metav1.PatchOptions{
+		FieldManager: FieldManager,
+	})
+}
 
-	template := &admissionregistrationv1.MutatingWebhookConfiguration{}
-	err = yaml.Unmarshal(templateYamlBytes, template)
-	if err != nil {
-		return nil, err
+// ownershipConflicts lists the fields a failed apply would have taken over from other field managers, together with
+// these managers, e.g. 'conflict with "kubectl-edit" using admissionregistration.k8s.io/v1: .webhooks[name="..."].namespaceSelector'
+func ownershipConflicts(err error) []string {
+	status, ok := err.(errors.APIStatus)
+	if !ok || !errors.IsConflict(err) || status.Status().Details == nil {
+		return nil
 	}
-	return template, err
+
+	var conflicts []string
+	for _, cause := range status.Status().Details.Causes {
+		if cause.Type == metav1.CauseTypeFieldManagerConflict {
+			conflicts = append(conflicts, fmt.Sprintf("%v: %v", cause.Message, cause.Field))
+		}
+	}
+	return conflicts
 }
 
-func createK8sClient() (*kubernetes.Clientset, error) {
-	logger.Logger.Tracef("creating k8s client...")
+// isTransientConflict is true for conflicts that may succeed on retry, i.e. all conflicts but those of field ownership
+func isTransientConflict(err error) bool {
+	return errors.IsConflict(err) && len(ownershipConflicts(err)) == 0
+}
 
-	config, err := rest.InClusterConfig()
+// patchCaBundle patches the caBundle of the existing webhooks that point at the service. The patch includes the
+// resourceVersion of the existing configuration, so that it fails with a conflict if the webhooks have been changed meanwhile.
+func patchCaBundle(client kubernetes.Interface, document *document, serviceMetadata ServiceMetadata, caBundle []byte) error {
+	ownWebhooks := map[string]bool{}
+	for _, webhook := range document.webhooks {
+		if pointsAt(*webhook.clientConfig, serviceMetadata) {
+			ownWebhooks[webhook.name] = true
+		}
+	}
+
+	existingDocument, err := getDocument(client, document.kind, document.objectMeta.Name)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	client, err := kubernetes.NewForConfig(config)
+	var operations []jsonpatch.Operation
+	for i, existingWebhook := range existingDocument.webhooks {
+		if ownWebhooks[existingWebhook.name] && !bytes.Equal(existingWebhook.clientConfig.CABundle, caBundle) {
+			operations = append(operations, jsonpatch.NewOperation("add", fmt.Sprintf("/webhooks/%d/clientConfig/caBundle", i), caBundle))
+		}
+	}
+	if len(operations) == 0 {
+		logger.Logger.WithFields(logrus.Fields{
+			"kind": document.kind,
+			"name": document.objectMeta.Name,
+		}).Debugln("caBundle is up to date")
+		return nil
+	}
+	operations = append(operations, jsonpatch.NewOperation("replace", "/metadata/resourceVersion", existingDocument.objectMeta.ResourceVersion))
+
+	logger.Logger.WithFields(logrus.Fields{
+		"kind":            document.kind,
+		"name":            document.objectMeta.Name,
+		"resourceVersion": existingDocument.objectMeta.ResourceVersion,
+		"webhooks":        len(operations) - 1,
+	}).Debugln("patching caBundle...")
+
+	data, err := json.Marshal(operations)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	return patchDocument(client, document.kind, document.objectMeta.Name, types.JSONPatchType, data, metav1.PatchOptions{
+		FieldManager: FieldManager,
+	})
+}
+
+// clientConfigs returns the clientConfigs of all webhooks, mutating webhooks first
+func (c *Configuration) clientConfigs() []*admissionregistrationv1.WebhookClientConfig {
+	var clientConfigs []*admissionregistrationv1.WebhookClientConfig
+	for _, document := range c.documents() {
+		for _, webhook := range document.webhooks {
+			clientConfigs = append(clientConfigs, webhook.clientConfig)
+		}
+	}
+	return clientConfigs
+}
+
+// documents returns all webhook configurations, mutating ones first
+func (c *Configuration) documents() []*document {
+	var documents []*document
+	for _, template := range c.mutatingTemplates {
+		documents = append(documents, mutatingDocument(template))
+	}
+	for _, template := range c.validatingTemplates {
+		documents = append(documents, validatingDocument(template))
+	}
+	return documents
+}
+
+func serviceMetadataOf(clientConfig admissionregistrationv1.WebhookClientConfig) (ServiceMetadata, error) {
+	switch {
+	case clientConfig.Service != nil:
+		return ServiceMetadata{
+			Name:      clientConfig.Service.Name,
+			Namespace: clientConfig.Service.Namespace,
+		}, nil
+	case clientConfig.URL != nil:
+		webhookUrl, err := url.Parse(*clientConfig.URL)
+		if err != nil {
+			return ServiceMetadata{}, fmt.Errorf("invalid clientConfig url: %v", err)
+		}
+		if webhookUrl.Hostname() == "" {
+			return ServiceMetadata{}, fmt.Errorf("invalid clientConfig url %q: missing host", *clientConfig.URL)
+		}
+		return ServiceMetadata{
+			Host: webhookUrl.Hostname(),
+		}, nil
+	default:
+		return ServiceMetadata{}, fmt.Errorf("invalid clientConfig: either service or url must be set")
+	}
+}
+
+func pointsAt(clientConfig admissionregistrationv1.WebhookClientConfig, serviceMetadata ServiceMetadata) bool {
+	clientServiceMetadata, err := serviceMetadataOf(clientConfig)
+	return err == nil && clientServiceMetadata == serviceMetadata
+}
+
+// parseTemplate parses a (multi-document) template of Mutating- and ValidatingWebhookConfigurations
+func parseTemplate(templateYamlBytes []byte) (*Configuration, error) {
+	configuration := &Configuration{}
+
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(templateYamlBytes)))
+	for {
+		document, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		typeMeta := metav1.TypeMeta{}
+		if err := yaml.Unmarshal(document, &typeMeta); err != nil {
+			return nil, err
+		}
+
+		logger.Logger.WithFields(logrus.Fields{
+			"kind": typeMeta.Kind,
+		}).Tracef("parsing template document...")
+		switch typeMeta.Kind {
+		case "":
+			// empty document, e.g. a conditional block of a helm chart
+			continue
+		case mutatingWebhookConfigurationKind:
+			template := &admissionregistrationv1.MutatingWebhookConfiguration{}
+			if err := yaml.Unmarshal(document, template); err != nil {
+				return nil, err
+			}
+			configuration.mutatingTemplates = append(configuration.mutatingTemplates, template)
+		case validatingWebhookConfigurationKind:
+			template := &admissionregistrationv1.ValidatingWebhookConfiguration{}
+			if err := yaml.Unmarshal(document, template); err != nil {
+				return nil, err
+			}
+			configuration.validatingTemplates = append(configuration.validatingTemplates, template)
+		default:
+			return nil, fmt.Errorf("unsupported kind %q, expected %q or %q", typeMeta.Kind, mutatingWebhookConfigurationKind, validatingWebhookConfigurationKind)
+		}
+	}
+
+	if len(configuration.clientConfigs()) == 0 {
+		return nil, fmt.Errorf("no webhooks configured")
 	}
-	return client, nil
+	return configuration, nil
 }
@@ -1,26 +1,660 @@
 package webhook
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
-	"sigs.k8s.io/yaml"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 )
 
 func TestConfiguration_GetServiceMetadata(t *testing.T) {
-	configuration := Configuration{
-		template: &admissionregistrationv1.MutatingWebhookConfiguration{},
-	}
-
-	_ = yaml.Unmarshal([]byte(mutatingWebhookConfiguration), configuration.template)
-	configuration.template.Webhooks[0].ClientConfig.Service = &admissionregistrationv1.ServiceReference{}
-	_ = yaml.Unmarshal([]byte(mutatingWebhookConfiguration), configuration.template)
+	configuration, err := parseTemplate([]byte(mutatingWebhookConfiguration))
+	assert.NoError(t, err)
 
-	metadata := configuration.GetServiceMetadata()
+	metadata, err := configuration.GetServiceMetadata()
+	assert.NoError(t, err)
 	assert.Equal(t, "RELEASE-NAME-k8s-pod-mutator-webhook", metadata.Name)
 	assert.Equal(t, "RELEASE-NAMESPACE", metadata.Namespace)
+	assert.Equal(t, "RELEASE-NAME-k8s-pod-mutator-webhook.RELEASE-NAMESPACE.svc", metadata.ServerName())
+}
+
+func TestConfiguration_GetServiceMetadataForClientConfigs(t *testing.T) {
+	testCases := []struct {
+		description      string
+		clientConfig     admissionregistrationv1.WebhookClientConfig
+		expectedMetadata ServiceMetadata
+		expectError      bool
+	}{
+		{
+			description: "service",
+			clientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{Name: "some-service", Namespace: "some-namespace"},
+			},
+			expectedMetadata: ServiceMetadata{Name: "some-service", Namespace: "some-namespace"},
+		},
+		{
+			description:      "url",
+			clientConfig:     admissionregistrationv1.WebhookClientConfig{URL: stringPtr("https://webhook.example.org:8443/mutate")},
+			expectedMetadata: ServiceMetadata{Host: "webhook.example.org"},
+		},
+		{
+			description:      "url with ip",
+			clientConfig:     admissionregistrationv1.WebhookClientConfig{URL: stringPtr("https://192.168.0.10:8443/mutate")},
+			expectedMetadata: ServiceMetadata{Host: "192.168.0.10"},
+		},
+		{
+			description:  "url without host",
+			clientConfig: admissionregistrationv1.WebhookClientConfig{URL: stringPtr("/mutate")},
+			expectError:  true,
+		},
+		{
+			description:  "invalid url",
+			clientConfig: admissionregistrationv1.WebhookClientConfig{URL: stringPtr("https://webhook example:8443")},
+			expectError:  true,
+		},
+		{
+			description:  "neither service nor url",
+			clientConfig: admissionregistrationv1.WebhookClientConfig{},
+			expectError:  true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		configuration := Configuration{
+			mutatingTemplates: []*admissionregistrationv1.MutatingWebhookConfiguration{{
+				Webhooks: []admissionregistrationv1.MutatingWebhook{{ClientConfig: testCase.clientConfig}},
+			}},
+		}
+
+		metadata, err := configuration.GetServiceMetadata()
+		if testCase.expectError {
+			assert.Error(t, err, testCase.description)
+			continue
+		}
+		assert.NoError(t, err, testCase.description)
+		assert.Equal(t, testCase.expectedMetadata, metadata, testCase.description)
+	}
+}
+
+func TestServiceMetadata_Hostnames(t *testing.T) {
+	service := ServiceMetadata{Name: "some-service", Namespace: "some-namespace"}
+	assert.Equal(t, []string{"some-service", "some-service.some-namespace", "some-service.some-namespace.svc", "some-service.some-namespace.svc.cluster.local"}, service.Hostnames("cluster.local"))
+	assert.Equal(t, []string{"some-service", "some-service.some-namespace", "some-service.some-namespace.svc"}, service.Hostnames(""))
+
+	url := ServiceMetadata{Host: "localhost"}
+	assert.Equal(t, []string{"localhost"}, url.Hostnames("cluster.local"))
+	assert.Equal(t, "localhost", url.ServerName())
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestConfiguration_InjectCaFromCertManager(t *testing.T) {
+	configuration, err := parseTemplate([]byte(multiDocumentWebhookConfiguration))
+	assert.NoError(t, err)
+
+	configuration.InjectCaFromCertManager("some-namespace/some-certificate")
+	for _, document := range configuration.documents() {
+		assert.Equal(t, "some-namespace/some-certificate", document.objectMeta.Annotations["cert-manager.io/inject-ca-from"], document.objectMeta.Name)
+	}
+}
+
+func TestParseTemplate_MultipleDocuments(t *testing.T) {
+	configuration, err := parseTemplate([]byte(multiDocumentWebhookConfiguration))
+	assert.NoError(t, err)
+
+	assert.Len(t, configuration.mutatingTemplates, 1)
+	assert.Len(t, configuration.mutatingTemplates[0].Webhooks, 2)
+	assert.Len(t, configuration.validatingTemplates, 1)
+	assert.Len(t, configuration.validatingTemplates[0].Webhooks, 2)
+	assert.Len(t, configuration.clientConfigs(), 4)
+
+	metadata, err := configuration.GetServiceMetadata()
+	assert.NoError(t, err)
+	assert.Equal(t, ServiceMetadata{Name: "some-service", Namespace: "some-namespace"}, metadata)
+}
+
+func TestParseTemplate_RejectsInvalidTemplates(t *testing.T) {
+	testCases := []struct {
+		description string
+		template    string
+	}{
+		{"empty", ""},
+		{"no webhooks", "apiVersion: admissionregistration.k8s.io/v1\nkind: MutatingWebhookConfiguration\nmetadata:\n  name: some-name\n"},
+		{"unsupported kind", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: some-name\n"},
+		{"invalid yaml", "kind: [MutatingWebhookConfiguration"},
+	}
+
+	for _, testCase := range testCases {
+		_, err := parseTemplate([]byte(testCase.template))
+		assert.Error(t, err, testCase.description)
+	}
+}
+
+func TestConfiguration_InjectCaBundle(t *testing.T) {
+	configuration, err := parseTemplate([]byte(multiDocumentWebhookConfiguration))
+	assert.NoError(t, err)
+
+	assert.NoError(t, configuration.injectCaBundle([]byte("some-ca-bundle")))
+	assert.Equal(t, []byte("some-ca-bundle"), configuration.mutatingTemplates[0].Webhooks[0].ClientConfig.CABundle)
+	assert.Equal(t, []byte("some-ca-bundle"), configuration.mutatingTemplates[0].Webhooks[1].ClientConfig.CABundle)
+	assert.Equal(t, []byte("some-ca-bundle"), configuration.validatingTemplates[0].Webhooks[0].ClientConfig.CABundle)
+	assert.Equal(t, []byte("other-ca-bundle"), configuration.validatingTemplates[0].Webhooks[1].ClientConfig.CABundle, "webhooks of other services keep their caBundle")
+}
+
+func TestConfiguration_ApplyInCluster(t *testing.T) {
+	configuration, _ := parseTemplate([]byte(multiDocumentWebhookConfiguration))
+	client := fake.NewSimpleClientset()
+	applied := recordApplyPatches(client)
+
+	assert.NoError(t, configuration.ApplyInCluster(client, []byte("some-ca-bundle")))
+
+	// new configurations are created with the caBundle of the own webhooks, so that they are never live without it
+	assert.Len(t, applied, 2)
+	mutating := &admissionregistrationv1.MutatingWebhookConfiguration{}
+	assert.NoError(t, json.Unmarshal(applied["some-mutating-configuration"], mutating))
+	assert.Equal(t, "MutatingWebhookConfiguration", mutating.Kind)
+	assert.Equal(t, []byte("some-ca-bundle"), mutating.Webhooks[0].ClientConfig.CABundle)
+	assert.Equal(t, []byte("some-ca-bundle"), mutating.Webhooks[1].ClientConfig.CABundle)
+
+	validating := &admissionregistrationv1.ValidatingWebhookConfiguration{}
+	assert.NoError(t, json.Unmarshal(applied["some-validating-configuration"], validating))
+	assert.Equal(t, "ValidatingWebhookConfiguration", validating.Kind)
+	assert.Equal(t, []byte("some-ca-bundle"), validating.Webhooks[0].ClientConfig.CABundle)
+	assert.Equal(t, []byte("other-ca-bundle"), validating.Webhooks[1].ClientConfig.CABundle)
+
+	for _, action := range client.Actions() {
+		if patchAction, ok := action.(k8stesting.PatchAction); ok {
+			assert.Equal(t, types.ApplyPatchType, patchAction.GetPatchType(), "caBundle of new configurations is not patched")
+		}
+	}
+}
+
+func TestConfiguration_ApplyInClusterPatchesCaBundleOfExistingConfiguration(t *testing.T) {
+	configuration, _ := parseTemplate([]byte(mutatingWebhookConfiguration))
+	client := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "RELEASE-NAME-k8s-pod-mutator-webhook", ResourceVersion: "1"},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{Name: "webhook.k8s-pod-mutator.io", ClientConfig: admissionregistrationv1.WebhookClientConfig{CABundle: []byte("old-ca-bundle")}},
+		},
+	})
+	applied := recordApplyPatches(client)
+	// e.g. a concurrent rotation
+	conflicts := failPatchesWithConflict(client, types.JSONPatchType, 1)
+
+	assert.NoError(t, configuration.ApplyInCluster(client, []byte("some-ca-bundle")))
+	assert.Len(t, applied, 1)
+	assert.Equal(t, 1, *conflicts)
+
+	// the existing caBundle is kept by the apply and patched afterwards
+	applying := &admissionregistrationv1.MutatingWebhookConfiguration{}
+	assert.NoError(t, json.Unmarshal(applied["RELEASE-NAME-k8s-pod-mutator-webhook"], applying))
+	assert.Equal(t, []byte("old-ca-bundle"), applying.Webhooks[0].ClientConfig.CABundle)
+	assert.Equal(t, "1", applying.ResourceVersion)
+
+	mutating, _ := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.TODO(), "RELEASE-NAME-k8s-pod-mutator-webhook", metav1.GetOptions{})
+	assert.Equal(t, []byte("some-ca-bundle"), mutating.Webhooks[0].ClientConfig.CABundle)
+}
+
+func TestConfiguration_ApplyInClusterLeavesExternallyManagedCaBundle(t *testing.T) {
+	configuration, _ := parseTemplate([]byte(multiDocumentWebhookConfiguration))
+	client := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "some-mutating-configuration"},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{Name: "fail-open.k8s-pod-mutator.io", ClientConfig: admissionregistrationv1.WebhookClientConfig{CABundle: []byte("injected")}},
+		},
+	})
+	applied := recordApplyPatches(client)
+
+	assert.NoError(t, configuration.ApplyInCluster(client, nil))
+
+	mutating := &admissionregistrationv1.MutatingWebhookConfiguration{}
+	assert.NoError(t, json.Unmarshal(applied["some-mutating-configuration"], mutating))
+	assert.Nil(t, mutating.Webhooks[0].ClientConfig.CABundle)
+	assert.Nil(t, mutating.Webhooks[1].ClientConfig.CABundle)
+	for _, action := range client.Actions() {
+		if patchAction, ok := action.(k8stesting.PatchAction); ok {
+			assert.Equal(t, types.ApplyPatchType, patchAction.GetPatchType(), "caBundle is not patched")
+		}
+	}
+}
+
+func TestConfiguration_ApplyInClusterRetriesConflicts(t *testing.T) {
+	configuration, _ := parseTemplate([]byte(multiDocumentWebhookConfiguration))
+	client := fake.NewSimpleClientset()
+	applied := recordApplyPatches(client)
+	// e.g. a concurrent apply by another replica
+	conflicts := failPatchesWithConflict(client, types.ApplyPatchType, 1)
+
+	assert.NoError(t, configuration.ApplyInCluster(client, []byte("some-ca-bundle")))
+	assert.Equal(t, 1, *conflicts)
+	assert.Len(t, applied, 2)
+}
+
+func TestConfiguration_ApplyInClusterKeepsFieldsOfOthers(t *testing.T) {
+	configuration, _ := parseTemplate([]byte(mutatingWebhookConfiguration))
+	apiServer, client := applyingApiServer(t)
+	assert.NoError(t, configuration.ApplyInCluster(client, nil))
+
+	// e.g. an operator adds a label that is not in the template
+	labelField := fieldPath("metadata", "labels", "team")
+	apiServer.update("kubectl-edit", labelField, "some-team")
+
+	assert.NoError(t, configuration.ApplyInCluster(client, nil))
+	assert.Equal(t, "some-team", apiServer.values[labelField])
+	assert.Equal(t, []string{"kubectl-edit"}, apiServer.managers[labelField])
+}
+
+func TestConfiguration_ApplyInClusterReportsFieldsChangedByOthers(t *testing.T) {
+	configuration, _ := parseTemplate([]byte(mutatingWebhookConfiguration))
+	apiServer, client := applyingApiServer(t)
+	assert.NoError(t, configuration.ApplyInCluster(client, nil))
+
+	// e.g. an operator extends the namespaceSelector
+	selectorField := fieldPath("webhooks", `[name="webhook.k8s-pod-mutator.io"]`, "namespaceSelector")
+	operatorSelector := map[string]interface{}{"matchLabels": map[string]interface{}{"added-by": "operator"}}
+	apiServer.update("kubectl-edit", selectorField, operatorSelector)
+	apiServer.applies = 0
+
+	err := configuration.ApplyInCluster(client, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "change them in the template as well or revert them")
+		assert.Contains(t, err.Error(), `conflict with "kubectl-edit": .webhooks[name="webhook.k8s-pod-mutator.io"].namespaceSelector`)
+	}
+	assert.Equal(t, 1, apiServer.applies, "conflicts of field ownership are not retried")
+	assert.Equal(t, operatorSelector, apiServer.values[selectorField])
+	assert.Equal(t, []string{"kubectl-edit"}, apiServer.managers[selectorField])
+}
+
+func TestConfiguration_PatchCaBundle(t *testing.T) {
+	configuration, _ := parseTemplate([]byte(multiDocumentWebhookConfiguration))
+	// managed by someone else, e.g. helm, with fields added by others and in a different order
+	client := fake.NewSimpleClientset(
+		&admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "some-mutating-configuration", ResourceVersion: "1"},
+			Webhooks: []admissionregistrationv1.MutatingWebhook{
+				{Name: "fail-open.k8s-pod-mutator.io", NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"added-by": "operator"}}},
+				{Name: "fail-closed.k8s-pod-mutator.io", ClientConfig: admissionregistrationv1.WebhookClientConfig{CABundle: []byte("old-ca-bundle")}},
+			},
+		},
+		&admissionregistrationv1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "some-validating-configuration", ResourceVersion: "1"},
+			Webhooks: []admissionregistrationv1.ValidatingWebhook{
+				{Name: "other.example.org", ClientConfig: admissionregistrationv1.WebhookClientConfig{CABundle: []byte("other-ca-bundle")}},
+				{Name: "validate.k8s-pod-mutator.io"},
+			},
+		},
+	)
+
+	assert.NoError(t, configuration.PatchCaBundle(client, []byte("some-ca-bundle")))
+
+	mutating, _ := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.TODO(), "some-mutating-configuration", metav1.GetOptions{})
+	assert.Equal(t, []byte("some-ca-bundle"), mutating.Webhooks[0].ClientConfig.CABundle)
+	assert.Equal(t, map[string]string{"added-by": "operator"}, mutating.Webhooks[0].NamespaceSelector.MatchLabels)
+	assert.Equal(t, []byte("some-ca-bundle"), mutating.Webhooks[1].ClientConfig.CABundle)
+	assert.Nil(t, mutating.Webhooks[1].NamespaceSelector)
+
+	validating, _ := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(context.TODO(), "some-validating-configuration", metav1.GetOptions{})
+	assert.Equal(t, []byte("other-ca-bundle"), validating.Webhooks[0].ClientConfig.CABundle)
+	assert.Equal(t, []byte("some-ca-bundle"), validating.Webhooks[1].ClientConfig.CABundle)
+
+	// no patches once the caBundle is up to date
+	client.ClearActions()
+	assert.NoError(t, configuration.PatchCaBundle(client, []byte("some-ca-bundle")))
+	for _, action := range client.Actions() {
+		assert.Equal(t, "get", action.GetVerb())
+	}
+}
+
+func TestConfiguration_PatchCaBundleRetriesConflicts(t *testing.T) {
+	configuration, _ := parseTemplate([]byte(mutatingWebhookConfiguration))
+	client := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "RELEASE-NAME-k8s-pod-mutator-webhook", ResourceVersion: "1"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "webhook.k8s-pod-mutator.io"}},
+	})
+	conflicts := failPatchesWithConflict(client, types.JSONPatchType, 1)
+
+	assert.NoError(t, configuration.PatchCaBundle(client, []byte("some-ca-bundle")))
+	assert.Equal(t, 1, *conflicts)
+
+	mutating, _ := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.TODO(), "RELEASE-NAME-k8s-pod-mutator-webhook", metav1.GetOptions{})
+	assert.Equal(t, []byte("some-ca-bundle"), mutating.Webhooks[0].ClientConfig.CABundle)
+
+	var patch []map[string]interface{}
+	for _, action := range client.Actions() {
+		if patchAction, ok := action.(k8stesting.PatchAction); ok {
+			assert.Equal(t, types.JSONPatchType, patchAction.GetPatchType())
+			assert.NoError(t, json.Unmarshal(patchAction.GetPatch(), &patch))
+		}
+	}
+	assert.Contains(t, patch, map[string]interface{}{"op": "replace", "path": "/metadata/resourceVersion", "value": "1"}, "resourceVersion is a precondition of the patch")
 }
 
+func TestConfiguration_PatchCaBundleFailsForMissingConfiguration(t *testing.T) {
+	configuration, _ := parseTemplate([]byte(mutatingWebhookConfiguration))
+	client := fake.NewSimpleClientset()
+
+	assert.Error(t, configuration.PatchCaBundle(client, []byte("some-ca-bundle")))
+	assert.NoError(t, configuration.PatchCaBundle(client, nil), "externally managed caBundle is not patched")
+}
+
+// recordApplyPatches records the server-side apply patches by name, which are not supported by the fake clientset.
+// Missing configurations are created from the patch, existing ones are left as they are.
+func recordApplyPatches(client *fake.Clientset) map[string][]byte {
+	applied := map[string][]byte{}
+	client.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patchAction := action.(k8stesting.PatchAction)
+		if patchAction.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+		applied[patchAction.GetName()] = patchAction.GetPatch()
+
+		var object runtime.Object
+		switch action.GetResource().Resource {
+		case "mutatingwebhookconfigurations":
+			object = &admissionregistrationv1.MutatingWebhookConfiguration{}
+		default:
+			object = &admissionregistrationv1.ValidatingWebhookConfiguration{}
+		}
+		if err := json.Unmarshal(patchAction.GetPatch(), object); err != nil {
+			return true, nil, err
+		}
+		if err := client.Tracker().Create(action.GetResource(), object, ""); err != nil && !errors.IsAlreadyExists(err) {
+			return true, nil, err
+		}
+		return true, object, nil
+	})
+	return applied
+}
+
+// fakeApiServer emulates the server-side apply of MutatingWebhookConfigurations by an API server, which the fake
+// clientset does not support. It tracks the managers of each field: a field that has been changed by another manager
+// fails the apply with a conflict unless the apply sets the same value, fields that are not applied are kept.
+// Lists are keyed by name and selectors are atomic, like in the schema of the webhook configurations.
+type fakeApiServer struct {
+	// values and managers are keyed by fieldPath
+	values   map[string]interface{}
+	managers map[string][]string
+	applies  int
+}
+
+func applyingApiServer(t *testing.T) (*fakeApiServer, kubernetes.Interface) {
+	apiServer := &fakeApiServer{
+		values:   map[string]interface{}{},
+		managers: map[string][]string{},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(apiServer.serveHTTP))
+	t.Cleanup(server.Close)
+
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	assert.NoError(t, err)
+	return apiServer, client
+}
+
+// fieldPath joins the segments of a field, e.g. 'webhooks', '[name="some-webhook"]', 'namespaceSelector'
+func fieldPath(segments ...string) string {
+	return strings.Join(segments, "\x00")
+}
+
+// formatFieldPath formats a fieldPath like the API server, e.g. '.webhooks[name="some-webhook"].namespaceSelector'
+func formatFieldPath(path string) string {
+	formatted := ""
+	for _, segment := range strings.Split(path, "\x00") {
+		if !strings.HasPrefix(segment, "[") {
+			formatted += "."
+		}
+		formatted += segment
+	}
+	return formatted
+}
+
+func flattenFields(prefix []string, object map[string]interface{}, fields map[string]interface{}) {
+	for key, value := range object {
+		path := append(append([]string{}, prefix...), key)
+		switch typed := value.(type) {
+		case map[string]interface{}:
+			if key == "namespaceSelector" || key == "objectSelector" {
+				fields[fieldPath(path...)] = typed
+				continue
+			}
+			flattenFields(path, typed, fields)
+		case []interface{}:
+			if key != "webhooks" {
+				fields[fieldPath(path...)] = typed
+				continue
+			}
+			for _, item := range typed {
+				webhook := item.(map[string]interface{})
+				flattenFields(append(path, fmt.Sprintf("[name=%q]", webhook["name"])), webhook, fields)
+			}
+		default:
+			fields[fieldPath(path...)] = typed
+		}
+	}
+}
+
+func (s *fakeApiServer) object() map[string]interface{} {
+	object := map[string]interface{}{}
+	for path, value := range s.values {
+		parent := object
+		segments := strings.Split(path, "\x00")
+		for i, segment := range segments[:len(segments)-1] {
+			if strings.HasPrefix(segment, "[") {
+				continue
+			}
+			if strings.HasPrefix(segments[i+1], "[") {
+				parent = webhookItem(parent, segment, segments[i+1])
+				continue
+			}
+			if _, ok := parent[segment]; !ok {
+				parent[segment] = map[string]interface{}{}
+			}
+			parent = parent[segment].(map[string]interface{})
+		}
+		parent[segments[len(segments)-1]] = value
+	}
+	return object
+}
+
+func webhookItem(parent map[string]interface{}, key string, selector string) map[string]interface{} {
+	items, _ := parent[key].([]interface{})
+	for _, item := range items {
+		if fmt.Sprintf("[name=%q]", item.(map[string]interface{})["name"]) == selector {
+			return item.(map[string]interface{})
+		}
+	}
+	item := map[string]interface{}{}
+	parent[key] = append(items, item)
+	return item
+}
+
+// update changes a field by another manager, e.g. 'kubectl edit'
+func (s *fakeApiServer) update(manager string, path string, value interface{}) {
+	s.values[path] = value
+	s.managers[path] = []string{manager}
+}
+
+func (s *fakeApiServer) serveHTTP(writer http.ResponseWriter, request *http.Request) {
+	const prefix = "/apis/admissionregistration.k8s.io/v1/mutatingwebhookconfigurations/"
+	resource := admissionregistrationv1.Resource("mutatingwebhookconfigurations")
+	if !strings.HasPrefix(request.URL.Path, prefix) {
+		s.writeStatus(writer, errors.NewNotFound(resource, request.URL.Path))
+		return
+	}
+	name := strings.TrimPrefix(request.URL.Path, prefix)
+
+	switch {
+	case request.Method == http.MethodGet && len(s.values) == 0:
+		s.writeStatus(writer, errors.NewNotFound(resource, name))
+		return
+	case request.Method == http.MethodGet:
+		s.writeObject(writer, s.object())
+		return
+	case request.Method != http.MethodPatch || request.Header.Get("Content-Type") != string(types.ApplyPatchType):
+		s.writeStatus(writer, errors.NewBadRequest("only get and server-side apply are supported"))
+		return
+	}
+	if request.URL.Query().Get("force") == "true" {
+		s.writeStatus(writer, errors.NewBadRequest("the apply must not be forced"))
+		return
+	}
+	s.applies++
+
+	body, _ := ioutil.ReadAll(request.Body)
+	object := map[string]interface{}{}
+	if err := json.Unmarshal(body, &object); err != nil {
+		s.writeStatus(writer, errors.NewBadRequest(err.Error()))
+		return
+	}
+	applied := map[string]interface{}{}
+	flattenFields(nil, object, applied)
+
+	fieldManager := request.URL.Query().Get("fieldManager")
+	conflict := errors.NewConflict(resource, name, fmt.Errorf("apply failed"))
+	conflict.ErrStatus.Details.Causes = nil
+	for path, value := range applied {
+		existing, ok := s.values[path]
+		if !ok || reflect.DeepEqual(existing, value) {
+			continue
+		}
+		for _, manager := range s.managers[path] {
+			if manager != fieldManager {
+				conflict.ErrStatus.Details.Causes = append(conflict.ErrStatus.Details.Causes, metav1.StatusCause{
+					Type:    metav1.CauseTypeFieldManagerConflict,
+					Message: fmt.Sprintf("conflict with %q", manager),
+					Field:   formatFieldPath(path),
+				})
+			}
+		}
+	}
+	if len(conflict.ErrStatus.Details.Causes) > 0 {
+		s.writeStatus(writer, conflict)
+		return
+	}
+
+	// fields that are not applied anymore are only removed if no one else manages them
+	for path, managers := range s.managers {
+		if _, ok := applied[path]; ok {
+			continue
+		}
+		var others []string
+		for _, manager := range managers {
+			if manager != fieldManager {
+				others = append(others, manager)
+			}
+		}
+		s.managers[path] = others
+		if len(others) == 0 {
+			delete(s.values, path)
+			delete(s.managers, path)
+		}
+	}
+	for path, value := range applied {
+		if existing, ok := s.values[path]; ok && reflect.DeepEqual(existing, value) {
+			if !contains(s.managers[path], fieldManager) {
+				s.managers[path] = append(s.managers[path], fieldManager)
+			}
+			continue
+		}
+		s.values[path] = value
+		s.managers[path] = []string{fieldManager}
+	}
+	s.writeObject(writer, s.object())
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *fakeApiServer) writeObject(writer http.ResponseWriter, object map[string]interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(writer).Encode(object)
+}
+
+func (s *fakeApiServer) writeStatus(writer http.ResponseWriter, err errors.APIStatus) {
+	status := err.Status()
+	status.APIVersion = "v1"
+	status.Kind = "Status"
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(int(status.Code))
+	_ = json.NewEncoder(writer).Encode(status)
+}
+
+// failPatchesWithConflict fails the given number of patches of patchType with a conflict
+func failPatchesWithConflict(client *fake.Clientset, patchType types.PatchType, times int) *int {
+	conflicts := 0
+	client.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts >= times || action.(k8stesting.PatchAction).GetPatchType() != patchType {
+			return false, nil, nil
+		}
+		conflicts++
+		return true, nil, errors.NewConflict(action.GetResource().GroupResource(), action.(k8stesting.PatchAction).GetName(), fmt.Errorf("the object has been modified"))
+	})
+	return &conflicts
+}
+
+const multiDocumentWebhookConfiguration = `
+apiVersion: admissionregistration.k8s.io/v1
+kind: MutatingWebhookConfiguration
+metadata:
+  name: some-mutating-configuration
+webhooks:
+  - name: fail-closed.k8s-pod-mutator.io
+    clientConfig:
+      service:
+        name: some-service
+        namespace: some-namespace
+        path: "/mutate"
+    failurePolicy: Fail
+  - name: fail-open.k8s-pod-mutator.io
+    clientConfig:
+      service:
+        name: some-service
+        namespace: some-namespace
+        path: "/mutate"
+    failurePolicy: Ignore
+---
+# empty documents are skipped
+---
+apiVersion: admissionregistration.k8s.io/v1
+kind: ValidatingWebhookConfiguration
+metadata:
+  name: some-validating-configuration
+webhooks:
+  - name: validate.k8s-pod-mutator.io
+    clientConfig:
+      service:
+        name: some-service
+        namespace: some-namespace
+        path: "/validate"
+  - name: other.example.org
+    clientConfig:
+      url: https://other.example.org/validate
+      caBundle: b3RoZXItY2EtYnVuZGxl
+`
+
 const mutatingWebhookConfiguration = `
 apiVersion: admissionregistration.k8s.io/v1
 kind: MutatingWebhookConfiguration
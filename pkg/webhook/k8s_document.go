@@ -0,0 +1,83 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// document is a Mutating- or ValidatingWebhookConfiguration, so that both can be handled alike
+type document struct {
+	kind       string
+	object     interface{}
+	objectMeta *metav1.ObjectMeta
+	webhooks   []namedClientConfig
+}
+
+type namedClientConfig struct {
+	name              string
+	clientConfig      *admissionregistrationv1.WebhookClientConfig
+	namespaceSelector **metav1.LabelSelector
+	objectSelector    **metav1.LabelSelector
+}
+
+func mutatingDocument(configuration *admissionregistrationv1.MutatingWebhookConfiguration) *document {
+	document := &document{
+		kind:       mutatingWebhookConfigurationKind,
+		object:     configuration,
+		objectMeta: &configuration.ObjectMeta,
+	}
+	for i := range configuration.Webhooks {
+		webhook := &configuration.Webhooks[i]
+		document.webhooks = append(document.webhooks, namedClientConfig{webhook.Name, &webhook.ClientConfig, &webhook.NamespaceSelector, &webhook.ObjectSelector})
+	}
+	return document
+}
+
+func validatingDocument(configuration *admissionregistrationv1.ValidatingWebhookConfiguration) *document {
+	document := &document{
+		kind:       validatingWebhookConfigurationKind,
+		object:     configuration,
+		objectMeta: &configuration.ObjectMeta,
+	}
+	for i := range configuration.Webhooks {
+		webhook := &configuration.Webhooks[i]
+		document.webhooks = append(document.webhooks, namedClientConfig{webhook.Name, &webhook.ClientConfig, &webhook.NamespaceSelector, &webhook.ObjectSelector})
+	}
+	return document
+}
+
+func getDocument(client kubernetes.Interface, kind string, name string) (*document, error) {
+	switch kind {
+	case mutatingWebhookConfigurationKind:
+		configuration, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return mutatingDocument(configuration), nil
+	case validatingWebhookConfigurationKind:
+		configuration, err := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return validatingDocument(configuration), nil
+	default:
+		return nil, fmt.Errorf("unsupported kind %q", kind)
+	}
+}
+
+func patchDocument(client kubernetes.Interface, kind string, name string, patchType types.PatchType, data []byte, options metav1.PatchOptions) error {
+	var err error
+	switch kind {
+	case mutatingWebhookConfigurationKind:
+		_, err = client.AdmissionregistrationV1().MutatingWebhookConfigurations().Patch(context.TODO(), name, patchType, data, options)
+	case validatingWebhookConfigurationKind:
+		_, err = client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Patch(context.TODO(), name, patchType, data, options)
+	default:
+		err = fmt.Errorf("unsupported kind %q", kind)
+	}
+	return err
+}
@@ -0,0 +1,156 @@
+package webhook
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"k8s-pod-mutator-webhook/internal/admission_review"
+	"k8s-pod-mutator-webhook/internal/logger"
+	"k8s-pod-mutator-webhook/pkg/mutator"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// mutateHandleFunc answers AdmissionReviews with the response of the mutator of the profile in the path, in the version
+// of the request. Requests which are not a valid AdmissionReview are rejected with a 4xx status code, failures of the
+// mutator are reported in the AdmissionResponse.
+func mutateHandleFunc(mutators *mutator.Registry, maxBodyBytes int64) func(responseWriter http.ResponseWriter, request *http.Request) {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		profile := profileOf(request.URL.Path)
+		logger.Logger.WithFields(logrus.Fields{
+			"profile": profile,
+		}).Debugln("handling mutation request")
+
+		mutator, ok := mutators.Get(profile)
+		if !ok {
+			logger.Logger.WithFields(logrus.Fields{
+				"profile": profile,
+				"path":    request.URL.Path,
+			}).Errorln("unknown profile")
+			http.Error(responseWriter, fmt.Sprintf("unknown profile %q, expected one of %v", profile, mutators.Profiles()), http.StatusNotFound)
+			return
+		}
+
+		if request.Method != http.MethodPost {
+			logger.Logger.WithFields(logrus.Fields{
+				"method": request.Method,
+			}).Errorln("invalid method")
+			responseWriter.Header().Set("Allow", http.MethodPost)
+			http.Error(responseWriter, "method must be 'POST'", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := checkContentType(request.Header.Get("Content-Type")); err != nil {
+			logger.Logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Errorln("invalid header 'Content-Type'")
+			http.Error(responseWriter, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if maxBodyBytes > 0 && request.ContentLength > maxBodyBytes {
+			rejectOversizedBody(responseWriter, request.ContentLength, maxBodyBytes)
+			return
+		}
+
+		var body []byte
+		if request.Body != nil {
+			reader := io.Reader(request.Body)
+			if maxBodyBytes > 0 {
+				// read one byte more than allowed to detect oversized bodies without Content-Length
+				reader = io.LimitReader(request.Body, maxBodyBytes+1)
+			}
+			data, err := ioutil.ReadAll(reader)
+			if err != nil {
+				logger.Logger.WithFields(logrus.Fields{
+					"error": err,
+				}).Errorln("could not read body")
+				http.Error(responseWriter, fmt.Sprintf("could not read body: %v", err), http.StatusBadRequest)
+				return
+			}
+			if maxBodyBytes > 0 && int64(len(data)) > maxBodyBytes {
+				rejectOversizedBody(responseWriter, -1, maxBodyBytes)
+				return
+			}
+			body = data
+		}
+		if len(body) == 0 {
+			logger.Logger.Errorln("empty body")
+			http.Error(responseWriter, "body must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		review, err := admission_review.Decode(body)
+		if err != nil {
+			logger.Logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Errorln("invalid admission review")
+			http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.Logger.WithFields(logrus.Fields{
+			"profile":    profile,
+			"apiVersion": review.APIVersion,
+			"uid":        review.Request.UID,
+		}).Debugln("decoded admission review")
+
+		admissionResponse := mutator.Mutate(review.Request)
+		admissionResponse.UID = review.Request.UID
+
+		response, err := review.EncodeResponse(admissionResponse)
+		if err != nil {
+			logger.Logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Errorln("encode failed")
+			http.Error(responseWriter, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.WriteHeader(http.StatusOK)
+		if _, err := responseWriter.Write(response); err != nil {
+			// the status code has been sent already, the API server will see a truncated response
+			logger.Logger.WithFields(logrus.Fields{
+				"error": err,
+			}).Errorln("write failed")
+			return
+		}
+
+		logger.Logger.WithFields(logrus.Fields{
+			"profile": profile,
+		}).Debugln("handled mutation request")
+	}
+}
+
+// profileOf returns the profile of '/mutate/<profile>', and the default profile for '/mutate'
+func profileOf(path string) string {
+	if path == mutatePath {
+		return mutator.DefaultProfile
+	}
+	return strings.TrimPrefix(path, mutatePath+"/")
+}
+
+// checkContentType accepts 'application/json', optionally with the charset 'utf-8'
+func checkContentType(contentType string) error {
+	mediaType, parameters, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("Content-Type must be 'application/json', could not parse %q: %v", contentType, err)
+	}
+	if mediaType != "application/json" {
+		return fmt.Errorf("Content-Type must be 'application/json', got %q", mediaType)
+	}
+	if charset, ok := parameters["charset"]; ok && !strings.EqualFold(charset, "utf-8") {
+		return fmt.Errorf("charset must be 'utf-8', got %q", charset)
+	}
+	return nil
+}
+
+func rejectOversizedBody(responseWriter http.ResponseWriter, contentLength int64, maxBodyBytes int64) {
+	logger.Logger.WithFields(logrus.Fields{
+		"contentLength": contentLength,
+		"maxBodyBytes":  maxBodyBytes,
+	}).Errorln("body too large")
+	http.Error(responseWriter, fmt.Sprintf("body must not exceed %v bytes", maxBodyBytes), http.StatusRequestEntityTooLarge)
+}
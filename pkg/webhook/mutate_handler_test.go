@@ -0,0 +1,287 @@
+package webhook
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMutateHandleFunc(t *testing.T) {
+	handler := mutateHandleFunc(testMutators(t), 0)
+
+	validReview := `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview", "request": {"uid": "some-uid", "kind": {"group": "", "version": "v1", "kind": "Pod"}, "operation": "CREATE", "object": {"metadata": {"name": "some-pod"}}}}`
+
+	testCases := []struct {
+		description    string
+		method         string
+		contentType    string
+		body           string
+		expectedStatus int
+	}{
+		{
+			description:    "valid review",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           validReview,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			description:    "content type with charset",
+			method:         http.MethodPost,
+			contentType:    "application/json; charset=utf-8",
+			body:           validReview,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			description:    "content type with upper case charset",
+			method:         http.MethodPost,
+			contentType:    "Application/JSON; charset=UTF-8",
+			body:           validReview,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			description:    "invalid method",
+			method:         http.MethodGet,
+			contentType:    "application/json",
+			body:           validReview,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			description:    "missing content type",
+			method:         http.MethodPost,
+			body:           validReview,
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			description:    "invalid content type",
+			method:         http.MethodPost,
+			contentType:    "text/plain",
+			body:           validReview,
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			description:    "unparsable content type",
+			method:         http.MethodPost,
+			contentType:    "application/json; charset",
+			body:           validReview,
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			description:    "invalid charset",
+			method:         http.MethodPost,
+			contentType:    "application/json; charset=iso-8859-1",
+			body:           validReview,
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			description:    "empty body",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "invalid json",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           `{"apiVersion": "admission.k8s.io/v1",`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "trailing data",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           validReview + `{}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "no object",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           `[]`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "missing apiVersion",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           `{"kind": "AdmissionReview", "request": {"uid": "some-uid"}}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "unknown apiVersion",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           `{"apiVersion": "admission.k8s.io/v2", "kind": "AdmissionReview", "request": {"uid": "some-uid"}}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "invalid kind",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           `{"apiVersion": "admission.k8s.io/v1", "kind": "Pod", "request": {"uid": "some-uid"}}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "missing request",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "null request",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview", "request": null}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "missing uid",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview", "request": {}}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, testCase := range testCases {
+		request := httptest.NewRequest(testCase.method, mutatePath, strings.NewReader(testCase.body))
+		if testCase.contentType != "" {
+			request.Header.Set("Content-Type", testCase.contentType)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+
+		assert.Equal(t, testCase.expectedStatus, recorder.Code, testCase.description)
+		if testCase.expectedStatus != http.StatusOK {
+			continue
+		}
+
+		review := admissionv1.AdmissionReview{}
+		if assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &review), testCase.description) {
+			assert.Equal(t, "admission.k8s.io/v1", review.APIVersion, testCase.description)
+			assert.Equal(t, "AdmissionReview", review.Kind, testCase.description)
+			if assert.NotNil(t, review.Response, testCase.description) {
+				assert.Equal(t, "some-uid", string(review.Response.UID), testCase.description)
+				assert.True(t, review.Response.Allowed, testCase.description)
+				assert.NotEmpty(t, review.Response.Patch, testCase.description)
+			}
+		}
+	}
+}
+
+func TestMutateHandleFunc_RejectsUndecodableObjects(t *testing.T) {
+	handler := mutateHandleFunc(testMutators(t), 0)
+
+	body := `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview", "request": {"uid": "some-uid", "kind": {"group": "", "version": "v1", "kind": "Pod"}, "operation": "CREATE", "object": "not-a-pod"}}`
+	request := httptest.NewRequest(http.MethodPost, mutatePath, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+
+	// the review itself is valid, so the failure is reported in the AdmissionResponse
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	review := admissionv1.AdmissionReview{}
+	if assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &review)) && assert.NotNil(t, review.Response) {
+		assert.Equal(t, "some-uid", string(review.Response.UID))
+		assert.False(t, review.Response.Allowed)
+		if assert.NotNil(t, review.Response.Result) {
+			assert.Equal(t, metav1.StatusFailure, review.Response.Result.Status)
+			assert.Equal(t, int32(http.StatusBadRequest), review.Response.Result.Code)
+			assert.Equal(t, metav1.StatusReasonBadRequest, review.Response.Result.Reason)
+			assert.Contains(t, review.Response.Result.Message, "could not decode pod")
+		}
+	}
+}
+
+func TestMutateHandleFunc_AllowsAllButPodCreates(t *testing.T) {
+	handler := mutateHandleFunc(testMutators(t), 0)
+
+	testCases := []struct {
+		description string
+		request     string
+	}{
+		{"pod delete", `{"uid": "some-uid", "kind": {"group": "", "version": "v1", "kind": "Pod"}, "operation": "DELETE", "name": "some-pod", "oldObject": {"metadata": {"name": "some-pod"}}}`},
+		{"other kind", `{"uid": "some-uid", "kind": {"group": "apps", "version": "v1", "kind": "Deployment"}, "operation": "CREATE", "object": {"metadata": {"name": "some-deployment"}}}`},
+	}
+
+	for _, testCase := range testCases {
+		body := `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview", "request": ` + testCase.request + `}`
+		request := httptest.NewRequest(http.MethodPost, mutatePath, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+
+		assert.Equal(t, http.StatusOK, recorder.Code, testCase.description)
+		review := admissionv1.AdmissionReview{}
+		if assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &review), testCase.description) && assert.NotNil(t, review.Response, testCase.description) {
+			assert.Equal(t, "some-uid", string(review.Response.UID), testCase.description)
+			assert.True(t, review.Response.Allowed, testCase.description)
+			assert.Nil(t, review.Response.Patch, testCase.description)
+			assert.Nil(t, review.Response.Result, testCase.description)
+		}
+	}
+}
+
+func TestMutateHandleFunc_RespondsInVersionOfRequest(t *testing.T) {
+	handler := mutateHandleFunc(testMutators(t), 0)
+
+	for _, apiVersion := range []string{"admission.k8s.io/v1", "admission.k8s.io/v1beta1"} {
+		body := `{"apiVersion": "` + apiVersion + `", "kind": "AdmissionReview", "request": {"uid": "some-uid", "kind": {"group": "", "version": "v1", "kind": "Pod"}, "operation": "CREATE", "object": {"metadata": {"name": "some-pod"}}}}`
+		request := httptest.NewRequest(http.MethodPost, mutatePath, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+
+		assert.Equal(t, http.StatusOK, recorder.Code, apiVersion)
+		review := admissionv1.AdmissionReview{}
+		if assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &review), apiVersion) && assert.NotNil(t, review.Response, apiVersion) {
+			assert.Equal(t, apiVersion, review.APIVersion)
+			assert.Equal(t, "AdmissionReview", review.Kind, apiVersion)
+			assert.Equal(t, "some-uid", string(review.Response.UID), apiVersion)
+			assert.True(t, review.Response.Allowed, apiVersion)
+			assert.NotEmpty(t, review.Response.Patch, apiVersion)
+		}
+	}
+}
+
+func TestMutateHandleFunc_RoutesProfiles(t *testing.T) {
+	handler := mutateHandleFunc(testMutators(t, "some-profile", "other-profile"), 0)
+
+	testCases := []struct {
+		description    string
+		path           string
+		expectedStatus int
+		expectedLabel  string
+	}{
+		{"default profile", "/mutate", http.StatusOK, "default"},
+		{"default profile by name", "/mutate/default", http.StatusOK, "default"},
+		{"some profile", "/mutate/some-profile", http.StatusOK, "some-profile"},
+		{"other profile", "/mutate/other-profile", http.StatusOK, "other-profile"},
+		{"unknown profile", "/mutate/unknown-profile", http.StatusNotFound, ""},
+		{"empty profile", "/mutate/", http.StatusNotFound, ""},
+		{"nested path", "/mutate/some-profile/nested", http.StatusNotFound, ""},
+	}
+
+	body := `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview", "request": {"uid": "some-uid", "kind": {"group": "", "version": "v1", "kind": "Pod"}, "operation": "CREATE", "object": {"metadata": {"name": "some-pod"}}}}`
+	for _, testCase := range testCases {
+		request := httptest.NewRequest(http.MethodPost, testCase.path, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+
+		assert.Equal(t, testCase.expectedStatus, recorder.Code, testCase.description)
+		if testCase.expectedStatus != http.StatusOK {
+			continue
+		}
+		review := admissionv1.AdmissionReview{}
+		if assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &review), testCase.description) && assert.NotNil(t, review.Response, testCase.description) {
+			assert.Contains(t, string(review.Response.Patch), `"some-label":"`+testCase.expectedLabel+`"`, testCase.description)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"k8s-pod-mutator-webhook/internal/logger"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+)
+
+// OwnerLabel marks the cluster resources that are created at runtime (webhook configurations, cert Secrets),
+// so that they can be found and removed on uninstall
+const OwnerLabel = "k8s-pod-mutator.io/owner"
+
+const DefaultOwner = "k8s-pod-mutator"
+
+func ValidateOwner(owner string) error {
+	if owner == "" {
+		return fmt.Errorf("owner must not be empty")
+	}
+	if errs := validation.IsValidLabelValue(owner); len(errs) > 0 {
+		return fmt.Errorf("invalid owner %q: %v", owner, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func OwnerSelector(owner string) string {
+	return labels.Set{OwnerLabel: owner}.String()
+}
+
+// SetOwner labels all webhook configurations as owned by the given owner
+func (c *Configuration) SetOwner(owner string) {
+	for _, document := range c.documents() {
+		if document.objectMeta.Labels == nil {
+			document.objectMeta.Labels = make(map[string]string)
+		}
+		document.objectMeta.Labels[OwnerLabel] = owner
+	}
+}
+
+// DeleteOwnedConfigurations deletes all Mutating- and ValidatingWebhookConfigurations owned by the given owner
+func DeleteOwnedConfigurations(client kubernetes.Interface, owner string) error {
+	listOptions := metav1.ListOptions{LabelSelector: OwnerSelector(owner)}
+
+	mutatingConfigurations, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().List(context.TODO(), listOptions)
+	if err != nil {
+		return fmt.Errorf("could not list %v: %v", mutatingWebhookConfigurationKind, err)
+	}
+	for _, configuration := range mutatingConfigurations.Items {
+		logDeletion(mutatingWebhookConfigurationKind, configuration.Name, owner)
+		err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Delete(context.TODO(), configuration.Name, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("could not delete %v %q: %v", mutatingWebhookConfigurationKind, configuration.Name, err)
+		}
+	}
+
+	validatingConfigurations, err := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().List(context.TODO(), listOptions)
+	if err != nil {
+		return fmt.Errorf("could not list %v: %v", validatingWebhookConfigurationKind, err)
+	}
+	for _, configuration := range validatingConfigurations.Items {
+		logDeletion(validatingWebhookConfigurationKind, configuration.Name, owner)
+		err := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Delete(context.TODO(), configuration.Name, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("could not delete %v %q: %v", validatingWebhookConfigurationKind, configuration.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func logDeletion(kind string, name string, owner string) {
+	logger.Logger.WithFields(logrus.Fields{
+		"kind":  kind,
+		"name":  name,
+		"owner": owner,
+	}).Infoln("deleting owned k8s configuration")
+}
@@ -0,0 +1,59 @@
+package webhook
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestValidateOwner(t *testing.T) {
+	assert.NoError(t, ValidateOwner(DefaultOwner))
+	assert.NoError(t, ValidateOwner("some-namespace.some-release"))
+	assert.Error(t, ValidateOwner(""))
+	assert.Error(t, ValidateOwner("some-namespace/some-release"))
+}
+
+func TestConfiguration_SetOwner(t *testing.T) {
+	configuration, _ := parseTemplate([]byte(multiDocumentWebhookConfiguration))
+
+	configuration.SetOwner("some-owner")
+	for _, document := range configuration.documents() {
+		assert.Equal(t, "some-owner", document.objectMeta.Labels[OwnerLabel], document.objectMeta.Name)
+	}
+}
+
+func TestDeleteOwnedConfigurations(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&admissionregistrationv1.MutatingWebhookConfiguration{ObjectMeta: ownedObjectMeta("owned-mutating", "some-owner")},
+		&admissionregistrationv1.MutatingWebhookConfiguration{ObjectMeta: ownedObjectMeta("other-owner-mutating", "other-owner")},
+		&admissionregistrationv1.MutatingWebhookConfiguration{ObjectMeta: metav1.ObjectMeta{Name: "unowned-mutating"}},
+		&admissionregistrationv1.ValidatingWebhookConfiguration{ObjectMeta: ownedObjectMeta("owned-validating", "some-owner")},
+		&admissionregistrationv1.ValidatingWebhookConfiguration{ObjectMeta: metav1.ObjectMeta{Name: "unowned-validating"}},
+	)
+
+	assert.NoError(t, DeleteOwnedConfigurations(client, "some-owner"))
+
+	mutatingConfigurations, _ := client.AdmissionregistrationV1().MutatingWebhookConfigurations().List(context.TODO(), metav1.ListOptions{})
+	var mutatingNames []string
+	for _, configuration := range mutatingConfigurations.Items {
+		mutatingNames = append(mutatingNames, configuration.Name)
+	}
+	assert.ElementsMatch(t, []string{"other-owner-mutating", "unowned-mutating"}, mutatingNames)
+
+	validatingConfigurations, _ := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().List(context.TODO(), metav1.ListOptions{})
+	assert.Len(t, validatingConfigurations.Items, 1)
+	assert.Equal(t, "unowned-validating", validatingConfigurations.Items[0].Name)
+
+	// nothing left to delete
+	assert.NoError(t, DeleteOwnedConfigurations(client, "some-owner"))
+}
+
+func ownedObjectMeta(name string, owner string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:   name,
+		Labels: map[string]string{OwnerLabel: owner},
+	}
+}
@@ -0,0 +1,155 @@
+package webhook
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"k8s-pod-mutator-webhook/internal/admission_review"
+	"k8s-pod-mutator-webhook/internal/logger"
+	"k8s-pod-mutator-webhook/pkg/mutator"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"net/http"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+// previewHandleFunc answers a Pod (YAML or JSON) or an AdmissionReview with the mutator.Preview of the profile in the
+// query parameter 'profile', which defaults to the default profile
+func previewHandleFunc(mutators *mutator.Registry, maxBodyBytes int64) func(responseWriter http.ResponseWriter, request *http.Request) {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			responseWriter.Header().Set("Allow", http.MethodPost)
+			http.Error(responseWriter, "method must be 'POST'", http.StatusMethodNotAllowed)
+			return
+		}
+
+		profile := request.URL.Query().Get("profile")
+		if profile == "" {
+			profile = mutator.DefaultProfile
+		}
+		mutator, ok := mutators.Get(profile)
+		if !ok {
+			http.Error(responseWriter, fmt.Sprintf("unknown profile %q, expected one of %v", profile, mutators.Profiles()), http.StatusNotFound)
+			return
+		}
+
+		reader := io.Reader(request.Body)
+		if maxBodyBytes > 0 {
+			reader = io.LimitReader(request.Body, maxBodyBytes+1)
+		}
+		body, err := ioutil.ReadAll(reader)
+		if err != nil {
+			http.Error(responseWriter, fmt.Sprintf("could not read body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if maxBodyBytes > 0 && int64(len(body)) > maxBodyBytes {
+			rejectOversizedBody(responseWriter, -1, maxBodyBytes)
+			return
+		}
+
+		admissionRequest, err := previewRequest(body)
+		if err != nil {
+			http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger.Logger.WithFields(logrus.Fields{
+			"profile":   profile,
+			"namespace": admissionRequest.Namespace,
+		}).Infoln("previewing mutation")
+
+		preview, err := mutator.Preview(admissionRequest)
+		if err != nil {
+			statusCode := http.StatusInternalServerError
+			if admission_review.IsBadRequest(err) {
+				statusCode = http.StatusBadRequest
+			}
+			http.Error(responseWriter, err.Error(), statusCode)
+			return
+		}
+
+		response, err := json.MarshalIndent(preview, "", "  ")
+		if err != nil {
+			http.Error(responseWriter, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+			return
+		}
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.WriteHeader(http.StatusOK)
+		_, _ = responseWriter.Write(response)
+	}
+}
+
+// previewRequest converts a Pod or an AdmissionReview, in YAML or JSON, into the request for the mutator
+func previewRequest(body []byte) (*admissionv1.AdmissionRequest, error) {
+	if len(strings.TrimSpace(string(body))) == 0 {
+		return nil, fmt.Errorf("body must contain a pod or an admission review")
+	}
+	jsonBody, err := yaml.YAMLToJSON(body)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode body: %v", err)
+	}
+
+	typeMeta := metav1.TypeMeta{}
+	if err := json.Unmarshal(jsonBody, &typeMeta); err != nil {
+		return nil, fmt.Errorf("body must contain a pod or an admission review: %v", err)
+	}
+	switch typeMeta.Kind {
+	case "AdmissionReview":
+		review, err := admission_review.Decode(jsonBody)
+		if err != nil {
+			return nil, err
+		}
+		return review.Request, nil
+	case "Pod", "":
+		objectMeta := struct {
+			Metadata metav1.ObjectMeta `json:"metadata"`
+		}{}
+		if err := json.Unmarshal(jsonBody, &objectMeta); err != nil {
+			return nil, fmt.Errorf("could not decode pod: %v", err)
+		}
+		return &admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Operation: admissionv1.Create,
+			Namespace: objectMeta.Metadata.Namespace,
+			Object:    runtime.RawExtension{Raw: jsonBody},
+		}, nil
+	default:
+		return nil, fmt.Errorf("body must contain a pod or an admission review, got kind %q", typeMeta.Kind)
+	}
+}
+
+// requireToken rejects requests without the bearer token from tokenFile with 401. The file is read for every
+// request, so that the token can be rotated, e.g. if it is mounted from a Secret.
+func requireToken(tokenFile string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil || len(strings.TrimSpace(string(token))) == 0 {
+			logger.Logger.WithFields(logrus.Fields{
+				"tokenFile": tokenFile,
+				"error":     err,
+			}).Errorln("could not read admin token")
+			http.Error(responseWriter, "admin token not available", http.StatusInternalServerError)
+			return
+		}
+
+		authorization := request.Header.Get("Authorization")
+		presented := strings.TrimPrefix(authorization, "Bearer ")
+		expected := strings.TrimSpace(string(token))
+		if !strings.HasPrefix(authorization, "Bearer ") || subtle.ConstantTimeCompare([]byte(presented), []byte(expected)) != 1 {
+			logger.Logger.WithFields(logrus.Fields{
+				"path":       request.URL.Path,
+				"remoteAddr": request.RemoteAddr,
+			}).Warnln("rejected unauthenticated admin request")
+			responseWriter.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(responseWriter, "a valid bearer token is required", http.StatusUnauthorized)
+			return
+		}
+
+		handler(responseWriter, request)
+	}
+}
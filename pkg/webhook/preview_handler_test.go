@@ -0,0 +1,208 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"k8s-pod-mutator-webhook/pkg/mutator"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPreviewHandleFunc(t *testing.T) {
+	handler := previewHandleFunc(testMutators(t, "some-profile"), 1024)
+
+	testCases := []struct {
+		description    string
+		method         string
+		query          string
+		body           string
+		expectedStatus int
+		expectedLabel  string
+	}{
+		{
+			description:    "json pod",
+			method:         http.MethodPost,
+			body:           `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "some-pod", "namespace": "some-namespace"}}`,
+			expectedStatus: http.StatusOK,
+			expectedLabel:  "default",
+		},
+		{
+			description:    "yaml pod",
+			method:         http.MethodPost,
+			body:           "apiVersion: v1\nkind: Pod\nmetadata:\n  name: some-pod\n  namespace: some-namespace\n",
+			expectedStatus: http.StatusOK,
+			expectedLabel:  "default",
+		},
+		{
+			description:    "pod without kind",
+			method:         http.MethodPost,
+			body:           "metadata:\n  name: some-pod\n  namespace: some-namespace\n",
+			expectedStatus: http.StatusOK,
+			expectedLabel:  "default",
+		},
+		{
+			description:    "admission review",
+			method:         http.MethodPost,
+			body:           `{"apiVersion": "admission.k8s.io/v1beta1", "kind": "AdmissionReview", "request": {"uid": "some-uid", "kind": {"group": "", "version": "v1", "kind": "Pod"}, "operation": "CREATE", "namespace": "some-namespace", "object": {"metadata": {"name": "some-pod"}}}}`,
+			expectedStatus: http.StatusOK,
+			expectedLabel:  "default",
+		},
+		{
+			description:    "profile",
+			method:         http.MethodPost,
+			query:          "?profile=some-profile",
+			body:           `{"metadata": {"name": "some-pod", "namespace": "some-namespace"}}`,
+			expectedStatus: http.StatusOK,
+			expectedLabel:  "some-profile",
+		},
+		{
+			description:    "unknown profile",
+			method:         http.MethodPost,
+			query:          "?profile=unknown-profile",
+			body:           `{"metadata": {"name": "some-pod"}}`,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			description:    "invalid method",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			description:    "empty body",
+			method:         http.MethodPost,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "invalid yaml",
+			method:         http.MethodPost,
+			body:           "metadata: [",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "other kind",
+			method:         http.MethodPost,
+			body:           `{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": {"name": "some-deployment"}}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "invalid pod",
+			method:         http.MethodPost,
+			body:           `{"kind": "Pod", "spec": "some-spec"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "invalid admission review",
+			method:         http.MethodPost,
+			body:           `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "oversized body",
+			method:         http.MethodPost,
+			body:           `{"metadata": {"name": "` + strings.Repeat("a", 1024) + `"}}`,
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, testCase := range testCases {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(testCase.method, previewPath+testCase.query, strings.NewReader(testCase.body)))
+
+		assert.Equal(t, testCase.expectedStatus, recorder.Code, testCase.description)
+		if testCase.expectedStatus != http.StatusOK {
+			continue
+		}
+
+		preview := mutator.Preview{}
+		if assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &preview), testCase.description) {
+			assert.Equal(t, testCase.expectedLabel, preview.Profile, testCase.description)
+			assert.Contains(t, preview.Matches, mutator.PatchMatch{Field: "metadata.labels", Name: "some-label", Reason: "added"}, testCase.description)
+			assert.Contains(t, compact(t, preview.JsonPatch), `"some-label":"`+testCase.expectedLabel+`"`, testCase.description)
+			assert.Contains(t, compact(t, preview.Pod), `"namespace":"some-namespace"`, testCase.description)
+		}
+	}
+}
+
+func compact(t *testing.T, raw json.RawMessage) string {
+	buffer := bytes.Buffer{}
+	assert.NoError(t, json.Compact(&buffer, raw))
+	return buffer.String()
+}
+
+func TestRequireToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("some-token\n"), 0600))
+	handler := requireToken(tokenFile, func(responseWriter http.ResponseWriter, request *http.Request) {
+		responseWriter.WriteHeader(http.StatusOK)
+	})
+
+	testCases := []struct {
+		description    string
+		authorization  string
+		expectedStatus int
+	}{
+		{"valid token", "Bearer some-token", http.StatusOK},
+		{"missing token", "", http.StatusUnauthorized},
+		{"invalid token", "Bearer other-token", http.StatusUnauthorized},
+		{"token without scheme", "some-token", http.StatusUnauthorized},
+		{"other scheme", "Basic some-token", http.StatusUnauthorized},
+	}
+
+	for _, testCase := range testCases {
+		request := httptest.NewRequest(http.MethodPost, previewPath, nil)
+		if testCase.authorization != "" {
+			request.Header.Set("Authorization", testCase.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		assert.Equal(t, testCase.expectedStatus, recorder.Code, testCase.description)
+	}
+
+	// the token is read for every request
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("rotated-token"), 0600))
+	request := httptest.NewRequest(http.MethodPost, previewPath, nil)
+	request.Header.Set("Authorization", "Bearer rotated-token")
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// without a token, all requests are rejected
+	assert.NoError(t, ioutil.WriteFile(tokenFile, nil, 0600))
+	request.Header.Set("Authorization", "Bearer ")
+	recorder = httptest.NewRecorder()
+	handler(recorder, request)
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+}
+
+func TestServer_Admin(t *testing.T) {
+	withoutAdmin, err := CreateServer(ServerSettings{Port: 8443}, testMutators(t))
+	assert.NoError(t, err)
+	assert.Nil(t, withoutAdmin.adminServer)
+	// the preview is never served on the main port
+	assert.Equal(t, http.StatusNotFound, serve(withoutAdmin, previewPath).Code)
+
+	_, err = CreateServer(ServerSettings{Port: 8443, AdminPort: 8444}, testMutators(t))
+	assert.Error(t, err, "admin port without token file")
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("some-token"), 0600))
+	withAdmin, err := CreateServer(ServerSettings{Port: 8443, AdminPort: 8444, AdminTokenFile: tokenFile}, testMutators(t))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, serve(withAdmin, previewPath).Code)
+
+	request := httptest.NewRequest(http.MethodPost, previewPath, strings.NewReader(`{"metadata": {"name": "some-pod"}}`))
+	recorder := httptest.NewRecorder()
+	withAdmin.adminServer.Handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	request = httptest.NewRequest(http.MethodPost, previewPath, strings.NewReader(`{"metadata": {"name": "some-pod"}}`))
+	request.Header.Set("Authorization", "Bearer some-token")
+	recorder = httptest.NewRecorder()
+	withAdmin.adminServer.Handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
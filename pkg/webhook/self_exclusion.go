@@ -0,0 +1,102 @@
+package webhook
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"k8s-pod-mutator-webhook/internal/logger"
+	"k8s-pod-mutator-webhook/pkg/mutator"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/kubernetes"
+	"reflect"
+)
+
+// namespaceNameLabel is set on all namespaces by Kubernetes (1.21+). On older clusters it is missing and 'NotIn' matches all namespaces.
+const namespaceNameLabel = "kubernetes.io/metadata.name"
+
+var namespaceNameLabelMinVersion = version.MustParseGeneric("1.21.0")
+
+const kubeSystemNamespace = "kube-system"
+
+// excludeSelf keeps the webhooks that point at the webhook's own service away from its own namespace, its own Pods and
+// kube-system. Otherwise, with failurePolicy 'Fail', the webhook's Pods could not be recreated, because their admission
+// would require the webhook to be running already. Selectors of the template are kept and extended.
+func (c *Configuration) excludeSelf(serviceMetadata ServiceMetadata) {
+	excludedNamespaces := []string{kubeSystemNamespace}
+	if serviceMetadata.Namespace != "" && serviceMetadata.Namespace != kubeSystemNamespace {
+		excludedNamespaces = append(excludedNamespaces, serviceMetadata.Namespace)
+	}
+
+	for _, document := range c.documents() {
+		for _, webhook := range document.webhooks {
+			if !pointsAt(*webhook.clientConfig, serviceMetadata) {
+				continue
+			}
+
+			logger.Logger.WithFields(logrus.Fields{
+				"kind":       document.kind,
+				"name":       document.objectMeta.Name,
+				"webhook":    webhook.name,
+				"namespaces": excludedNamespaces,
+				"podLabel":   mutator.SelfLabel,
+			}).Debugln("excluding own namespace and pods")
+
+			addSelectorRequirement(webhook.namespaceSelector, metav1.LabelSelectorRequirement{
+				Key:      namespaceNameLabel,
+				Operator: metav1.LabelSelectorOpNotIn,
+				Values:   excludedNamespaces,
+			})
+			addSelectorRequirement(webhook.objectSelector, metav1.LabelSelectorRequirement{
+				Key:      mutator.SelfLabel,
+				Operator: metav1.LabelSelectorOpDoesNotExist,
+			})
+		}
+	}
+}
+
+// warnIfNamespacesNotExcluded warns if the cluster is too old to set namespaceNameLabel, so that excludeSelf does not
+// exclude any namespace unless the namespaces have been labeled manually
+func warnIfNamespacesNotExcluded(client kubernetes.Interface, serviceMetadata ServiceMetadata) {
+	supported, serverVersion, err := namespaceNameLabelSupported(client)
+	if err != nil {
+		logger.Logger.WithFields(logrus.Fields{
+			"error": err,
+		}).Warnln("could not determine whether namespaces can be excluded from the webhooks")
+		return
+	}
+	if supported {
+		return
+	}
+
+	logger.Logger.WithFields(logrus.Fields{
+		"serverVersion": serverVersion,
+		"namespaces":    []string{kubeSystemNamespace, serviceMetadata.Namespace},
+		"label":         namespaceNameLabel,
+	}).Warnf("kubernetes < %v does not label namespaces with their name, the namespaces are only excluded from the webhooks if they are labeled manually", namespaceNameLabelMinVersion)
+}
+
+// namespaceNameLabelSupported returns whether the API server (1.21+) sets namespaceNameLabel on all namespaces
+func namespaceNameLabelSupported(client kubernetes.Interface) (bool, string, error) {
+	info, err := client.Discovery().ServerVersion()
+	if err != nil {
+		return false, "", fmt.Errorf("could not get server version: %v", err)
+	}
+	serverVersion, err := version.ParseGeneric(info.GitVersion)
+	if err != nil {
+		return false, info.GitVersion, fmt.Errorf("could not parse server version %q: %v", info.GitVersion, err)
+	}
+	return serverVersion.AtLeast(namespaceNameLabelMinVersion), info.GitVersion, nil
+}
+
+// addSelectorRequirement adds the requirement to the selector, unless the selector contains it already
+func addSelectorRequirement(selector **metav1.LabelSelector, requirement metav1.LabelSelectorRequirement) {
+	if *selector == nil {
+		*selector = &metav1.LabelSelector{}
+	}
+	for _, existingRequirement := range (*selector).MatchExpressions {
+		if reflect.DeepEqual(existingRequirement, requirement) {
+			return
+		}
+	}
+	(*selector).MatchExpressions = append((*selector).MatchExpressions, requirement)
+}
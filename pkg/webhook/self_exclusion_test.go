@@ -0,0 +1,136 @@
+package webhook
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestConfiguration_ExcludeSelf(t *testing.T) {
+	configuration, err := parseTemplate([]byte(webhookConfigurationWithSelectors))
+	assert.NoError(t, err)
+	serviceMetadata, _ := configuration.GetServiceMetadata()
+
+	configuration.excludeSelf(serviceMetadata)
+	// repeated registrations do not add the exclusions again
+	configuration.excludeSelf(serviceMetadata)
+
+	webhooks := configuration.mutatingTemplates[0].Webhooks
+
+	// without selectors
+	assert.Equal(t, "kubernetes.io/metadata.name notin (kube-system,some-namespace)", metav1.FormatLabelSelector(webhooks[0].NamespaceSelector))
+	assert.Equal(t, "!k8s-pod-mutator.io/webhook", metav1.FormatLabelSelector(webhooks[0].ObjectSelector))
+
+	// selectors of the template are kept
+	assert.Equal(t, "!control-plane,environment=dev,kubernetes.io/metadata.name notin (kube-system,some-namespace)", metav1.FormatLabelSelector(webhooks[1].NamespaceSelector))
+	assert.Equal(t, "app in (some-app),!k8s-pod-mutator.io/webhook", metav1.FormatLabelSelector(webhooks[1].ObjectSelector))
+
+	// webhooks of others are left as they are
+	assert.Nil(t, webhooks[2].NamespaceSelector)
+	assert.Nil(t, webhooks[2].ObjectSelector)
+}
+
+func TestConfiguration_ExcludeSelfInKubeSystem(t *testing.T) {
+	configuration, _ := ConfigurationFromSettings(GeneratedConfigurationSettings{
+		Name:               "some-configuration",
+		WebhookName:        "webhook.example.org",
+		ServiceName:        "some-service",
+		ServiceNamespace:   "kube-system",
+		ServicePath:        "/mutate",
+		ServicePort:        443,
+		Operations:         []string{"CREATE"},
+		FailurePolicy:      "Fail",
+		TimeoutSeconds:     2,
+		ReinvocationPolicy: "Never",
+	})
+	serviceMetadata, _ := configuration.GetServiceMetadata()
+
+	configuration.excludeSelf(serviceMetadata)
+
+	webhook := configuration.mutatingTemplates[0].Webhooks[0]
+	assert.Equal(t, "kubernetes.io/metadata.name notin (kube-system)", metav1.FormatLabelSelector(webhook.NamespaceSelector))
+}
+
+func TestConfiguration_ApplyInClusterExcludesSelf(t *testing.T) {
+	configuration, _ := parseTemplate([]byte(webhookConfigurationWithSelectors))
+	client := fake.NewSimpleClientset()
+	applied := recordApplyPatches(client)
+
+	assert.NoError(t, configuration.ApplyInCluster(client, []byte("some-ca-bundle")))
+
+	mutating := &admissionregistrationv1.MutatingWebhookConfiguration{}
+	assert.NoError(t, json.Unmarshal(applied["some-mutating-configuration"], mutating))
+	for _, webhook := range mutating.Webhooks[:2] {
+		assert.Contains(t, webhook.NamespaceSelector.MatchExpressions, metav1.LabelSelectorRequirement{
+			Key:      "kubernetes.io/metadata.name",
+			Operator: metav1.LabelSelectorOpNotIn,
+			Values:   []string{"kube-system", "some-namespace"},
+		}, webhook.Name)
+		assert.Contains(t, webhook.ObjectSelector.MatchExpressions, metav1.LabelSelectorRequirement{
+			Key:      "k8s-pod-mutator.io/webhook",
+			Operator: metav1.LabelSelectorOpDoesNotExist,
+		}, webhook.Name)
+	}
+}
+
+const webhookConfigurationWithSelectors = `
+apiVersion: admissionregistration.k8s.io/v1
+kind: MutatingWebhookConfiguration
+metadata:
+  name: some-mutating-configuration
+webhooks:
+  - name: without-selectors.k8s-pod-mutator.io
+    clientConfig:
+      service:
+        name: some-service
+        namespace: some-namespace
+    failurePolicy: Fail
+  - name: with-selectors.k8s-pod-mutator.io
+    clientConfig:
+      service:
+        name: some-service
+        namespace: some-namespace
+    failurePolicy: Fail
+    namespaceSelector:
+      matchLabels:
+        environment: dev
+      matchExpressions:
+        - key: control-plane
+          operator: DoesNotExist
+    objectSelector:
+      matchExpressions:
+        - key: app
+          operator: In
+          values: ["some-app"]
+  - name: other.example.org
+    clientConfig:
+      url: https://other.example.org/mutate
+`
+
+func TestNamespaceNameLabelSupported(t *testing.T) {
+	testCases := []struct {
+		gitVersion        string
+		expectedSupported bool
+		expectedError     bool
+	}{
+		{"v1.21.0", true, false},
+		{"v1.22.3-gke.1500", true, false},
+		{"v1.20.15", false, false},
+		{"v1.16.0+k3s1", false, false},
+		{"unknown", false, true},
+	}
+
+	for _, testCase := range testCases {
+		client := fake.NewSimpleClientset()
+		client.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &version.Info{GitVersion: testCase.gitVersion}
+
+		supported, _, err := namespaceNameLabelSupported(client)
+		assert.Equal(t, testCase.expectedSupported, supported, testCase.gitVersion)
+		assert.Equal(t, testCase.expectedError, err != nil, testCase.gitVersion)
+	}
+}
@@ -2,130 +2,251 @@ package webhook
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
 	"github.com/sirupsen/logrus"
-	"io/ioutil"
-	"k8s-pod-mutator-webhook/internal/admission_review"
 	"k8s-pod-mutator-webhook/internal/logger"
+	"k8s-pod-mutator-webhook/internal/metrics"
 	"k8s-pod-mutator-webhook/pkg/mutator"
-	admissionv1 "k8s.io/api/admission/v1"
 	"net/http"
-	"reflect"
+	"sync/atomic"
+	"time"
 )
 
+// readyPath is kept for backwards compatibility, it responds like readyzPath but with 204
 const readyPath = "/ready"
+const livezPath = "/livez"
+const readyzPath = "/readyz"
 const mutatePath = "/mutate"
+const metricsPath = "/metrics"
+const previewPath = "/debug/preview"
 
 type ServerSettings struct {
-	Port        int
-	Tls         bool
-	TlsCertFile string
-	TlsKeyFile  string
+	Port              int
+	Tls               bool
+	TlsCertFile       string
+	TlsKeyFile        string
+	TlsReloadInterval time.Duration
+	// TlsMinVersion, TlsCipherSuites and TlsCurves restrict the TLS handshake, Go's defaults apply if they are empty
+	TlsMinVersion   string
+	TlsCipherSuites []string
+	TlsCurves       []string
+	Http2           bool
+	// timeouts of the http.Server, 0 disables a timeout
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// MaxRequestBodyBytes rejects larger requests with 413, 0 does not limit the body
+	MaxRequestBodyBytes int64
+	// ClientCaFile enables client cert verification for mutation requests, e.g. with the client cert of the API server
+	ClientCaFile string
+	// AllowedClientNames restricts mutation requests to client certs with one of these common names or SANs, if set
+	AllowedClientNames []string
+	// MetricsPort serves the metrics by plain HTTP on a separate port, if set. Otherwise, they are served on Port.
+	MetricsPort int
+	// ShutdownGracePeriod is waited for after readiness fails on shutdown, so that the endpoints are updated before requests are drained
+	ShutdownGracePeriod time.Duration
+	// DrainTimeout limits how long in-flight requests are waited for on shutdown, 0 waits indefinitely
+	DrainTimeout time.Duration
+	// AdminPort serves the debug endpoints, e.g. the preview of mutations, if set. They require the bearer token from
+	// AdminTokenFile and are served by TLS if Tls is set.
+	AdminPort      int
+	AdminTokenFile string
 }
 
 type Server struct {
 	settings   ServerSettings
 	httpServer http.Server
+	// metricsServer is nil if the metrics are served by httpServer
+	metricsServer *http.Server
+	// adminServer is nil if no AdminPort is set
+	adminServer *http.Server
+	certificate *certificateHolder
+	stopChan    chan struct{}
+	// notReady is set while the webhook must not receive requests yet, e.g. until it has registered itself
+	notReady int32
+	// shuttingDown is set once Stop is called, the server is not ready anymore from then on
+	shuttingDown int32
+	liveness     healthChecks
+	readiness    healthChecks
 }
 
-func CreateServer(settings ServerSettings, mutator mutator.Mutator) (*Server, error) {
+// CreateServer creates a server for the Mutators of all profiles, the default profile is served on '/mutate', all others
+// on '/mutate/<profile>'
+func CreateServer(settings ServerSettings, mutators *mutator.Registry) (*Server, error) {
 	logger.Logger.WithFields(logrus.Fields{
 		"settings": settings,
 	}).Infoln("creating server")
 
 	serveMux := http.NewServeMux()
 
-	serveMux.HandleFunc(readyPath, readyHandleFunc)
-	logger.Logger.Debugf("setup handler for %v", readyPath)
-
-	serveMux.HandleFunc(mutatePath, mutateHandleFunc(mutator))
-	logger.Logger.Debugf("setup handler for %v", mutatePath)
-
 	server := Server{
 		settings: settings,
+		stopChan: make(chan struct{}),
 		httpServer: http.Server{
-			Addr:    fmt.Sprintf(":%v", settings.Port),
-			Handler: serveMux,
+			Addr:              fmt.Sprintf(":%v", settings.Port),
+			Handler:           serveMux,
+			ReadHeaderTimeout: settings.ReadHeaderTimeout,
+			ReadTimeout:       settings.ReadTimeout,
+			WriteTimeout:      settings.WriteTimeout,
+			IdleTimeout:       settings.IdleTimeout,
 		},
 	}
-	return &server, nil
-}
+	if !settings.Http2 {
+		// a non-nil map disables HTTP/2
+		server.httpServer.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
 
-func readyHandleFunc(responseWriter http.ResponseWriter, request *http.Request) {
-	responseWriter.WriteHeader(204)
-}
+	server.liveness.add(HealthCheck{Name: "ping", Check: func() error { return nil }})
+	server.readiness.add(HealthCheck{Name: "serving", Check: server.checkServing})
+	server.readiness.add(HealthCheck{Name: "shutdown", Check: server.checkShutdown})
 
-func mutateHandleFunc(mutator mutator.Mutator) func(responseWriter http.ResponseWriter, request *http.Request) {
-	return func(responseWriter http.ResponseWriter, request *http.Request) {
-		logger.Logger.Debugln("handling mutation request")
-
-		contentType := request.Header.Get("Content-Type")
-		if contentType != "application/json" {
-			logger.Logger.WithFields(logrus.Fields{
-				"expected": "application/json",
-				"actual":   contentType,
-			}).Errorln("invalid header 'Content-Type'")
-			http.Error(responseWriter, "Content-Type must be 'application/json'", http.StatusUnsupportedMediaType)
-			return
-		}
+	serveMux.Handle(livezPath, metrics.Instrument("livez", healthHandleFunc(&server.liveness, http.StatusOK)))
+	logger.Logger.Debugf("setup handler for %v", livezPath)
 
-		var body []byte
-		if request.Body != nil {
-			if data, err := ioutil.ReadAll(request.Body); err == nil {
-				body = data
-			}
-		}
-		if len(body) == 0 {
-			logger.Logger.WithFields(logrus.Fields{
-				"body": string(body),
-			}).Errorln("invalid body")
-			http.Error(responseWriter, "body must not be empty", http.StatusBadRequest)
-			return
-		}
+	serveMux.Handle(readyzPath, metrics.Instrument("readyz", healthHandleFunc(&server.readiness, http.StatusOK)))
+	logger.Logger.Debugf("setup handler for %v", readyzPath)
 
-		var admissionResponse *admissionv1.AdmissionResponse
-		reviewRequest := admissionv1.AdmissionReview{}
-		if err := json.Unmarshal(body, &reviewRequest); err != nil {
-			logger.Logger.WithFields(logrus.Fields{
-				"error": err,
-				"type":  reflect.TypeOf(reviewRequest),
-			}).Errorln("decode failed")
-			admissionResponse = admission_review.ErrorResponse(err)
-		} else {
-			admissionResponse = mutator.Mutate(reviewRequest.Request)
+	serveMux.Handle(readyPath, metrics.Instrument("ready", healthHandleFunc(&server.readiness, http.StatusNoContent)))
+	logger.Logger.Debugf("setup handler for %v", readyPath)
+
+	mutateHandler := mutateHandleFunc(mutators, settings.MaxRequestBodyBytes)
+	if settings.ClientCaFile != "" {
+		if !settings.Tls {
+			return nil, fmt.Errorf("client cert verification requires TLS")
 		}
+		mutateHandler = requireClientCert(settings.AllowedClientNames, mutateHandler)
+	}
+	instrumentedMutateHandler := metrics.Instrument("mutate", mutateHandler)
+	serveMux.Handle(mutatePath, instrumentedMutateHandler)
+	serveMux.Handle(mutatePath+"/", instrumentedMutateHandler)
+	logger.Logger.WithFields(logrus.Fields{
+		"profiles": mutators.Profiles(),
+	}).Debugf("setup handler for %v", mutatePath)
 
-		admissionResponse.UID = reviewRequest.Request.UID
+	if settings.MetricsPort == 0 {
+		serveMux.Handle(metricsPath, metrics.Handler())
+	} else {
+		metricsServeMux := http.NewServeMux()
+		metricsServeMux.Handle(metricsPath, metrics.Handler())
+		server.metricsServer = &http.Server{
+			Addr:              fmt.Sprintf(":%v", settings.MetricsPort),
+			Handler:           metricsServeMux,
+			ReadHeaderTimeout: settings.ReadHeaderTimeout,
+			ReadTimeout:       settings.ReadTimeout,
+			WriteTimeout:      settings.WriteTimeout,
+			IdleTimeout:       settings.IdleTimeout,
+		}
+	}
+	logger.Logger.Debugf("setup handler for %v", metricsPath)
 
-		reviewResponse := admissionv1.AdmissionReview{
-			TypeMeta: reviewRequest.TypeMeta,
-			Response: admissionResponse,
+	if settings.AdminPort != 0 {
+		if settings.AdminTokenFile == "" {
+			return nil, fmt.Errorf("the admin port requires an admin token file")
+		}
+		adminServeMux := http.NewServeMux()
+		adminServeMux.Handle(previewPath, metrics.Instrument("preview", requireToken(settings.AdminTokenFile, previewHandleFunc(mutators, settings.MaxRequestBodyBytes))))
+		server.adminServer = &http.Server{
+			Addr:              fmt.Sprintf(":%v", settings.AdminPort),
+			Handler:           adminServeMux,
+			ReadHeaderTimeout: settings.ReadHeaderTimeout,
+			ReadTimeout:       settings.ReadTimeout,
+			WriteTimeout:      settings.WriteTimeout,
+			IdleTimeout:       settings.IdleTimeout,
 		}
+		logger.Logger.Debugf("setup handler for %v", previewPath)
+	}
 
-		response, err := json.Marshal(reviewResponse)
+	if settings.Tls {
+		server.certificate = &certificateHolder{
+			certFile: settings.TlsCertFile,
+			keyFile:  settings.TlsKeyFile,
+		}
+		tlsConfig, err := createTlsConfig(settings)
 		if err != nil {
-			logger.Logger.WithFields(logrus.Fields{
-				"error": err,
-			}).Errorln("encode failed")
-			http.Error(responseWriter, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+			return nil, err
 		}
-
-		responseWriter.Header().Set("Content-Type", "application/json")
-		responseWriter.WriteHeader(200)
-		if _, err := responseWriter.Write(response); err != nil {
-			logger.Logger.WithFields(logrus.Fields{
-				"error": err,
-			}).Errorln("write failed")
-			http.Error(responseWriter, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
+		tlsConfig.GetCertificate = server.certificate.getCertificate
+		if settings.ClientCaFile != "" {
+			if err := applyClientAuth(tlsConfig, settings.ClientCaFile); err != nil {
+				return nil, err
+			}
 		}
+		server.httpServer.TLSConfig = tlsConfig
+		if server.adminServer != nil {
+			// the admin server neither requires client certs nor serves HTTP/2
+			adminTlsConfig, err := createTlsConfig(settings)
+			if err != nil {
+				return nil, err
+			}
+			adminTlsConfig.GetCertificate = server.certificate.getCertificate
+			server.adminServer.TLSConfig = adminTlsConfig
+			server.adminServer.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+		server.readiness.add(tlsHealthCheck(server.certificate, time.Now))
+	}
+
+	return &server, nil
+}
 
-		logger.Logger.Debugln("handled mutation request")
+func (s *Server) checkServing() error {
+	if atomic.LoadInt32(&s.notReady) != 0 {
+		return fmt.Errorf("not ready to serve requests")
 	}
+	return nil
 }
 
+func (s *Server) checkShutdown() error {
+	if atomic.LoadInt32(&s.shuttingDown) != 0 {
+		return fmt.Errorf("shutting down")
+	}
+	return nil
+}
+
+// AddLivenessCheck adds a check to '/livez', the webhook is restarted if it fails
+func (s *Server) AddLivenessCheck(check HealthCheck) {
+	s.liveness.add(check)
+}
+
+// AddReadinessCheck adds a check to '/readyz', the webhook does not receive requests while it fails
+func (s *Server) AddReadinessCheck(check HealthCheck) {
+	s.readiness.add(check)
+}
+
+// SetReady controls whether the server reports to be ready - it is ready by default
+func (s *Server) SetReady(ready bool) {
+	logger.Logger.WithFields(logrus.Fields{
+		"ready": ready,
+	}).Infoln("changing readiness")
+
+	var notReady int32
+	if !ready {
+		notReady = 1
+	}
+	atomic.StoreInt32(&s.notReady, notReady)
+}
+
+// Start serves until the server is stopped, in which case it returns http.ErrServerClosed, or until the main server,
+// the metrics server or the admin server fails, e.g. because its port is in use
 func (s *Server) Start() error {
+	errChan := make(chan error, 3)
+	if s.metricsServer != nil {
+		logger.Logger.WithFields(logrus.Fields{
+			"port": s.settings.MetricsPort,
+		}).Infoln("starting metrics server")
+		serveAside("metrics", s.metricsServer.ListenAndServe, errChan)
+	}
+
+	go func() {
+		errChan <- s.serve(errChan)
+	}()
+	return <-errChan
+}
+
+func (s *Server) serve(errChan chan<- error) error {
 	if !s.settings.Tls {
+		s.startAdminServer(errChan)
 		logger.Logger.WithFields(logrus.Fields{
 			"port": s.settings.Port,
 			"tls":  "disabled",
@@ -133,14 +254,90 @@ func (s *Server) Start() error {
 		return s.httpServer.ListenAndServe()
 	}
 
+	if err := s.certificate.load(); err != nil {
+		return err
+	}
+	if s.settings.TlsReloadInterval > 0 {
+		go s.certificate.watch(s.settings.TlsReloadInterval, s.stopChan)
+	}
+	s.startAdminServer(errChan)
+
 	logger.Logger.WithFields(logrus.Fields{
 		"port": s.settings.Port,
 		"tls":  "enabled",
 	}).Infoln("starting server")
-	return s.httpServer.ListenAndServeTLS(s.settings.TlsCertFile, s.settings.TlsKeyFile)
+	return s.httpServer.ListenAndServeTLS("", "")
 }
 
+// serveAside runs a server besides the main server and reports its failure to errChan. http.ErrServerClosed is not
+// reported, so that Start only returns it once the main server has been stopped as well.
+func serveAside(name string, listenAndServe func() error, errChan chan<- error) {
+	go func() {
+		if err := listenAndServe(); err != nil && err != http.ErrServerClosed {
+			errChan <- fmt.Errorf("%v server failed: %v", name, err)
+		}
+	}()
+}
+
+func (s *Server) startAdminServer(errChan chan<- error) {
+	if s.adminServer == nil {
+		return
+	}
+	logger.Logger.WithFields(logrus.Fields{
+		"port": s.settings.AdminPort,
+		"tls":  s.settings.Tls,
+	}).Infoln("starting admin server")
+	listenAndServe := s.adminServer.ListenAndServe
+	if s.settings.Tls {
+		listenAndServe = func() error {
+			return s.adminServer.ListenAndServeTLS("", "")
+		}
+	}
+	serveAside("admin", listenAndServe, errChan)
+}
+
+// ReloadCertificate makes the server pick up a renewed TLS cert immediately, instead of with the next periodic reload
+func (s *Server) ReloadCertificate() error {
+	if !s.settings.Tls {
+		return nil
+	}
+	return s.certificate.load()
+}
+
+// Stop shuts the server down gracefully: readiness fails first, so that no new requests are routed to the webhook after
+// ShutdownGracePeriod, then in-flight requests are drained for at most DrainTimeout. Start returns http.ErrServerClosed afterwards.
 func (s *Server) Stop() error {
-	logger.Logger.Infoln("stopping server")
-	return s.httpServer.Shutdown(context.Background())
+	logger.Logger.WithFields(logrus.Fields{
+		"gracePeriod":  s.settings.ShutdownGracePeriod,
+		"drainTimeout": s.settings.DrainTimeout,
+	}).Infoln("stopping server")
+
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	if s.settings.ShutdownGracePeriod > 0 {
+		logger.Logger.Debugln("waiting for endpoints to be updated")
+		time.Sleep(s.settings.ShutdownGracePeriod)
+	}
+	close(s.stopChan)
+
+	ctx := context.Background()
+	if s.settings.DrainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.settings.DrainTimeout)
+		defer cancel()
+	}
+
+	logger.Logger.Debugln("draining requests")
+	if s.metricsServer != nil {
+		_ = s.metricsServer.Shutdown(ctx)
+	}
+	if s.adminServer != nil {
+		_ = s.adminServer.Shutdown(ctx)
+	}
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		_ = s.httpServer.Close()
+		return fmt.Errorf("could not drain requests: %v", err)
+	}
+
+	logger.Logger.Infoln("server stopped")
+	return nil
 }
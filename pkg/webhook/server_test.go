@@ -0,0 +1,318 @@
+package webhook
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"k8s-pod-mutator-webhook/pkg/mutator"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Readiness(t *testing.T) {
+	server, err := CreateServer(ServerSettings{Port: 8443}, testMutators(t))
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusNoContent, serve(server, readyPath).Code, "ready by default")
+
+	server.SetReady(false)
+	assert.Equal(t, http.StatusServiceUnavailable, serve(server, readyPath).Code)
+
+	server.SetReady(true)
+	assert.Equal(t, http.StatusNoContent, serve(server, readyPath).Code)
+}
+
+func TestServer_VerboseReadinessHasBody(t *testing.T) {
+	server, err := CreateServer(ServerSettings{Port: 8443}, testMutators(t))
+	assert.NoError(t, err)
+	// a real connection, as the recorder keeps bodies that are dropped for 204 responses
+	httpServer := httptest.NewServer(server.httpServer.Handler)
+	defer httpServer.Close()
+
+	response, err := http.Get(httpServer.URL + readyPath + "?verbose")
+	assert.NoError(t, err)
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "application/json", response.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), `"status":"ok"`)
+}
+
+func TestServer_Health(t *testing.T) {
+	server, err := CreateServer(ServerSettings{Port: 8443}, testMutators(t))
+	assert.NoError(t, err)
+
+	livez := serve(server, livezPath)
+	assert.Equal(t, http.StatusOK, livez.Code)
+	assert.Equal(t, "ok\n", livez.Body.String())
+	assert.Equal(t, http.StatusOK, serve(server, readyzPath).Code)
+
+	// further checks can be plugged in
+	syncErr := fmt.Errorf("cache not synced")
+	server.AddReadinessCheck(HealthCheck{Name: "informers", Check: func() error { return syncErr }})
+	server.SetReady(false)
+
+	readyz := serve(server, readyzPath)
+	assert.Equal(t, http.StatusServiceUnavailable, readyz.Code)
+	assert.Equal(t, "serving failed: not ready to serve requests\ninformers failed: cache not synced\n", readyz.Body.String())
+	assert.Equal(t, http.StatusOK, serve(server, livezPath).Code, "liveness is not affected")
+
+	verbose := serve(server, readyzPath+"?verbose")
+	assert.Equal(t, http.StatusServiceUnavailable, verbose.Code)
+	assert.Equal(t, "application/json", verbose.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{
+		"status": "failed",
+		"checks": [
+			{"name": "serving", "status": "failed", "error": "not ready to serve requests"},
+			{"name": "shutdown", "status": "ok"},
+			{"name": "informers", "status": "failed", "error": "cache not synced"}
+		]
+	}`, verbose.Body.String())
+
+	server.AddLivenessCheck(HealthCheck{Name: "deadlock", Check: func() error { return fmt.Errorf("stuck") }})
+	assert.Equal(t, http.StatusServiceUnavailable, serve(server, livezPath).Code)
+}
+
+func TestTlsHealthCheck(t *testing.T) {
+	now := time.Now()
+	holder := testCertificateHolder(t)
+	check := tlsHealthCheck(holder, func() time.Time { return now })
+
+	assert.Error(t, check.Check(), "no certificate loaded")
+
+	writeKeyPair(t, holder, "some-name", now.Add(time.Hour))
+	assert.NoError(t, holder.load())
+	assert.NoError(t, check.Check())
+
+	writeKeyPair(t, holder, "some-name", now.Add(-time.Hour))
+	assert.NoError(t, holder.load())
+	assert.Error(t, check.Check(), "expired")
+}
+
+// testMutators creates a default mutator and one for each profile, which add the label 'some-label: <profile>'
+func testMutators(t *testing.T, profiles ...string) *mutator.Registry {
+	createMutator := func(profile string) mutator.Mutator {
+		patchFile := filepath.Join(t.TempDir(), profile+".yaml")
+		assert.NoError(t, ioutil.WriteFile(patchFile, []byte("metadata:\n  labels:\n    some-label: "+profile+"\n"), 0640))
+		testMutator, err := mutator.CreateMutator(mutator.MutationSettings{Profile: profile, PatchFile: patchFile, RolloutPercentage: 100})
+		assert.NoError(t, err)
+		return *testMutator
+	}
+
+	mutators := mutator.NewRegistry(createMutator(mutator.DefaultProfile))
+	for _, profile := range profiles {
+		assert.NoError(t, mutators.Add(createMutator(profile)))
+	}
+	return mutators
+}
+
+func serve(server *Server, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	server.httpServer.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder
+}
+
+func TestServer_Metrics(t *testing.T) {
+	server, err := CreateServer(ServerSettings{Port: 8443}, mutator.NewRegistry(mutator.Mutator{}))
+	assert.NoError(t, err)
+
+	review := `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview", "request": {"uid": "some-uid", "kind": {"group": "", "version": "v1", "kind": "Pod"}, "operation": "CREATE", "namespace": "some-namespace", "object": {"metadata": {"labels": {"k8s-pod-mutator.io/webhook": "true"}}}}}`
+	request := httptest.NewRequest(http.MethodPost, mutatePath, strings.NewReader(review))
+	request.Header.Set("Content-Type", "application/json")
+	server.httpServer.Handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	response := serve(server, metricsPath)
+	assert.Equal(t, http.StatusOK, response.Code)
+	body := response.Body.String()
+	assert.Contains(t, body, `k8s_pod_mutator_http_requests_total{code="200",handler="mutate"}`)
+	assert.Contains(t, body, `k8s_pod_mutator_http_request_duration_seconds_count{handler="mutate"}`)
+	assert.Contains(t, body, `k8s_pod_mutator_mutations_total{namespace="some-namespace",outcome="skipped_own_pod",patch="",profile="default"}`)
+	assert.Contains(t, body, `k8s_pod_mutator_mutation_duration_seconds_bucket{namespace="some-namespace",outcome="skipped_own_pod",patch="",profile="default",le="0.0005"}`)
+	assert.Contains(t, body, "k8s_pod_mutator_tls_cert_expiry_timestamp_seconds")
+	assert.Contains(t, body, "go_goroutines")
+}
+
+func TestServer_MetricsOnSeparatePort(t *testing.T) {
+	server, err := CreateServer(ServerSettings{Port: 8443, MetricsPort: 9090}, mutator.NewRegistry(mutator.Mutator{}))
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusNotFound, serve(server, metricsPath).Code)
+
+	recorder := httptest.NewRecorder()
+	server.metricsServer.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "k8s_pod_mutator_http_requests_total")
+}
+
+func TestServer_StopFailsReadinessBeforeDraining(t *testing.T) {
+	server, err := CreateServer(ServerSettings{Port: freePort(t), ShutdownGracePeriod: 200 * time.Millisecond, DrainTimeout: time.Second}, testMutators(t))
+	assert.NoError(t, err)
+	serverErrChan := startServer(t, server)
+
+	stopErrChan := make(chan error, 1)
+	go func() {
+		stopErrChan <- server.Stop()
+	}()
+
+	// during the grace period, the server is still serving but not ready anymore
+	assert.Eventually(t, func() bool {
+		return serve(server, readyzPath).Code == http.StatusServiceUnavailable
+	}, time.Second, 10*time.Millisecond)
+	response, err := http.Get(fmt.Sprintf("http://localhost:%v%v", server.settings.Port, livezPath))
+	if assert.NoError(t, err) {
+		_ = response.Body.Close()
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+	}
+
+	assert.NoError(t, <-stopErrChan)
+	assert.Equal(t, http.ErrServerClosed, <-serverErrChan)
+}
+
+func TestServer_StopTimesOutDraining(t *testing.T) {
+	server, err := CreateServer(ServerSettings{Port: freePort(t), DrainTimeout: 100 * time.Millisecond}, testMutators(t))
+	assert.NoError(t, err)
+	serverErrChan := startServer(t, server)
+
+	// an incomplete request keeps its connection active
+	connection, err := net.Dial("tcp", fmt.Sprintf("localhost:%v", server.settings.Port))
+	assert.NoError(t, err)
+	defer connection.Close()
+	_, err = fmt.Fprint(connection, "POST /mutate HTTP/1.1\r\nHost: localhost\r\n")
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	assert.Error(t, server.Stop())
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Equal(t, http.ErrServerClosed, <-serverErrChan)
+}
+
+func TestServer_FailsIfMetricsPortIsInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	server, err := CreateServer(ServerSettings{Port: freePort(t), MetricsPort: listener.Addr().(*net.TCPAddr).Port}, testMutators(t))
+	assert.NoError(t, err)
+	defer func() { _ = server.httpServer.Close() }()
+
+	err = server.Start()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "metrics server failed")
+	}
+}
+
+func TestServer_FailsIfAdminPortIsInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("some-token"), 0600))
+	server, err := CreateServer(ServerSettings{Port: freePort(t), AdminPort: listener.Addr().(*net.TCPAddr).Port, AdminTokenFile: tokenFile}, testMutators(t))
+	assert.NoError(t, err)
+	defer func() { _ = server.httpServer.Close() }()
+
+	err = server.Start()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "admin server failed")
+	}
+}
+
+func startServer(t *testing.T, server *Server) <-chan error {
+	serverErrChan := make(chan error, 1)
+	go func() {
+		serverErrChan <- server.Start()
+	}()
+	assert.Eventually(t, func() bool {
+		connection, err := net.Dial("tcp", fmt.Sprintf("localhost:%v", server.settings.Port))
+		if err == nil {
+			_ = connection.Close()
+		}
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	return serverErrChan
+}
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestServer_RejectsOversizedBodies(t *testing.T) {
+	server, err := CreateServer(ServerSettings{Port: 8443, MaxRequestBodyBytes: 128}, testMutators(t))
+	assert.NoError(t, err)
+
+	review := `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview", "request": {"uid": "some-uid", "kind": {"group": "", "version": "v1", "kind": "Pod"}, "operation": "CREATE", "object": {"metadata": {"name": "some-pod-with-a-long-name-that-exceeds-the-limit"}}}}`
+	for _, contentLength := range []int64{int64(len(review)), -1} {
+		request := httptest.NewRequest(http.MethodPost, mutatePath, strings.NewReader(review))
+		request.Header.Set("Content-Type", "application/json")
+		// -1: unknown length, e.g. chunked encoding
+		request.ContentLength = contentLength
+
+		recorder := httptest.NewRecorder()
+		server.httpServer.Handler.ServeHTTP(recorder, request)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code, contentLength)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, mutatePath, strings.NewReader(`{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview", "request": {"uid": "some-uid"}}`))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	server.httpServer.Handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestServer_ClosesPartialRequests(t *testing.T) {
+	server, err := CreateServer(ServerSettings{Port: freePort(t), MetricsPort: freePort(t), ReadHeaderTimeout: 100 * time.Millisecond}, testMutators(t))
+	assert.NoError(t, err)
+	startServer(t, server)
+	defer server.Stop()
+
+	for _, port := range []int{server.settings.Port, server.settings.MetricsPort} {
+		// slowloris: the headers are never completed
+		var connection net.Conn
+		assert.Eventually(t, func() bool {
+			connection, err = net.Dial("tcp", fmt.Sprintf("localhost:%v", port))
+			return err == nil
+		}, time.Second, 10*time.Millisecond, port)
+		_, err = fmt.Fprint(connection, "POST /mutate HTTP/1.1\r\nHost: localhost\r\nX-Slow: ")
+		assert.NoError(t, err, port)
+
+		start := time.Now()
+		assert.NoError(t, connection.SetReadDeadline(time.Now().Add(2*time.Second)), port)
+		_, err = ioutil.ReadAll(connection)
+		assert.NoError(t, err, "the server closes the connection on port %v", port)
+		assert.Less(t, int64(time.Since(start)), int64(time.Second), port)
+		_ = connection.Close()
+	}
+}
+
+func TestServer_Http2(t *testing.T) {
+	withoutHttp2, err := CreateServer(ServerSettings{Port: 8443}, testMutators(t))
+	assert.NoError(t, err)
+	assert.NotNil(t, withoutHttp2.httpServer.TLSNextProto)
+	assert.Empty(t, withoutHttp2.httpServer.TLSNextProto)
+
+	withHttp2, err := CreateServer(ServerSettings{Port: 8443, Http2: true}, testMutators(t))
+	assert.NoError(t, err)
+	assert.Nil(t, withHttp2.httpServer.TLSNextProto)
+}
+
+func TestServer_RoutesProfiles(t *testing.T) {
+	server, err := CreateServer(ServerSettings{Port: 8443}, testMutators(t, "some-profile"))
+	assert.NoError(t, err)
+
+	// GET reaches the mutate handler, which only accepts POST
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(server, "/mutate").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(server, "/mutate/some-profile").Code)
+	assert.Equal(t, http.StatusNotFound, serve(server, "/mutate/unknown-profile").Code)
+}
@@ -1,6 +1,35 @@
 package webhook
 
+import "fmt"
+
 type ServiceMetadata struct {
 	Name      string
 	Namespace string
+	// Host is set instead of Name and Namespace if the webhook is reached by URL, e.g. when it runs outside the cluster
+	Host string
+}
+
+// ServerName is the name the API server verifies the TLS cert against
+func (sm ServiceMetadata) ServerName() string {
+	if sm.Host != "" {
+		return sm.Host
+	}
+	return fmt.Sprintf("%v.%v.svc", sm.Name, sm.Namespace)
+}
+
+// Hostnames returns all names (or IPs) the webhook is reachable under. The fully qualified service name is only included if clusterDomain is set.
+func (sm ServiceMetadata) Hostnames(clusterDomain string) []string {
+	if sm.Host != "" {
+		return []string{sm.Host}
+	}
+
+	hostnames := []string{
+		sm.Name,
+		fmt.Sprintf("%v.%v", sm.Name, sm.Namespace),
+		fmt.Sprintf("%v.%v.svc", sm.Name, sm.Namespace),
+	}
+	if clusterDomain != "" {
+		hostnames = append(hostnames, fmt.Sprintf("%v.%v.svc.%v", sm.Name, sm.Namespace, clusterDomain))
+	}
+	return hostnames
 }
@@ -0,0 +1,79 @@
+package webhook
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// TlsVersions returns the names of the supported TLS versions, e.g. for flag descriptions
+func TlsVersions() []string {
+	var names []string
+	for name := range tlsVersions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TlsCurves returns the names of the supported curves, e.g. for flag descriptions
+func TlsCurves() []string {
+	var names []string
+	for name := range tlsCurves {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// createTlsConfig applies the TLS policy of the settings. Only secure cipher suites can be selected, the cipher suites
+// of TLS 1.3 are not configurable.
+func createTlsConfig(settings ServerSettings) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if settings.TlsMinVersion != "" {
+		version, ok := tlsVersions[settings.TlsMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported minimum TLS version %q, expected one of %v", settings.TlsMinVersion, TlsVersions())
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if len(settings.TlsCipherSuites) > 0 {
+		cipherSuites := map[string]uint16{}
+		for _, cipherSuite := range tls.CipherSuites() {
+			cipherSuites[cipherSuite.Name] = cipherSuite.ID
+		}
+		for _, name := range settings.TlsCipherSuites {
+			id, ok := cipherSuites[name]
+			if !ok {
+				return nil, fmt.Errorf("unsupported or insecure TLS cipher suite %q", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+
+	for _, name := range settings.TlsCurves {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS curve %q, expected one of %v", name, TlsCurves())
+		}
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, curve)
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,41 @@
+package webhook
+
+import (
+	"crypto/tls"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCreateTlsConfig(t *testing.T) {
+	tlsConfig, err := createTlsConfig(ServerSettings{
+		TlsMinVersion:   "1.2",
+		TlsCipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+		TlsCurves:       []string{"X25519", "P256"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, tlsConfig.CipherSuites)
+	assert.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, tlsConfig.CurvePreferences)
+
+	defaults, err := createTlsConfig(ServerSettings{})
+	assert.NoError(t, err)
+	assert.Equal(t, &tls.Config{}, defaults)
+}
+
+func TestCreateTlsConfig_RejectsInvalidSettings(t *testing.T) {
+	for _, settings := range []ServerSettings{
+		{TlsMinVersion: "1.4"},
+		{TlsMinVersion: "TLS12"},
+		{TlsCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{TlsCipherSuites: []string{"some-cipher-suite"}},
+		{TlsCurves: []string{"P224"}},
+	} {
+		_, err := createTlsConfig(settings)
+		assert.Error(t, err, "%+v", settings)
+	}
+}
+
+func TestCreateServer_RejectsInvalidTlsSettings(t *testing.T) {
+	_, err := CreateServer(ServerSettings{Tls: true, TlsMinVersion: "1.4"}, testMutators(t))
+	assert.Error(t, err)
+}
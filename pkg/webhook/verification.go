@@ -0,0 +1,237 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"k8s-pod-mutator-webhook/internal/logger"
+	"k8s-pod-mutator-webhook/pkg/mutator"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// VerificationAnnotation records the result of the last verification on the webhook configurations
+const VerificationAnnotation = "k8s-pod-mutator.io/verification"
+
+type VerificationSettings struct {
+	Timeout time.Duration
+	// Address ("<host>:<port>") is dialed instead of the service or URL, e.g. a port-forward when running outside the cluster.
+	// The cert is still verified for the service or URL host.
+	Address string
+	// ClientCertFile and ClientKeyFile are presented as client cert, if set, e.g. the one of the API server if the webhook
+	// requires client certs
+	ClientCertFile string
+	ClientKeyFile  string
+}
+
+// endpoint is where the API server sends admission requests to
+type endpoint struct {
+	url        string
+	address    string
+	serverName string
+}
+
+// Verify checks that the webhook's own service can be reached the way the API server reaches it: a TLS handshake that
+// trusts only the caBundle, followed by a synthetic AdmissionReview for a Pod of the webhook itself, which the webhook
+// admits without mutating it.
+func (c *Configuration) Verify(caBundle []byte, settings VerificationSettings) error {
+	clientConfigs := c.clientConfigs()
+	if len(clientConfigs) == 0 {
+		return fmt.Errorf("no webhooks configured")
+	}
+	endpoint, err := endpointOf(*clientConfigs[0])
+	if err != nil {
+		return err
+	}
+	if settings.Address != "" {
+		endpoint.address = settings.Address
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caBundle) {
+		return fmt.Errorf("caBundle does not contain any PEM encoded certs")
+	}
+	tlsConfig := &tls.Config{
+		RootCAs:    roots,
+		ServerName: endpoint.serverName,
+	}
+	if settings.ClientCertFile != "" || settings.ClientKeyFile != "" {
+		clientCert, err := tls.LoadX509KeyPair(settings.ClientCertFile, settings.ClientKeyFile)
+		if err != nil {
+			return fmt.Errorf("could not load client cert: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+	dialer := &net.Dialer{Timeout: settings.Timeout}
+
+	logger.Logger.WithFields(logrus.Fields{
+		"url":        endpoint.url,
+		"address":    endpoint.address,
+		"serverName": endpoint.serverName,
+	}).Infoln("verifying webhook...")
+
+	connection, err := tls.DialWithDialer(dialer, "tcp", endpoint.address, tlsConfig)
+	if err != nil {
+		return fmt.Errorf("TLS handshake with %v failed: %v", endpoint.address, err)
+	}
+	_ = connection.Close()
+
+	httpClient := &http.Client{
+		Timeout: settings.Timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+			DialContext: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, endpoint.address)
+			},
+		},
+	}
+	if err := sendSyntheticReview(httpClient, endpoint.url); err != nil {
+		return fmt.Errorf("admission review at %v failed: %v", endpoint.url, err)
+	}
+
+	logger.Logger.WithFields(logrus.Fields{
+		"url": endpoint.url,
+	}).Infoln("webhook verified")
+
+	return nil
+}
+
+// RecordVerification annotates the webhook configurations with the result of Verify
+func (c *Configuration) RecordVerification(client kubernetes.Interface, verificationErr error) error {
+	status := fmt.Sprintf("succeeded at %v", time.Now().UTC().Format(time.RFC3339))
+	if verificationErr != nil {
+		status = fmt.Sprintf("failed at %v: %v", time.Now().UTC().Format(time.RFC3339), verificationErr)
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{VerificationAnnotation: status},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, document := range c.documents() {
+		if err := patchDocument(client, document.kind, document.objectMeta.Name, types.MergePatchType, data, metav1.PatchOptions{
+			FieldManager: FieldManager,
+		}); err != nil {
+			return fmt.Errorf("could not record verification on %v %q: %v", document.kind, document.objectMeta.Name, err)
+		}
+	}
+	return nil
+}
+
+func endpointOf(clientConfig admissionregistrationv1.WebhookClientConfig) (endpoint, error) {
+	if clientConfig.URL != nil {
+		webhookUrl, err := url.Parse(*clientConfig.URL)
+		if err != nil {
+			return endpoint{}, fmt.Errorf("invalid clientConfig url: %v", err)
+		}
+		port := webhookUrl.Port()
+		if port == "" {
+			port = "443"
+		}
+		return endpoint{
+			url:        webhookUrl.String(),
+			address:    net.JoinHostPort(webhookUrl.Hostname(), port),
+			serverName: webhookUrl.Hostname(),
+		}, nil
+	}
+
+	serviceMetadata, err := serviceMetadataOf(clientConfig)
+	if err != nil {
+		return endpoint{}, err
+	}
+	port := "443"
+	if clientConfig.Service.Port != nil {
+		port = strconv.Itoa(int(*clientConfig.Service.Port))
+	}
+	path := "/"
+	if clientConfig.Service.Path != nil {
+		path = *clientConfig.Service.Path
+	}
+	address := net.JoinHostPort(serviceMetadata.ServerName(), port)
+	return endpoint{
+		url:        (&url.URL{Scheme: "https", Host: address, Path: path}).String(),
+		address:    address,
+		serverName: serviceMetadata.ServerName(),
+	}, nil
+}
+
+func sendSyntheticReview(httpClient *http.Client, webhookUrl string) error {
+	pod, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": map[string]interface{}{
+			"name":   "k8s-pod-mutator-verification",
+			"labels": map[string]string{mutator.SelfLabel: "verification"},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	dryRun := true
+	reviewRequest := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admission.k8s.io/v1",
+			Kind:       "AdmissionReview",
+		},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       uuid.NewUUID(),
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: pod},
+			DryRun:    &dryRun,
+		},
+	}
+	body, err := json.Marshal(reviewRequest)
+	if err != nil {
+		return err
+	}
+
+	response, err := httpClient.Post(webhookUrl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %v: %v", response.Status, string(responseBody))
+	}
+
+	reviewResponse := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(responseBody, &reviewResponse); err != nil {
+		return fmt.Errorf("could not decode response: %v", err)
+	}
+	switch {
+	case reviewResponse.Response == nil:
+		return fmt.Errorf("response is missing")
+	case reviewResponse.Response.UID != reviewRequest.Request.UID:
+		return fmt.Errorf("response uid %q does not match request uid %q", reviewResponse.Response.UID, reviewRequest.Request.UID)
+	case !reviewResponse.Response.Allowed:
+		return fmt.Errorf("request was not allowed: %+v", reviewResponse.Response.Result)
+	}
+	return nil
+}
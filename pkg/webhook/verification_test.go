@@ -0,0 +1,164 @@
+package webhook
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"k8s-pod-mutator-webhook/pkg/mutator"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfiguration_Verify(t *testing.T) {
+	server, _ := CreateServer(ServerSettings{}, mutator.NewRegistry(mutator.Mutator{}))
+	tlsServer := httptest.NewTLSServer(server.httpServer.Handler)
+	defer tlsServer.Close()
+
+	// the cert of the test server is valid for example.com
+	configuration := verificationConfiguration("https://example.com/mutate")
+	settings := VerificationSettings{Timeout: 5 * time.Second, Address: tlsServer.Listener.Addr().String()}
+
+	assert.NoError(t, configuration.Verify(caBundleOf(tlsServer), settings))
+}
+
+func TestConfiguration_VerifyFails(t *testing.T) {
+	server, _ := CreateServer(ServerSettings{}, mutator.NewRegistry(mutator.Mutator{}))
+	tlsServer := httptest.NewTLSServer(server.httpServer.Handler)
+	defer tlsServer.Close()
+	otherCa := testCertificateHolder(t)
+	writeKeyPair(t, otherCa, "example.com", time.Now().Add(time.Hour))
+	untrustedCaBundle, _ := ioutil.ReadFile(otherCa.certFile)
+	deniedServer := httptest.NewTLSServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		_, _ = fmt.Fprint(responseWriter, `{"response": {"uid": "other-uid", "allowed": true}}`)
+	}))
+	defer deniedServer.Close()
+
+	testCases := []struct {
+		description   string
+		server        *httptest.Server
+		webhookUrl    string
+		caBundle      []byte
+		expectedError string
+	}{
+		{"untrusted ca", tlsServer, "https://example.com/mutate", untrustedCaBundle, "TLS handshake"},
+		{"wrong host", tlsServer, "https://webhook.example.org/mutate", caBundleOf(tlsServer), "TLS handshake"},
+		{"no caBundle", tlsServer, "https://example.com/mutate", nil, "caBundle"},
+		{"wrong path", tlsServer, "https://example.com/validate", caBundleOf(tlsServer), "404"},
+		{"wrong uid", deniedServer, "https://example.com/mutate", caBundleOf(deniedServer), "does not match"},
+	}
+
+	for _, testCase := range testCases {
+		configuration := verificationConfiguration(testCase.webhookUrl)
+		settings := VerificationSettings{Timeout: 5 * time.Second, Address: testCase.server.Listener.Addr().String()}
+
+		err := configuration.Verify(testCase.caBundle, settings)
+		if assert.Error(t, err, testCase.description) {
+			assert.Contains(t, err.Error(), testCase.expectedError, testCase.description)
+		}
+	}
+}
+
+func TestConfiguration_VerifyPresentsClientCert(t *testing.T) {
+	clientCa := newTestCa(t)
+	clientCaFile := filepath.Join(t.TempDir(), "client-ca.crt")
+	assert.NoError(t, ioutil.WriteFile(clientCaFile, clientCa.certPem, 0640))
+	server, err := CreateServer(ServerSettings{Tls: true, ClientCaFile: clientCaFile}, mutator.NewRegistry(mutator.Mutator{}))
+	assert.NoError(t, err)
+
+	tlsServer := httptest.NewUnstartedServer(server.httpServer.Handler)
+	tlsServer.TLS = server.httpServer.TLSConfig.Clone()
+	// the test server provides its own cert
+	tlsServer.TLS.GetCertificate = nil
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+
+	configuration := verificationConfiguration("https://example.com/mutate")
+	settings := VerificationSettings{Timeout: 5 * time.Second, Address: tlsServer.Listener.Addr().String()}
+
+	err = configuration.Verify(caBundleOf(tlsServer), settings)
+	if assert.Error(t, err, "no client cert") {
+		assert.Contains(t, err.Error(), "401")
+	}
+
+	settings.ClientCertFile, settings.ClientKeyFile = writeClientCert(t, clientCa.issue(t, "kube-apiserver", nil))
+	assert.NoError(t, configuration.Verify(caBundleOf(tlsServer), settings))
+
+	settings.ClientKeyFile = filepath.Join(t.TempDir(), "missing.key")
+	assert.Error(t, configuration.Verify(caBundleOf(tlsServer), settings))
+}
+
+func TestEndpointOf(t *testing.T) {
+	port := int32(8443)
+	path := "/mutate"
+	service, err := endpointOf(admissionregistrationv1.WebhookClientConfig{
+		Service: &admissionregistrationv1.ServiceReference{Name: "some-service", Namespace: "some-namespace", Port: &port, Path: &path},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, endpoint{
+		url:        "https://some-service.some-namespace.svc:8443/mutate",
+		address:    "some-service.some-namespace.svc:8443",
+		serverName: "some-service.some-namespace.svc",
+	}, service)
+
+	webhookUrl, err := endpointOf(admissionregistrationv1.WebhookClientConfig{URL: stringPtr("https://webhook.example.org/mutate")})
+	assert.NoError(t, err)
+	assert.Equal(t, endpoint{
+		url:        "https://webhook.example.org/mutate",
+		address:    "webhook.example.org:443",
+		serverName: "webhook.example.org",
+	}, webhookUrl)
+}
+
+func TestConfiguration_RecordVerification(t *testing.T) {
+	configuration, _ := parseTemplate([]byte(multiDocumentWebhookConfiguration))
+	client := fake.NewSimpleClientset(
+		&admissionregistrationv1.MutatingWebhookConfiguration{ObjectMeta: metav1.ObjectMeta{Name: "some-mutating-configuration"}},
+		&admissionregistrationv1.ValidatingWebhookConfiguration{ObjectMeta: metav1.ObjectMeta{Name: "some-validating-configuration"}},
+	)
+
+	assert.NoError(t, configuration.RecordVerification(client, fmt.Errorf("some error")))
+
+	mutating, _ := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.TODO(), "some-mutating-configuration", metav1.GetOptions{})
+	assert.True(t, strings.HasPrefix(mutating.Annotations[VerificationAnnotation], "failed at "))
+	assert.True(t, strings.HasSuffix(mutating.Annotations[VerificationAnnotation], ": some error"))
+
+	assert.NoError(t, configuration.RecordVerification(client, nil))
+
+	validating, _ := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(context.TODO(), "some-validating-configuration", metav1.GetOptions{})
+	assert.True(t, strings.HasPrefix(validating.Annotations[VerificationAnnotation], "succeeded at "))
+}
+
+func verificationConfiguration(webhookUrl string) *Configuration {
+	return &Configuration{
+		mutatingTemplates: []*admissionregistrationv1.MutatingWebhookConfiguration{{
+			Webhooks: []admissionregistrationv1.MutatingWebhook{{ClientConfig: admissionregistrationv1.WebhookClientConfig{URL: &webhookUrl}}},
+		}},
+	}
+}
+
+func caBundleOf(server *httptest.Server) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+}
+
+func writeClientCert(t *testing.T, clientCert *tls.Certificate) (string, string) {
+	keyDer, err := x509.MarshalECPrivateKey(clientCert.PrivateKey.(*ecdsa.PrivateKey))
+	assert.NoError(t, err)
+
+	certFile := filepath.Join(t.TempDir(), "client.crt")
+	keyFile := filepath.Join(t.TempDir(), "client.key")
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCert.Certificate[0]}), 0640))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}